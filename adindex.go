@@ -0,0 +1,163 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type offlineInventory struct {
+	record *Inventory
+	since  time.Time
+}
+
+// record为nil表示回源时没有这个ad_id
+type lruInventory struct {
+	adId   int
+	record *Inventory
+	time   time.Time
+}
+
+// 事件处理按ad_id查物料：在线的直接用快照，最近下线的单独保留一段时间，
+// 都查不到的才回源，回源结果放在LRU里，查不到的结果也缓存，伪造的ad_id不会每次都打到数据库
+type adIdIndex struct {
+	lock    sync.Mutex
+	offline map[int]*offlineInventory
+	lru     map[int]*list.Element
+	order   *list.List // 最近用过的在前面
+
+	hits      int64
+	fallbacks int64
+	notFound  int64
+}
+
+func newAdIdIndex() *adIdIndex {
+	return &adIdIndex{
+		offline: make(map[int]*offlineInventory),
+		lru:     make(map[int]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func indexByAdId(idMap map[int]*Inventory) map[int]*Inventory {
+	byAdId := make(map[int]*Inventory, len(idMap))
+	for _, record := range idMap {
+		byAdId[record.AdId] = record
+	}
+	return byAdId
+}
+
+// 发布新快照时调用：旧快照里有、新快照里没有的转入最近下线，重新上线的移出，
+// 超过保留时间的清掉。回源的结果靠InventoryLruTtl过期
+func (inv *InventoryCache) retire(old *InventorySnapshot, byAdId map[int]*Inventory, now time.Time) {
+	index := inv.adIndex
+	retention := time.Duration(inv.configure.InventoryOfflineRetention) * time.Second
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	for adId, record := range old.ByAdId {
+		if _, ok := byAdId[adId]; !ok {
+			// 快照中的记录不能改，复制一份再标记下线
+			retired := *record
+			retired.Status = "offline"
+			index.offline[adId] = &offlineInventory{record: &retired, since: now}
+		}
+	}
+	for adId, offline := range index.offline {
+		if _, ok := byAdId[adId]; ok || now.Sub(offline.since) > retention {
+			delete(index.offline, adId)
+		}
+	}
+}
+
+func (index *adIdIndex) get(adId int, ttl time.Duration) (*Inventory, bool) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if offline, ok := index.offline[adId]; ok {
+		return offline.record, true
+	}
+	elem, ok := index.lru[adId]
+	if !ok {
+		return nil, false
+	}
+	cached := elem.Value.(*lruInventory)
+	if time.Since(cached.time) > ttl {
+		index.order.Remove(elem)
+		delete(index.lru, adId)
+		return nil, false
+	}
+	index.order.MoveToFront(elem)
+	return cached.record, true
+}
+
+func (index *adIdIndex) put(adId int, record *Inventory, size int) {
+	if size <= 0 {
+		return
+	}
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if elem, ok := index.lru[adId]; ok {
+		index.order.Remove(elem)
+	}
+	index.lru[adId] = index.order.PushFront(&lruInventory{adId: adId, record: record, time: time.Now()})
+	for index.order.Len() > size {
+		oldest := index.order.Back()
+		index.order.Remove(oldest)
+		delete(index.lru, oldest.Value.(*lruInventory).adId)
+	}
+}
+
+// 用ad_id查询，包含已下线的物料，查到的记录复制到record中
+func (inv *InventoryCache) FetchOne(adId int, record *Inventory) error {
+	if found, ok := inv.Snapshot().ByAdId[adId]; ok {
+		atomic.AddInt64(&inv.adIndex.hits, 1)
+		*record = *found
+		return nil
+	}
+	ttl := time.Duration(inv.configure.InventoryLruTtl) * time.Second
+	if found, ok := inv.adIndex.get(adId, ttl); ok {
+		atomic.AddInt64(&inv.adIndex.hits, 1)
+		if found == nil {
+			atomic.AddInt64(&inv.adIndex.notFound, 1)
+			return sql.ErrNoRows
+		}
+		*record = *found
+		return nil
+	}
+	atomic.AddInt64(&inv.adIndex.fallbacks, 1)
+	fetched := &Inventory{}
+	if err := inv.source.FetchOne(adId, fetched); err != nil {
+		if err == sql.ErrNoRows {
+			atomic.AddInt64(&inv.adIndex.notFound, 1)
+			inv.adIndex.put(adId, nil, inv.configure.InventoryLruSize)
+		}
+		return err
+	}
+	// 已下线的物料也可能不合法，解析失败不影响事件处理
+	fetched.Prepare(inv.configure.CurrencyRates, inv.logger)
+	inv.adIndex.put(adId, fetched, inv.configure.InventoryLruSize)
+	*record = *fetched
+	return nil
+}
+
+type AdIdIndexStatus struct {
+	Offline   int   `json:"offline"`
+	Cached    int   `json:"cached"`
+	Hits      int64 `json:"hits"`
+	Fallbacks int64 `json:"fallbacks"`
+	NotFound  int64 `json:"not_found"`
+}
+
+func (inv *InventoryCache) AdIdIndexStatus() *AdIdIndexStatus {
+	index := inv.adIndex
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	return &AdIdIndexStatus{
+		Offline:   len(index.offline),
+		Cached:    len(index.lru),
+		Hits:      atomic.LoadInt64(&index.hits),
+		Fallbacks: atomic.LoadInt64(&index.fallbacks),
+		NotFound:  atomic.LoadInt64(&index.notFound),
+	}
+}
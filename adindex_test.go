@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// 统计回源次数的数据源
+type countingSource struct {
+	InventorySource
+	fetches int
+}
+
+func (s *countingSource) FetchOne(adId int, record *Inventory) error {
+	s.fetches += 1
+	return s.InventorySource.FetchOne(adId, record)
+}
+
+func TestInventoryFetchOne(t *testing.T) {
+	online := testRecord(1, "a", "US", "1")
+	retired := testRecord(2, "b", "US", "1")
+	offline := testRecord(3, "c", "US", "1")
+	offline.Status = "offline"
+	cache, write := newTestInventoryCache(t, []*Inventory{online, retired, offline}, nil)
+	source := &countingSource{InventorySource: cache.source}
+	cache.source = source
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// b下线之后仍然可以从最近下线中查到
+	write([]*Inventory{online, offline})
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	source.fetches = 0
+
+	cases := []struct {
+		name    string
+		adId    int
+		status  string
+		err     error
+		fetches int
+	}{
+		{"online", online.AdId, "online", nil, 0},
+		{"recently retired", retired.AdId, "offline", nil, 0},
+		{"from source", offline.AdId, "offline", nil, 1},
+		{"cached", offline.AdId, "offline", nil, 1},
+		{"not found", 999, "", sql.ErrNoRows, 2},
+		// 查不到的结果也缓存，不再回源
+		{"not found cached", 999, "", sql.ErrNoRows, 2},
+	}
+	for _, c := range cases {
+		record := &Inventory{}
+		err := cache.FetchOne(c.adId, record)
+		if err != c.err || record.Status != c.status || source.fetches != c.fetches {
+			t.Errorf("%v: FetchOne = %+v, %v, %v fetches", c.name, record, err, source.fetches)
+		}
+	}
+	status := cache.AdIdIndexStatus()
+	if status.Offline != 1 || status.Cached != 2 || status.Fallbacks != 2 || status.NotFound != 2 {
+		t.Errorf("status = %+v", status)
+	}
+
+	// 缓存过期之后重新回源，新加进来的ad_id可以查到
+	cache.configure.InventoryLruTtl = -1
+	added := testRecord(899, "d", "US", "1")
+	added.Status = "offline"
+	write([]*Inventory{online, offline, added})
+	record := &Inventory{}
+	if err := cache.FetchOne(999, record); err != nil || record.PackageName != "d" {
+		t.Errorf("FetchOne after expiry = %+v, %v", record, err)
+	}
+}
+
+func TestAdIdIndexLru(t *testing.T) {
+	index := newAdIdIndex()
+	for adId := 1; adId <= 3; adId++ {
+		index.put(adId, &Inventory{AdId: adId}, 2)
+	}
+	index.put(4, nil, 0)
+	cases := []struct {
+		adId  int
+		found bool
+	}{
+		{1, false}, {2, true}, {3, true}, {4, false},
+	}
+	for _, c := range cases {
+		if _, ok := index.get(c.adId, time.Minute); ok != c.found {
+			t.Errorf("get(%v) found = %v", c.adId, ok)
+		}
+	}
+}
@@ -24,8 +24,39 @@ func NewRankTable(rankFile string) (*RankTable, error) {
 	return t, nil
 }
 
+// 由已排好序的列表直接构造，不读文件
+func NewRankTableFromList(rankFile string, rankList []string) *RankTable {
+	t := &RankTable{
+		rankFile:   rankFile,
+		rank:       make(map[string]int),
+		updateTime: time.Now(),
+	}
+	for index, value := range rankList {
+		t.rank[value] = index
+	}
+	return t
+}
+
 func (rt *RankTable) Len() int { return len(rt.rank) }
 
+// 按名次还原成列表，与排序文件的格式一致
+func (rt *RankTable) List() []string {
+	ordered := make([]string, len(rt.rank))
+	for value, index := range rt.rank {
+		if index < len(ordered) {
+			ordered[index] = value
+		}
+	}
+	// 原文件中有重复项时会留下空位
+	rankList := make([]string, 0, len(ordered))
+	for _, value := range ordered {
+		if value != "" {
+			rankList = append(rankList, value)
+		}
+	}
+	return rankList
+}
+
 func (rt *RankTable) Load() error {
 	newTable := make(map[string]int)
 	file, err := os.Open(rt.rankFile)
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// 一个可选的物料，Trials/Rewards来自实时统计
+type BanditArm struct {
+	Record    *Inventory
+	Frequency int
+	Trials    float64
+	Rewards   float64
+}
+
+type BanditChoice struct {
+	Arm        *BanditArm
+	Propensity float64 // 前面位置已定时，该位置上选中这个物料的概率
+}
+
+// 逐个位置选择，已选中的不再参与后续位置
+type BanditPolicy interface {
+	Choose(arms []*BanditArm, count int, r *rand.Rand) []*BanditChoice
+}
+
+func NewBanditPolicy(configure *Configure) (BanditPolicy, error) {
+	mean := configure.DefaultCtr
+	if configure.BanditReward == "conversion" {
+		mean *= configure.DefaultCvr
+	}
+	prior := &betaPrior{
+		alpha: mean * configure.RatePriorWeight,
+		beta:  (1 - mean) * configure.RatePriorWeight,
+	}
+	switch configure.BanditPolicy {
+	case "":
+		return nil, nil
+	case "epsilon_greedy":
+		return &epsilonGreedyPolicy{prior: prior, epsilon: configure.BanditEpsilon}, nil
+	case "ucb":
+		return &ucbPolicy{prior: prior}, nil
+	case "thompson":
+		if configure.BanditPropensitySamples < 1 {
+			return nil, fmt.Errorf("invalid bandit propensity samples: %v", configure.BanditPropensitySamples)
+		}
+		return &thompsonPolicy{prior: prior, samples: configure.BanditPropensitySamples}, nil
+	}
+	return nil, fmt.Errorf("unknown bandit policy: %v", configure.BanditPolicy)
+}
+
+type betaPrior struct {
+	alpha float64
+	beta  float64
+}
+
+func (p *betaPrior) mean(arm *BanditArm) float64 {
+	return (arm.Rewards + p.alpha) / (arm.Trials + p.alpha + p.beta)
+}
+
+// 按先后顺序取最大，并列时排序靠前的优先
+func argmax(values []float64, skip []bool) int {
+	best := -1
+	for i, value := range values {
+		if skip[i] {
+			continue
+		}
+		if best < 0 || value > values[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+type epsilonGreedyPolicy struct {
+	prior   *betaPrior
+	epsilon float64
+}
+
+func (p *epsilonGreedyPolicy) Choose(arms []*BanditArm, count int, r *rand.Rand) []*BanditChoice {
+	means := make([]float64, len(arms))
+	for i, arm := range arms {
+		means[i] = p.prior.mean(arm)
+	}
+	chosen := make([]bool, len(arms))
+	choices := make([]*BanditChoice, 0, count)
+	for remain := len(arms); remain > 0 && len(choices) < count; remain-- {
+		best := argmax(means, chosen)
+		pick := best
+		if r.Float64() < p.epsilon {
+			// 在剩下的里面均匀选一个
+			k := r.Intn(remain)
+			for i := range arms {
+				if chosen[i] {
+					continue
+				}
+				if k == 0 {
+					pick = i
+					break
+				}
+				k--
+			}
+		}
+		propensity := p.epsilon / float64(remain)
+		if pick == best {
+			propensity += 1 - p.epsilon
+		}
+		chosen[pick] = true
+		choices = append(choices, &BanditChoice{Arm: arms[pick], Propensity: propensity})
+	}
+	return choices
+}
+
+// UCB1，确定性策略，选中概率为1
+type ucbPolicy struct {
+	prior *betaPrior
+}
+
+func (p *ucbPolicy) Choose(arms []*BanditArm, count int, r *rand.Rand) []*BanditChoice {
+	total := 1.0
+	for _, arm := range arms {
+		total += arm.Trials
+	}
+	scores := make([]float64, len(arms))
+	for i, arm := range arms {
+		// 先验折算成已有的试验次数，避免新物料的置信上界无穷大
+		trials := arm.Trials + p.prior.alpha + p.prior.beta
+		scores[i] = p.prior.mean(arm) + math.Sqrt(2*math.Log(total+p.prior.alpha+p.prior.beta)/trials)
+	}
+	chosen := make([]bool, len(arms))
+	choices := make([]*BanditChoice, 0, count)
+	for len(choices) < count {
+		best := argmax(scores, chosen)
+		if best < 0 {
+			break
+		}
+		chosen[best] = true
+		choices = append(choices, &BanditChoice{Arm: arms[best], Propensity: 1})
+	}
+	return choices
+}
+
+// Thompson采样，选中概率没有解析解，用多次采样估计。
+// 每个请求只采样一次samples×arms，各个位置共用，只是去掉已选中的物料。
+// 估计的精度是1/(samples+1)，实际选中的那次也计入，记录的选中概率不低于1/(samples+1)，
+// 不会出现0，离线评估时IPS的权重最大为samples+1
+type thompsonPolicy struct {
+	prior   *betaPrior
+	samples int
+}
+
+func (p *thompsonPolicy) draw(arms []*BanditArm, r *rand.Rand) []float64 {
+	values := make([]float64, len(arms))
+	for i, arm := range arms {
+		values[i] = sampleBeta(r, arm.Rewards+p.prior.alpha, arm.Trials-arm.Rewards+p.prior.beta)
+	}
+	return values
+}
+
+func (p *thompsonPolicy) Choose(arms []*BanditArm, count int, r *rand.Rand) []*BanditChoice {
+	draws := make([][]float64, p.samples)
+	for i := range draws {
+		draws[i] = p.draw(arms, r)
+	}
+	chosen := make([]bool, len(arms))
+	choices := make([]*BanditChoice, 0, count)
+	for len(choices) < count {
+		pick := argmax(p.draw(arms, r), chosen)
+		if pick < 0 {
+			break
+		}
+		// 实际选中的这次也算一次，选中概率的下限是1/(samples+1)
+		wins := 1
+		for _, values := range draws {
+			if argmax(values, chosen) == pick {
+				wins++
+			}
+		}
+		chosen[pick] = true
+		choices = append(choices, &BanditChoice{
+			Arm:        arms[pick],
+			Propensity: float64(wins) / float64(p.samples+1),
+		})
+	}
+	return choices
+}
+
+func sampleBeta(r *rand.Rand, alpha float64, beta float64) float64 {
+	if alpha <= 0 {
+		alpha = 1e-3
+	}
+	if beta <= 0 {
+		beta = 1e-3
+	}
+	x := sampleGamma(r, alpha)
+	y := sampleGamma(r, beta)
+	if x+y == 0 {
+		return 0
+	}
+	return x / (x + y)
+}
+
+// Marsaglia & Tsang
+func sampleGamma(r *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return sampleGamma(r, shape+1) * math.Pow(r.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := r.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := r.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func testArms(stats [][2]float64) []*BanditArm {
+	arms := make([]*BanditArm, len(stats))
+	for i, value := range stats {
+		arms[i] = &BanditArm{Record: &Inventory{AdId: i}, Trials: value[0], Rewards: value[1]}
+	}
+	return arms
+}
+
+func testPrior() *betaPrior {
+	return &betaPrior{alpha: 1, beta: 99}
+}
+
+// 多次运行策略，比较每个位置上记录的选中概率和实际的选中频率
+func checkPropensities(t *testing.T, name string, policy BanditPolicy, arms []*BanditArm, count int, runs int, tolerance float64) {
+	r := rand.New(rand.NewSource(7))
+	type slot struct{ position, arm int }
+	picks := make(map[slot]int)
+	propensities := make(map[slot]float64)
+	// 选中概率依赖前面位置的选择，只比较第一个位置的频率，后面的位置比较在相同前缀下的条件频率
+	prefixCounts := make(map[slot]int)
+	for run := 0; run < runs; run++ {
+		choices := policy.Choose(arms, count, r)
+		if len(choices) != count {
+			t.Fatalf("%v: %v choices, want %v", name, len(choices), count)
+		}
+		first := choices[0].Arm.Record.AdId
+		picks[slot{0, first}] += 1
+		propensities[slot{0, first}] += choices[0].Propensity
+		if count > 1 {
+			second := choices[1].Arm.Record.AdId
+			picks[slot{first + 1, second}] += 1
+			propensities[slot{first + 1, second}] += choices[1].Propensity
+			prefixCounts[slot{first + 1, 0}] += 1
+		}
+	}
+	for key, n := range picks {
+		total := runs
+		if key.position > 0 {
+			total = prefixCounts[slot{key.position, 0}]
+		}
+		if total < runs/20 {
+			continue
+		}
+		empirical := float64(n) / float64(total)
+		logged := propensities[key] / float64(n)
+		if math.Abs(empirical-logged) > tolerance {
+			t.Errorf("%v: slot %+v logged propensity %.3f, empirical %.3f", name, key, logged, empirical)
+		}
+	}
+}
+
+func TestBanditPropensities(t *testing.T) {
+	arms := testArms([][2]float64{{1000, 30}, {1000, 20}, {50, 1}, {0, 0}})
+	checkPropensities(t, "epsilon_greedy", &epsilonGreedyPolicy{prior: testPrior(), epsilon: 0.2}, arms, 2, 20000, 0.02)
+	checkPropensities(t, "ucb", &ucbPolicy{prior: testPrior()}, arms, 2, 200, 1e-9)
+	checkPropensities(t, "thompson", &thompsonPolicy{prior: testPrior(), samples: 200}, arms, 2, 5000, 0.05)
+}
+
+func TestBanditChooseBounds(t *testing.T) {
+	policies := map[string]BanditPolicy{
+		"epsilon_greedy": &epsilonGreedyPolicy{prior: testPrior(), epsilon: 0.1},
+		"ucb":            &ucbPolicy{prior: testPrior()},
+		"thompson":       &thompsonPolicy{prior: testPrior(), samples: 10},
+	}
+	r := rand.New(rand.NewSource(1))
+	for name, policy := range policies {
+		cases := []struct{ arms, count, want int }{
+			{0, 3, 0}, {2, 3, 2}, {5, 3, 3},
+		}
+		for _, c := range cases {
+			stats := make([][2]float64, c.arms)
+			choices := policy.Choose(testArms(stats), c.count, r)
+			if len(choices) != c.want {
+				t.Errorf("%v: %v arms, count %v: %v choices", name, c.arms, c.count, len(choices))
+			}
+			seen := make(map[int]bool)
+			for _, choice := range choices {
+				if seen[choice.Arm.Record.AdId] {
+					t.Errorf("%v: arm %v chosen twice", name, choice.Arm.Record.AdId)
+				}
+				seen[choice.Arm.Record.AdId] = true
+				if choice.Propensity <= 0 || choice.Propensity > 1 {
+					t.Errorf("%v: propensity %v", name, choice.Propensity)
+				}
+			}
+		}
+	}
+}
+
+func TestNewBanditPolicy(t *testing.T) {
+	cases := []struct {
+		name string
+		ok   bool
+		nil_ bool
+	}{
+		{"", true, true}, {"epsilon_greedy", true, false}, {"ucb", true, false}, {"thompson", true, false}, {"softmax", false, true},
+	}
+	for _, c := range cases {
+		configure := NewConfigure()
+		configure.BanditPolicy = c.name
+		policy, err := NewBanditPolicy(configure)
+		if (err == nil) != c.ok || (policy == nil) != c.nil_ {
+			t.Errorf("NewBanditPolicy(%q) = %v, %v", c.name, policy, err)
+		}
+	}
+}
+
+func TestSampleBetaMean(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	cases := []struct{ alpha, beta float64 }{
+		{1, 1}, {2, 98}, {0.5, 0.5}, {30, 10}, {0, 5},
+	}
+	for _, c := range cases {
+		sum := 0.0
+		n := 20000
+		for i := 0; i < n; i++ {
+			value := sampleBeta(r, c.alpha, c.beta)
+			if value < 0 || value > 1 {
+				t.Fatalf("Beta(%v, %v) sample %v out of range", c.alpha, c.beta, value)
+			}
+			sum += value
+		}
+		alpha := math.Max(c.alpha, 1e-3)
+		want := alpha / (alpha + c.beta)
+		if math.Abs(sum/float64(n)-want) > 0.01 {
+			t.Errorf("Beta(%v, %v) mean %v, want %v", c.alpha, c.beta, sum/float64(n), want)
+		}
+	}
+}
+
+func benchmarkArms(n int) []*BanditArm {
+	stats := make([][2]float64, n)
+	for i := range stats {
+		stats[i] = [2]float64{float64(100 * i), float64(i)}
+	}
+	return testArms(stats)
+}
+
+func BenchmarkThompsonChoose(b *testing.B) {
+	configure := NewConfigure()
+	policy := &thompsonPolicy{prior: testPrior(), samples: configure.BanditPropensitySamples}
+	arms := benchmarkArms(50)
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		policy.Choose(arms, 8, r)
+	}
+}
+
+// 几乎不可能被选中的物料被选中时，记录的选中概率也不低于1/(samples+1)
+func TestThompsonPropensityFloor(t *testing.T) {
+	arms := testArms([][2]float64{{100000, 10000}, {100000, 10}, {0, 0}})
+	r := rand.New(rand.NewSource(5))
+	cases := []int{1, 20, 200}
+	for _, samples := range cases {
+		policy := &thompsonPolicy{prior: testPrior(), samples: samples}
+		floor := 1 / float64(samples+1)
+		for run := 0; run < 200; run++ {
+			for _, choice := range policy.Choose(arms, 3, r) {
+				if choice.Propensity < floor-1e-12 || choice.Propensity > 1 {
+					t.Fatalf("samples %v: propensity %v, floor %v", samples, choice.Propensity, floor)
+				}
+			}
+		}
+	}
+	configure := NewConfigure()
+	configure.BanditPolicy = "thompson"
+	configure.BanditPropensitySamples = 0
+	if _, err := NewBanditPolicy(configure); err == nil {
+		t.Errorf("thompson with no samples accepted")
+	}
+}
@@ -14,27 +14,38 @@ type Configure struct {
 	CallbackAddress string `default:"0.0.0.0:8705"`
 	ClickAddress    string `default:"0.0.0.0:8705"`
 
+	InventorySource   string `default:"mysql"` // mysql, sqlite, json, csv
+	InventoryFilePath string `default:""`      // sqlite/json/csv数据源的文件路径
+
 	MySqlAddress        string `default:"localhost:3306"`
 	MySqlUser           string `default:"root"`
 	MySqlPassword       string `default:""`
 	MySqlDatabase       string `default:""`
 	MysqlUpdateInterval int    `default:"60"`
 
+	InventoryIncrementalEnable  bool `default:"true"`
+	InventoryFullReloadInterval int  `default:"3600"` // 增量模式下全量重载的间隔，秒
+
+	InventorySnapshotPath     string `default:"inventory.snapshot"` // 为空则不落盘
+	InventorySnapshotInterval int    `default:"300"`                // 增量更新后落盘的最小间隔，秒
+
 	KafkaEnable          bool   `default:"true"`
 	KafkaBrokers         string `default:"localhost:9092"`
 	KafkaRequestTopic    string `default:"request"`
 	KafkaImressionTopic  string `default:"impression"`
 	KafkaClickTopic      string `default:"click"`
 	KafkaConversionTopic string `default:"td_postback"`
+	KafkaWinTopic        string `default:"win"`
 
 	RedisAddress           string `default:"localhost:6379"`
 	RedisCachePrefix       string `default:"param:"`
 	RedisFrequencyPrefix   string `default:"fr:"`
-	RedisFrequencyPerId    int    `default:"5"`
+	RedisFrequencyPerId    int    `default:"5"` // 没有配置FrequencyCaps时的lifetime频控
 	RedisRequestTimeout    int    `default:"43200"`
 	RedisImpressionTimeout int    `default:"86400"`
 	RedisClickTimeout      int    `default:"259200"`
 	RedisConversionTimeout int    `default:"43200"`
+	RedisRatePrefix        string `default:"rate:"`
 
 	LogLevel string `default:"debug"`
 	LogDir   string `default:""`
@@ -44,14 +55,119 @@ type Configure struct {
 
 	TrafficRandom int `default:"80"`
 
+	// win通知中的成交价密钥，websafe base64，为空表示明文
+	PriceEncryptionKey string `default:""`
+	PriceIntegrityKey  string `default:""`
+
 	ModelDataSaveDir string `default:"./"`
 
 	RankTablePath string `default:"adrank.json"`
+
+	// table按排序表，ecpm按出价乘预估点击率转化率
+	RankMode   string  `default:"table"`
+	DefaultCtr float64 `default:"0.01"`
+	DefaultCvr float64 `default:"0.05"`
+	// 非美元出价的汇率，1单位该币种折合多少美元，如{"EUR": 1.08}。
+	// 排序前统一折算成美元，没有汇率的币种的物料不上线
+	CurrencyRates map[string]float64
+
+	// 实时点击率转化率统计，ecpm排序时使用
+	RateEnable       bool    `default:"true"`
+	RateSyncInterval int     `default:"30"`
+	RateWindowDays   int     `default:"7"`
+	RatePriorWeight  float64 `default:"100"`
+
+	// 不为空时用bandit选物料，取代TrafficRandom的固定分流：epsilon_greedy, ucb, thompson
+	BanditPolicy            string  `default:""`
+	BanditReward            string  `default:"click"` // click, conversion
+	BanditEpsilon           float64 `default:"0.1"`
+	BanditPropensitySamples int     `default:"20"` // thompson估计选中概率的采样次数，每个请求采样一次，各位置共用；记录的选中概率不低于1/(samples+1)
+
+	// 在请求和model.save中记录候选包名，ope评估候选排序表时需要，会显著增加日志和redis的体积
+	OpeLogCandidates bool `default:"false"`
+
+	// pCTR模型文件，为空表示不启用，按排序表排序
+	ModelPath           string `default:""`
+	ModelReloadInterval int    `default:"60"`
+
+	// 用户画像，按包名和类目记录展示、点击和安装
+	ProfileEnable          bool    `default:"false"`
+	RedisProfilePrefix     string  `default:"profile:"`
+	ProfileTtl             int     `default:"2592000"` // 秒
+	ProfileMaxEntries      int     `default:"200"`     // 每个用户保留的包名和类目总数
+	ProfileFilterInstalled bool    `default:"true"`
+	ProfileCategoryBoost   float64 `default:"0.2"`
+
+	// 特征抽取，FeatureNames为空时使用全部基础特征，
+	// FeatureCrosses每一项是参与交叉的基础特征名，见features.go
+	FeatureNames   []string
+	FeatureCrosses [][]string
+
+	// 在线FTRL，用展示和点击的关联训练
+	FtrlEnable             bool    `default:"false"`
+	FtrlAlpha              float64 `default:"0.05"`
+	FtrlBeta               float64 `default:"1"`
+	FtrlL1                 float64 `default:"1"`
+	FtrlL2                 float64 `default:"1"`
+	FtrlLabelWindow        int     `default:"600"`     // 展示之后等待点击的时间，秒
+	FtrlMaxPending         int     `default:"1000000"` // 最多挂起的展示数，超过时丢掉最早的，不作为样本
+	FtrlHoldoutPercent     int     `default:"5"`
+	FtrlHoldoutWindow      int     `default:"100000"` // 计算AUC和logloss的最近留出样本数
+	FtrlCheckpointPath     string  `default:"ftrl.model"`
+	FtrlCheckpointInterval int     `default:"300"`
+
+	// 频控规则，见FrequencyCapRule，为空时使用RedisFrequencyPerId
+	FrequencyCaps        []*FrequencyCapRule
+	FrequencyLifetimeTtl int `default:"7776000"` // lifetime计数多久不展示后过期，秒
+
+	// 跟踪链接的param使用AES-GCM加密的token，事件回调不再依赖redis中保存的请求。
+	// TrackingTokenKey为hex编码的16、24或32字节密钥。转化回调的param由广告主透传，仍是旧格式
+	TrackingTokenEnable bool   `default:"false"`
+	TrackingTokenKey    string `default:""`
+
+	// 跟踪链接和win、loss通知的签名，第一个密钥用于签名，其余的只用于校验；为空时不签名
+	TrackingSignKeys []*SigningKey
+	TrackingSignTtl  int `default:"604800"` // 签名的有效期，秒
+
+	// 事件关联：进程内缓存最近的请求，再查redis，关联不上的进重试队列，不占用worker。
+	// 重试队列由JoinRetryWorkers个goroutine并发重试，JoinDeadline之内带退避，之后每JoinRetryInterval秒一次，
+	// 最多等JoinRetryMaxAge秒。重试队列每JoinRetryInterval秒写到AsyncSpillDir/join.retry，重启后重新提交
+	JoinCacheSize      int `default:"50000"`
+	JoinCacheTtl       int `default:"300"`  // 秒
+	JoinDeadline       int `default:"3000"` // 毫秒
+	JoinRetryQueueSize int `default:"10000"`
+	JoinRetryInterval  int `default:"10"`
+	JoinRetryMaxAge    int `default:"600"`
+	JoinRetryWorkers   int `default:"8"`
+
+	// 事件处理按ad_id查物料：下线的物料保留InventoryOfflineRetention秒，
+	// 快照中没有的回源查询，结果放在LRU里
+	InventoryOfflineRetention int `default:"259200"`
+	InventoryLruSize          int `default:"10000"`
+	InventoryLruTtl           int `default:"600"`
+
+	// 响应之后的异步处理，每种事件（request、impression、click、conversion、win、loss）一个worker池。
+	// 队列满时按AsyncOverflow处理：drop丢弃，block等待，spill写到AsyncSpillDir稍后重放；
+	// request池默认spill。AsyncPools可以按事件覆盖这几个设置，见WorkerPoolConfig
+	AsyncWorkers             int    `default:"8"`
+	AsyncQueueSize           int    `default:"10000"`
+	AsyncOverflow            string `default:"drop"`
+	AsyncSpillDir            string `default:"spill"`
+	AsyncSpillReplayInterval int    `default:"10"`
+	AsyncPools               map[string]*WorkerPoolConfig
+
+	// 分层实验，见ExperimentLayer
+	Experiments []*ExperimentLayer
 }
 
 func NewConfigure() *Configure {
 	configure := &Configure{}
 	configure.InitWithDefault()
+	// 复制一份，加载配置和修改时不能改到默认值
+	configure.FeatureCrosses = make([][]string, len(DefaultFeatureCrosses))
+	for i, cross := range DefaultFeatureCrosses {
+		configure.FeatureCrosses[i] = append([]string(nil), cross...)
+	}
 	return configure
 }
 
@@ -68,6 +184,10 @@ func (c *Configure) InitWithDefault() {
 			if i, err := strconv.ParseInt(t.Tag.Get("default"), 10, 32); err == nil {
 				v.SetInt(i)
 			}
+		case reflect.Float64:
+			if f, err := strconv.ParseFloat(t.Tag.Get("default"), 64); err == nil {
+				v.SetFloat(f)
+			}
 		case reflect.Bool:
 			if i, err := strconv.ParseBool(strings.ToLower(t.Tag.Get("default"))); err == nil {
 				v.SetBool(i)
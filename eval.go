@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type evalCell struct {
+	impressions int
+	clicks      int
+	activates   int
+}
+
+var evalDimensions = map[string]func(data *ModelData) string{
+	"placement": func(data *ModelData) string { return data.AdUnitId },
+	"country": func(data *ModelData) string {
+		if data.IpLib != nil && data.IpLib.CountryCode != "" {
+			return data.IpLib.CountryCode
+		}
+		return data.Cc
+	},
+	"package": func(data *ModelData) string { return data.SelectedCreative.PackageName },
+	"adgroup": func(data *ModelData) string { return data.AdgroupId },
+	"hour": func(data *ModelData) string {
+		return fmt.Sprintf("%02d", time.Unix(data.Timestamp, 0).UTC().Hour())
+	},
+	"experiments": func(data *ModelData) string { return data.Experiments },
+}
+
+// rtblite eval [-by placement,country] [-model ctr.model] model.save model.save.20160101 ...
+// 按request_id和物料把展示、点击、激活串成漏斗，分维度输出CTR和CVR；
+// 指定模型时对有展示的漏斗重新打分，输出点击的AUC和logloss
+func RunEval(args []string) error {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	by := flags.String("by", "placement,country,package,adgroup,hour", "分组维度，逗号分隔")
+	modelFile := flags.String("model", "", "待评估的模型文件")
+	configFile := flags.String("c", "", "配置文件，用其中的特征设置给模型打分")
+	minImpressions := flags.Int("min", 0, "展示数少于此值的分组不输出")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: rtblite eval [options] model.save ...")
+	}
+	dimensions := make([]string, 0)
+	for _, name := range strings.Split(*by, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := evalDimensions[name]; !ok {
+			return fmt.Errorf("unknown dimension: %v", name)
+		}
+		dimensions = append(dimensions, name)
+	}
+	extractor, err := loadFeatureExtractor(*configFile)
+	if err != nil {
+		return err
+	}
+	var model *LinearModel = nil
+	if *modelFile != "" {
+		if model, err = LoadLinearModel(*modelFile); err != nil {
+			return err
+		}
+	}
+
+	funnels, invalid, err := JoinModelDataLogs(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	total := &evalCell{}
+	orphans := 0
+	cells := make(map[string]map[string]*evalCell)
+	for _, name := range dimensions {
+		cells[name] = make(map[string]*evalCell)
+	}
+	scores := make([]float64, 0)
+	labels := make([]float64, 0)
+	for _, funnel := range funnels {
+		if !funnel.Impression {
+			// 展示日志丢失或者在更早的文件里
+			orphans += 1
+			continue
+		}
+		targets := []*evalCell{total}
+		for _, name := range dimensions {
+			value := evalDimensions[name](funnel.Data)
+			cell, ok := cells[name][value]
+			if !ok {
+				cell = &evalCell{}
+				cells[name][value] = cell
+			}
+			targets = append(targets, cell)
+		}
+		for _, cell := range targets {
+			cell.impressions += 1
+			if funnel.Click {
+				cell.clicks += 1
+			}
+			if funnel.Activate {
+				cell.activates += 1
+			}
+		}
+		if model != nil {
+			scores = append(scores, model.Predict(extractor.Extract(funnel.Data.Request(), funnel.Data.SelectedCreative)))
+			labels = append(labels, funnel.Label("click"))
+		}
+	}
+	if total.impressions == 0 {
+		return errors.New("no impression found")
+	}
+
+	fmt.Printf("funnels:\t%v (%v without impression, %v invalid lines)\n", len(funnels), orphans, invalid)
+	printEvalHeader("total")
+	printEvalCell("*", total)
+	for _, name := range dimensions {
+		values := make([]string, 0, len(cells[name]))
+		for value := range cells[name] {
+			values = append(values, value)
+		}
+		sort.Slice(values, func(i, j int) bool {
+			a, b := cells[name][values[i]], cells[name][values[j]]
+			if a.impressions != b.impressions {
+				return a.impressions > b.impressions
+			}
+			return values[i] < values[j]
+		})
+		printEvalHeader(name)
+		for _, value := range values {
+			if cells[name][value].impressions >= *minImpressions {
+				printEvalCell(value, cells[name][value])
+			}
+		}
+	}
+	if model != nil {
+		fmt.Printf("\nmodel:\t\t%v\n", *modelFile)
+		fmt.Printf("AUC:\t\t%.6f\n", Auc(scores, labels))
+		fmt.Printf("logloss:\t%.6f\n", LogLoss(scores, labels))
+	}
+	return nil
+}
+
+func printEvalHeader(name string) {
+	fmt.Printf("\n%v\timpressions\tclicks\tactivates\tctr\tcvr\n", name)
+}
+
+// cvr为激活数除以点击数
+func printEvalCell(value string, cell *evalCell) {
+	ctr, cvr := 0.0, 0.0
+	if cell.impressions > 0 {
+		ctr = float64(cell.clicks) / float64(cell.impressions)
+	}
+	if cell.clicks > 0 {
+		cvr = float64(cell.activates) / float64(cell.clicks)
+	}
+	if value == "" {
+		value = "-"
+	}
+	fmt.Printf("%v\t%v\t%v\t%v\t%.6f\t%.6f\n", value, cell.impressions, cell.clicks, cell.activates, ctr, cvr)
+}
+
+// 离线命令读取配置文件中的特征设置，不指定时使用默认配置
+func loadFeatureExtractor(file string) (*FeatureExtractor, error) {
+	configure := NewConfigure()
+	if file != "" {
+		if err := configure.LoadFromFile(file); err != nil {
+			return nil, err
+		}
+	}
+	return NewFeatureExtractorFromConfigure(configure)
+}
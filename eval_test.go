@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func modelDataLines(t *testing.T, records ...*ModelData) string {
+	lines := make([]string, 0, len(records))
+	for _, data := range records {
+		line, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func testModelData(requestId string, adId int, event string, timestamp int64) *ModelData {
+	return &ModelData{
+		RequestId:        requestId,
+		Event:            event,
+		Timestamp:        timestamp,
+		AdUnitId:         "p1",
+		Cc:               "US",
+		SelectedCreative: &Inventory{AdId: adId, PackageName: "a"},
+	}
+}
+
+func TestJoinModelDataLogs(t *testing.T) {
+	second := testModelData("r1", 2, "impression", 10)
+	second.Position = 1
+	content := modelDataLines(t,
+		testModelData("r2", 1, "click", 20),
+		testModelData("r1", 1, "impression", 10),
+		second,
+		testModelData("r1", 1, "click", 11),
+		testModelData("r1", 1, "activate", 15),
+		testModelData("r3", 1, "impression", 5),
+	) + "not json\n{\"event\":\"impression\"}\n\n"
+	funnels, invalid, err := JoinModelDataLogs([]string{writeTempFile(t, "model.save", content)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invalid != 2 {
+		t.Errorf("invalid = %v", invalid)
+	}
+	want := []struct {
+		requestId                   string
+		adId                        int
+		impression, click, activate bool
+	}{
+		{"r3", 1, true, false, false},
+		{"r1", 1, true, true, true},
+		{"r1", 2, true, false, false},
+		{"r2", 1, false, true, false},
+	}
+	if len(funnels) != len(want) {
+		t.Fatalf("%v funnels", len(funnels))
+	}
+	for i, w := range want {
+		f := funnels[i]
+		if f.Data.RequestId != w.requestId || f.Data.SelectedCreative.AdId != w.adId ||
+			f.Impression != w.impression || f.Click != w.click || f.Activate != w.activate {
+			t.Errorf("funnel %v = %+v %+v", i, f, f.Data)
+		}
+	}
+	if funnels[1].Label("click") != 1 || funnels[1].Label("activate") != 1 || funnels[2].Label("click") != 0 {
+		t.Errorf("labels of %+v", funnels[1])
+	}
+	if _, _, err := JoinModelDataLogs([]string{"/no/such/model.save"}); err == nil {
+		t.Errorf("missing file joined")
+	}
+}
+
+func TestEvalDimensions(t *testing.T) {
+	data := testModelData("r", 1, "impression", 3600*5+1)
+	data.AdgroupId = "7"
+	data.Experiments = "strategy:random"
+	want := map[string]string{
+		"placement": "p1", "country": "US", "package": "a", "adgroup": "7", "hour": "05", "experiments": "strategy:random",
+	}
+	for name, value := range want {
+		if got := evalDimensions[name](data); got != value {
+			t.Errorf("%v = %q, want %q", name, got, value)
+		}
+	}
+	// 有IP库的国家时优先用它
+	data.IpLib = &IpLib{CountryCode: "BR"}
+	if got := evalDimensions["country"](data); got != "BR" {
+		t.Errorf("country = %q", got)
+	}
+}
+
+func TestRunEval(t *testing.T) {
+	logs := writeTempFile(t, "model.save", modelDataLines(t,
+		testModelData("r1", 1, "impression", 10),
+		testModelData("r1", 1, "click", 11),
+		testModelData("r2", 1, "impression", 12),
+	))
+	model := writeTempFile(t, "ctr.model", "bias\t-1\n")
+	orphans := writeTempFile(t, "orphans.save", modelDataLines(t, testModelData("r1", 1, "click", 11)))
+	cases := []struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		{"no logs", nil, false},
+		{"default", []string{logs}, true},
+		{"model", []string{"-by", "country, package", "-model", model, logs}, true},
+		{"unknown dimension", []string{"-by", "city", logs}, false},
+		{"missing model", []string{"-model", "/no/such/model", logs}, false},
+		{"no impression", []string{orphans}, false},
+	}
+	for _, c := range cases {
+		if err := RunEval(c.args); (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// 选择策略及其默认的adgroup
+const (
+	StrategyMixed   = "mixed" // 按TrafficRandom在random和package之间分流
+	StrategyRandom  = "random"
+	StrategyPackage = "package"
+	StrategyBandit  = "bandit"
+)
+
+var strategyAdgroups = map[string]string{
+	StrategyRandom:  "1",
+	StrategyPackage: "4",
+	StrategyBandit:  "5",
+}
+
+// 用cid加盐哈希分桶，同一个用户在同一层里总是落在同一个桶
+func StickyBucket(salt string, cid string) int {
+	if cid == "" {
+		return rand.Intn(100)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(salt))
+	h.Write([]byte{'|'})
+	h.Write([]byte(cid))
+	return int(h.Sum32() % 100)
+}
+
+type ExperimentVariant struct {
+	Name     string            `json:"name"`
+	Share    int               `json:"share"`    // 流量百分比
+	Strategy string            `json:"strategy"` // 为空表示不改变选择策略
+	Adgroup  string            `json:"adgroup"`  // 为空则用策略默认的adgroup
+	Params   map[string]string `json:"params"`   // traffic_random，bandit策略的policy, epsilon
+
+	trafficRandom    int
+	hasTrafficRandom bool
+	bandit           BanditPolicy
+}
+
+// 实验可以改变的参数，每个参数只能由一层设置
+const (
+	ExperimentParamStrategy      = "strategy" // 包括bandit的policy和epsilon
+	ExperimentParamTrafficRandom = "traffic_random"
+	ExperimentParamAdgroup       = "adgroup"
+)
+
+// 一层实验，层与层之间用不同的盐独立分桶，可以同时进行。
+// 不同的层设置的参数不能重叠，这样各层的效果互不覆盖，分组标签也准确
+type ExperimentLayer struct {
+	Name     string               `json:"name"`
+	Salt     string               `json:"salt"`
+	Variants []*ExperimentVariant `json:"variants"`
+}
+
+func (layer *ExperimentLayer) Variant(cid string) *ExperimentVariant {
+	salt := layer.Salt
+	if salt == "" {
+		salt = layer.Name
+	}
+	bucket := StickyBucket(salt, cid)
+	for _, variant := range layer.Variants {
+		if bucket < variant.Share {
+			return variant
+		}
+		bucket -= variant.Share
+	}
+	return nil
+}
+
+// 一次请求的分组结果
+type ExperimentAssignment struct {
+	Strategy      string
+	Adgroup       string
+	TrafficRandom int
+	Bandit        BanditPolicy
+	Labels        []string // 层名:组名
+}
+
+func (a *ExperimentAssignment) String() string {
+	return strings.Join(a.Labels, ",")
+}
+
+type Experiments struct {
+	configure     *Configure
+	layers        []*ExperimentLayer
+	defaultBandit BanditPolicy
+}
+
+func NewExperiments(configure *Configure, defaultBandit BanditPolicy, ratesEnabled bool) (*Experiments, error) {
+	names := make(map[string]bool)
+	// 参数 -> 设置它的层
+	owners := make(map[string]string)
+	for _, layer := range configure.Experiments {
+		if layer.Name == "" || names[layer.Name] {
+			return nil, fmt.Errorf("experiment layer name empty or duplicated: %q", layer.Name)
+		}
+		names[layer.Name] = true
+		total := 0
+		for _, variant := range layer.Variants {
+			if variant.Share < 0 {
+				return nil, fmt.Errorf("experiment %v/%v: negative share", layer.Name, variant.Name)
+			}
+			total += variant.Share
+			if err := variant.prepare(configure); err != nil {
+				return nil, fmt.Errorf("experiment %v/%v: %v", layer.Name, variant.Name, err.Error())
+			}
+			if variant.Strategy == StrategyBandit && !ratesEnabled {
+				return nil, fmt.Errorf("experiment %v/%v: bandit strategy requires RateEnable", layer.Name, variant.Name)
+			}
+		}
+		if total > 100 {
+			return nil, fmt.Errorf("experiment %v: shares sum up to %v%%", layer.Name, total)
+		}
+		for _, param := range layer.parameters() {
+			if owner, ok := owners[param]; ok {
+				return nil, fmt.Errorf("experiment layers %v and %v both set %v", owner, layer.Name, param)
+			}
+			owners[param] = layer.Name
+		}
+	}
+	return &Experiments{
+		configure:     configure,
+		layers:        configure.Experiments,
+		defaultBandit: defaultBandit,
+	}, nil
+}
+
+// 层里任何一组设置了的参数
+func (layer *ExperimentLayer) parameters() []string {
+	set := make(map[string]bool)
+	for _, variant := range layer.Variants {
+		if variant.Strategy != "" {
+			set[ExperimentParamStrategy] = true
+		}
+		if variant.hasTrafficRandom {
+			set[ExperimentParamTrafficRandom] = true
+		}
+		if variant.Adgroup != "" {
+			set[ExperimentParamAdgroup] = true
+		}
+	}
+	params := make([]string, 0, len(set))
+	for _, param := range []string{ExperimentParamStrategy, ExperimentParamTrafficRandom, ExperimentParamAdgroup} {
+		if set[param] {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+func (v *ExperimentVariant) prepare(configure *Configure) error {
+	for key := range v.Params {
+		switch key {
+		case "traffic_random":
+		case "policy", "epsilon":
+			if v.Strategy != StrategyBandit {
+				return fmt.Errorf("param %v requires bandit strategy", key)
+			}
+		default:
+			return fmt.Errorf("unknown param: %v", key)
+		}
+	}
+	if value, ok := v.Params["traffic_random"]; ok {
+		trafficRandom, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if trafficRandom < 0 || trafficRandom > 100 {
+			return fmt.Errorf("traffic_random out of range: %v", trafficRandom)
+		}
+		v.trafficRandom = trafficRandom
+		v.hasTrafficRandom = true
+	}
+	switch v.Strategy {
+	case "", StrategyMixed, StrategyRandom, StrategyPackage:
+	case StrategyBandit:
+		overridden := *configure
+		if policy, ok := v.Params["policy"]; ok {
+			overridden.BanditPolicy = policy
+		}
+		if value, ok := v.Params["epsilon"]; ok {
+			epsilon, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			overridden.BanditEpsilon = epsilon
+		}
+		bandit, err := NewBanditPolicy(&overridden)
+		if err != nil {
+			return err
+		}
+		if bandit == nil {
+			return fmt.Errorf("bandit strategy without policy")
+		}
+		v.bandit = bandit
+	default:
+		return fmt.Errorf("unknown strategy: %v", v.Strategy)
+	}
+	return nil
+}
+
+func (e *Experiments) Assign(req *ParsedRequest) *ExperimentAssignment {
+	assignment := &ExperimentAssignment{
+		Strategy:      StrategyMixed,
+		TrafficRandom: e.configure.TrafficRandom,
+		Labels:        make([]string, 0, len(e.layers)),
+	}
+	if e.defaultBandit != nil {
+		assignment.Strategy = StrategyBandit
+		assignment.Bandit = e.defaultBandit
+	}
+	for _, layer := range e.layers {
+		variant := layer.Variant(req.Cid)
+		if variant == nil {
+			continue
+		}
+		assignment.Labels = append(assignment.Labels, layer.Name+":"+variant.Name)
+		if variant.Strategy != "" {
+			assignment.Strategy = variant.Strategy
+			assignment.Bandit = variant.bandit
+		}
+		if variant.hasTrafficRandom {
+			assignment.TrafficRandom = variant.trafficRandom
+		}
+		if variant.Adgroup != "" {
+			assignment.Adgroup = variant.Adgroup
+		}
+	}
+	return assignment
+}
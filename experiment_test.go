@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStickyBucket(t *testing.T) {
+	if StickyBucket("layer", "user-1") != StickyBucket("layer", "user-1") {
+		t.Errorf("bucket not sticky")
+	}
+	// 不同的盐分桶互相独立：一层里的同一个桶在另一层里均匀分散
+	counts := make([]int, 100)
+	sameBucket := 0
+	n := 20000
+	for i := 0; i < n; i++ {
+		cid := fmt.Sprintf("user-%v", i)
+		bucket := StickyBucket("a", cid)
+		if bucket < 0 || bucket >= 100 {
+			t.Fatalf("bucket %v out of range", bucket)
+		}
+		counts[bucket] += 1
+		if bucket < 10 && StickyBucket("b", cid) < 10 {
+			sameBucket += 1
+		}
+	}
+	for bucket, count := range counts {
+		if count < n/100/2 || count > n/100*2 {
+			t.Errorf("bucket %v has %v users", bucket, count)
+		}
+	}
+	// 两层都落在前10%的应该约为1%
+	if sameBucket < n/200 || sameBucket > n/50 {
+		t.Errorf("%v users in the first 10%% of both layers", sameBucket)
+	}
+}
+
+func TestExperimentLayerVariant(t *testing.T) {
+	layer := &ExperimentLayer{Name: "l", Variants: []*ExperimentVariant{{Name: "a", Share: 30}, {Name: "b", Share: 20}}}
+	counts := make(map[string]int)
+	n := 10000
+	for i := 0; i < n; i++ {
+		name := "none"
+		if variant := layer.Variant(fmt.Sprintf("u%v", i)); variant != nil {
+			name = variant.Name
+		}
+		counts[name] += 1
+	}
+	for name, share := range map[string]int{"a": 30, "b": 20, "none": 50} {
+		if got := counts[name] * 100 / n; got < share-3 || got > share+3 {
+			t.Errorf("variant %v got %v%%, want %v%%", name, got, share)
+		}
+	}
+}
+
+func TestNewExperimentsValidation(t *testing.T) {
+	variant := func(name string, share int, strategy string, params map[string]string) *ExperimentVariant {
+		return &ExperimentVariant{Name: name, Share: share, Strategy: strategy, Params: params}
+	}
+	cases := []struct {
+		name   string
+		layers []*ExperimentLayer
+		ok     bool
+	}{
+		{"empty", nil, true},
+		{"independent params", []*ExperimentLayer{
+			{Name: "s", Variants: []*ExperimentVariant{variant("r", 50, StrategyRandom, nil)}},
+			{Name: "t", Variants: []*ExperimentVariant{variant("t", 50, "", map[string]string{"traffic_random": "20"})}},
+		}, true},
+		{"two layers set strategy", []*ExperimentLayer{
+			{Name: "a", Variants: []*ExperimentVariant{variant("r", 50, StrategyRandom, nil)}},
+			{Name: "b", Variants: []*ExperimentVariant{variant("p", 50, StrategyPackage, nil)}},
+		}, false},
+		{"two layers set traffic_random", []*ExperimentLayer{
+			{Name: "a", Variants: []*ExperimentVariant{variant("r", 50, StrategyMixed, map[string]string{"traffic_random": "10"})}},
+			{Name: "b", Variants: []*ExperimentVariant{variant("t", 50, "", map[string]string{"traffic_random": "90"})}},
+		}, false},
+		{"two layers set adgroup", []*ExperimentLayer{
+			{Name: "a", Variants: []*ExperimentVariant{{Name: "x", Share: 10, Adgroup: "7"}}},
+			{Name: "b", Variants: []*ExperimentVariant{{Name: "y", Share: 10, Adgroup: "8"}}},
+		}, false},
+		{"duplicated layer", []*ExperimentLayer{{Name: "a"}, {Name: "a"}}, false},
+		{"shares over 100", []*ExperimentLayer{
+			{Name: "a", Variants: []*ExperimentVariant{variant("x", 60, "", nil), variant("y", 50, "", nil)}},
+		}, false},
+		{"unknown strategy", []*ExperimentLayer{{Name: "a", Variants: []*ExperimentVariant{variant("x", 10, "greedy", nil)}}}, false},
+		{"unknown param", []*ExperimentLayer{{Name: "a", Variants: []*ExperimentVariant{variant("x", 10, "", map[string]string{"foo": "1"})}}}, false},
+		{"traffic_random out of range", []*ExperimentLayer{{Name: "a", Variants: []*ExperimentVariant{variant("x", 10, "", map[string]string{"traffic_random": "101"})}}}, false},
+		{"epsilon without bandit", []*ExperimentLayer{{Name: "a", Variants: []*ExperimentVariant{variant("x", 10, StrategyRandom, map[string]string{"epsilon": "0.1"})}}}, false},
+		{"bandit", []*ExperimentLayer{{Name: "a", Variants: []*ExperimentVariant{variant("x", 10, StrategyBandit, map[string]string{"policy": "ucb"})}}}, true},
+		{"bandit without policy", []*ExperimentLayer{{Name: "a", Variants: []*ExperimentVariant{variant("x", 10, StrategyBandit, nil)}}}, false},
+	}
+	for _, c := range cases {
+		configure := NewConfigure()
+		configure.Experiments = c.layers
+		if _, err := NewExperiments(configure, nil, true); (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+		}
+	}
+}
+
+func TestExperimentsAssign(t *testing.T) {
+	configure := NewConfigure()
+	configure.TrafficRandom = 80
+	configure.Experiments = []*ExperimentLayer{
+		{Name: "strategy", Variants: []*ExperimentVariant{{Name: "random", Share: 100, Strategy: StrategyRandom}}},
+		{Name: "traffic", Variants: []*ExperimentVariant{{Name: "low", Share: 100, Params: map[string]string{"traffic_random": "20"}}}},
+		{Name: "group", Variants: []*ExperimentVariant{{Name: "g", Share: 100, Adgroup: "9"}}},
+		{Name: "off", Variants: []*ExperimentVariant{{Name: "x", Share: 0}}},
+	}
+	experiments, err := NewExperiments(configure, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment := experiments.Assign(&ParsedRequest{Cid: "u"})
+	if assignment.Strategy != StrategyRandom || assignment.TrafficRandom != 20 || assignment.Adgroup != "9" {
+		t.Errorf("assignment = %+v", assignment)
+	}
+	if got := assignment.String(); got != "strategy:random,traffic:low,group:g" {
+		t.Errorf("labels = %v", got)
+	}
+
+	// 没有实验时用配置的默认值，配置了bandit时默认走bandit
+	bandit := &ucbPolicy{prior: testPrior()}
+	defaults, _ := NewExperiments(NewConfigure(), bandit, true)
+	if assignment := defaults.Assign(&ParsedRequest{}); assignment.Strategy != StrategyBandit || assignment.Bandit != bandit || assignment.String() != "" {
+		t.Errorf("default assignment = %+v", assignment)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rtblite export [-c rtblite.conf] [-format libsvm] [-label click] [-o train.txt] model.save ...
+// 把日志串成带标签的样本，特征用和线上打分相同的抽取逻辑。
+// libsvm每行为"标签 特征:1 ..."，特征即哈希值，升序去重；
+// csv每行为标签,request_id,ad_id,position,timestamp,空格分隔的特征
+func RunExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configFile := flags.String("c", "", "配置文件，使用其中的特征设置")
+	format := flags.String("format", "libsvm", "输出格式，libsvm或csv")
+	event := flags.String("label", "click", "作为正样本的事件，click或activate")
+	output := flags.String("o", "", "输出文件，默认为标准输出")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: rtblite export [options] model.save ...")
+	}
+	if *format != "libsvm" && *format != "csv" {
+		return fmt.Errorf("unknown format: %v", *format)
+	}
+	if *event != "click" && *event != "activate" {
+		return fmt.Errorf("unknown label: %v", *event)
+	}
+	extractor, err := loadFeatureExtractor(*configFile)
+	if err != nil {
+		return err
+	}
+	funnels, invalid, err := JoinModelDataLogs(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	writer := bufio.NewWriter(out)
+	if *format == "csv" {
+		fmt.Fprintln(writer, "label,request_id,ad_id,position,timestamp,features")
+	}
+	examples, positives := 0, 0
+	for _, funnel := range funnels {
+		// 只有展示过的才是样本
+		if !funnel.Impression {
+			continue
+		}
+		data := funnel.Data
+		label := funnel.Label(*event)
+		features := uniqueFeatures(extractor.Extract(data.Request(), data.SelectedCreative))
+		if *format == "libsvm" {
+			fields := make([]string, 0, len(features)+1)
+			fields = append(fields, strconv.Itoa(int(label)))
+			for _, feature := range features {
+				fields = append(fields, strconv.Itoa(feature)+":1")
+			}
+			fmt.Fprintln(writer, strings.Join(fields, " "))
+		} else {
+			fields := make([]string, len(features))
+			for i, feature := range features {
+				fields[i] = strconv.Itoa(feature)
+			}
+			fmt.Fprintf(writer, "%v,%v,%v,%v,%v,%v\n", int(label), data.RequestId,
+				data.SelectedCreative.AdId, data.Position, data.Timestamp, strings.Join(fields, " "))
+		}
+		examples += 1
+		positives += int(label)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "examples: %v, positives: %v, invalid lines: %v\n", examples, positives, invalid)
+	return nil
+}
+
+func uniqueFeatures(features []int) []int {
+	sorted := make([]int, len(features))
+	copy(sorted, features)
+	sort.Ints(sorted)
+	unique := sorted[:0]
+	for i, feature := range sorted {
+		if i == 0 || feature != sorted[i-1] {
+			unique = append(unique, feature)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUniqueFeatures(t *testing.T) {
+	cases := []struct{ features, want []int }{
+		{nil, []int{}},
+		{[]int{3, 1, 3, 2, 1}, []int{1, 2, 3}},
+		{[]int{-1, 5}, []int{-1, 5}},
+	}
+	for _, c := range cases {
+		features := append([]int{}, c.features...)
+		if got := uniqueFeatures(features); !equalInts(got, c.want) || !equalInts(features, c.features) {
+			t.Errorf("uniqueFeatures(%v) = %v, input %v", c.features, got, features)
+		}
+	}
+}
+
+func TestRunExport(t *testing.T) {
+	logs := writeTempFile(t, "model.save", modelDataLines(t,
+		testModelData("r1", 1, "impression", 10),
+		testModelData("r1", 1, "click", 11),
+		testModelData("r2", 1, "impression", 12),
+		testModelData("r3", 1, "click", 13),
+	))
+	dir := filepath.Dir(logs)
+	cases := []struct {
+		name   string
+		args   []string
+		header string
+		labels []string
+		ok     bool
+	}{
+		{"libsvm", []string{"-label", "click"}, "", []string{"1 ", "0 "}, true},
+		{"csv", []string{"-format", "csv", "-label", "activate"}, "label,request_id,ad_id,position,timestamp,features",
+			[]string{"0,r1,1,0,10,", "0,r2,1,0,12,"}, true},
+		{"unknown format", []string{"-format", "json"}, "", nil, false},
+		{"unknown label", []string{"-label", "install"}, "", nil, false},
+	}
+	for _, c := range cases {
+		output := filepath.Join(dir, c.name+".txt")
+		err := RunExport(append(append(c.args, "-o", output), logs))
+		if (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+		}
+		if !c.ok {
+			continue
+		}
+		content, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if c.header != "" {
+			if lines[0] != c.header {
+				t.Errorf("%v: header %q", c.name, lines[0])
+			}
+			lines = lines[1:]
+		}
+		// 只有展示过的才是样本
+		if len(lines) != len(c.labels) {
+			t.Fatalf("%v: lines %q", c.name, lines)
+		}
+		for i, prefix := range c.labels {
+			if !strings.HasPrefix(lines[i], prefix) {
+				t.Errorf("%v: line %q, want prefix %q", c.name, lines[i], prefix)
+			}
+		}
+	}
+	if err := RunExport(nil); err == nil {
+		t.Errorf("export without logs")
+	}
+}
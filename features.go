@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 默认的特征交叉，每一项是参与交叉的基础特征名
+var DefaultFeatureCrosses = [][]string{
+	{"package", "country"},
+	{"package", "placement"},
+	{"package", "hp"},
+	{"package", "network"},
+	{"ad_type", "country"},
+}
+
+// 请求侧的基础特征
+var requestFeatureNames = []string{
+	"placement", "country", "ip2", "ip3", "os_version", "app_version",
+	"network", "carrier", "language", "hp",
+}
+
+// 物料侧的基础特征
+var creativeFeatureNames = []string{
+	"package", "model_sign1", "ad_type",
+}
+
+// 用户画像和物料组合出的特征，需要在FeatureNames中显式启用
+var userFeatureNames = []string{
+	"user_package", "user_category",
+}
+
+func requestFeatureValue(name string, req *ParsedRequest) string {
+	switch name {
+	case "placement":
+		return req.PlacementId
+	case "country":
+		if req.IpLib != nil {
+			return req.IpLib.CountryCode
+		}
+	case "ip2":
+		if req.IpLib != nil {
+			return strconv.Itoa(req.IpLib.IpHashLevel2)
+		}
+	case "ip3":
+		if req.IpLib != nil {
+			return strconv.Itoa(req.IpLib.IpHashLevel3)
+		}
+	case "os_version":
+		return req.OsVersion
+	case "app_version":
+		return req.ClientVersion
+	case "network":
+		return strconv.Itoa(req.Network)
+	case "carrier":
+		// carrier只取第一个
+		return strings.Split(req.M, ",")[0]
+	case "language":
+		return req.L
+	case "hp":
+		return req.Hp
+	}
+	return ""
+}
+
+func creativeFeatureValue(name string, record *Inventory) string {
+	switch name {
+	case "package":
+		return record.PackageName
+	case "model_sign1":
+		return strconv.Itoa(record.ModelSign1)
+	case "ad_type":
+		return record.AdType
+	}
+	return ""
+}
+
+func userFeatureValue(name string, profile *UserProfile, record *Inventory) string {
+	switch name {
+	case "user_package":
+		return profile.PackageState(record.PackageName)
+	case "user_category":
+		return profile.CategoryState(record.Category)
+	}
+	return ""
+}
+
+// 特征为"名字=取值"的HiveHash，交叉特征的名字和取值用*连接
+func FeatureHash(name string, value string) int {
+	return HiveHash(name + "=" + value)
+}
+
+type FeatureExtractor struct {
+	requestNames  []string
+	creativeNames []string
+	userNames     []string
+	crosses       [][]string
+}
+
+func isFeatureName(names []string, name string) bool {
+	for _, value := range names {
+		if value == name {
+			return true
+		}
+	}
+	return false
+}
+
+// names为使用的基础特征，为空时使用全部请求侧和物料侧特征；交叉特征可以引用未启用的基础特征
+func NewFeatureExtractor(names []string, crosses [][]string) (*FeatureExtractor, error) {
+	if len(names) == 0 {
+		names = append(append([]string{}, requestFeatureNames...), creativeFeatureNames...)
+	}
+	fe := &FeatureExtractor{
+		requestNames:  make([]string, 0, len(names)),
+		creativeNames: make([]string, 0, len(names)),
+		userNames:     make([]string, 0, len(names)),
+		crosses:       crosses,
+	}
+	for _, name := range names {
+		if isFeatureName(requestFeatureNames, name) {
+			fe.requestNames = append(fe.requestNames, name)
+		} else if isFeatureName(creativeFeatureNames, name) {
+			fe.creativeNames = append(fe.creativeNames, name)
+		} else if isFeatureName(userFeatureNames, name) {
+			fe.userNames = append(fe.userNames, name)
+		} else {
+			return nil, fmt.Errorf("unknown feature: %v", name)
+		}
+	}
+	for _, cross := range crosses {
+		if len(cross) < 2 {
+			return nil, fmt.Errorf("feature cross needs at least two features: %v", cross)
+		}
+		for _, name := range cross {
+			if !isFeatureName(requestFeatureNames, name) && !isFeatureName(creativeFeatureNames, name) &&
+				!isFeatureName(userFeatureNames, name) {
+				return nil, fmt.Errorf("unknown feature in cross %v: %v", cross, name)
+			}
+		}
+	}
+	return fe, nil
+}
+
+// 在线打分、在线训练和离线导出都用这个，保证特征一致
+func NewFeatureExtractorFromConfigure(configure *Configure) (*FeatureExtractor, error) {
+	return NewFeatureExtractor(configure.FeatureNames, configure.FeatureCrosses)
+}
+
+// 一次请求内请求侧特征只算一次
+type FeatureContext struct {
+	extractor *FeatureExtractor
+	profile   *UserProfile
+	values    map[string]string
+	features  []int
+}
+
+func (fe *FeatureExtractor) Context(req *ParsedRequest) *FeatureContext {
+	ctx := &FeatureContext{
+		extractor: fe,
+		profile:   req.Profile,
+		values:    make(map[string]string, len(requestFeatureNames)),
+		features:  make([]int, 0, len(fe.requestNames)),
+	}
+	for _, name := range requestFeatureNames {
+		ctx.values[name] = requestFeatureValue(name, req)
+	}
+	for _, name := range fe.requestNames {
+		ctx.features = append(ctx.features, FeatureHash(name, ctx.values[name]))
+	}
+	return ctx
+}
+
+func (ctx *FeatureContext) Extract(record *Inventory) []int {
+	fe := ctx.extractor
+	features := make([]int, 0, len(ctx.features)+len(fe.creativeNames)+len(fe.userNames)+len(fe.crosses))
+	features = append(features, ctx.features...)
+	for _, name := range fe.creativeNames {
+		features = append(features, FeatureHash(name, creativeFeatureValue(name, record)))
+	}
+	for _, name := range fe.userNames {
+		features = append(features, FeatureHash(name, userFeatureValue(name, ctx.profile, record)))
+	}
+	for _, cross := range fe.crosses {
+		crossValues := make([]string, len(cross))
+		for i, name := range cross {
+			if isFeatureName(creativeFeatureNames, name) {
+				crossValues[i] = creativeFeatureValue(name, record)
+			} else if isFeatureName(userFeatureNames, name) {
+				crossValues[i] = userFeatureValue(name, ctx.profile, record)
+			} else {
+				crossValues[i] = ctx.values[name]
+			}
+		}
+		features = append(features, FeatureHash(strings.Join(cross, "*"), strings.Join(crossValues, "*")))
+	}
+	return features
+}
+
+func (fe *FeatureExtractor) Extract(req *ParsedRequest, record *Inventory) []int {
+	return fe.Context(req).Extract(record)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestNewFeatureExtractor(t *testing.T) {
+	cases := []struct {
+		name    string
+		names   []string
+		crosses [][]string
+		ok      bool
+	}{
+		{"defaults", nil, DefaultFeatureCrosses, true},
+		{"user features", []string{"package", "user_package"}, [][]string{{"user_category", "country"}}, true},
+		{"unknown feature", []string{"package", "city"}, nil, false},
+		{"single feature cross", nil, [][]string{{"package"}}, false},
+		{"unknown feature in cross", nil, [][]string{{"package", "city"}}, false},
+	}
+	for _, c := range cases {
+		if _, err := NewFeatureExtractor(c.names, c.crosses); (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+		}
+	}
+}
+
+func TestFeatureExtract(t *testing.T) {
+	req := &ParsedRequest{PlacementId: "p1", M: "72402,72403", IpLib: &IpLib{CountryCode: "BR"}}
+	record := &Inventory{PackageName: "a", Category: "game"}
+	profile := NewUserProfileFromStates("a", "installed", "game", "seen")
+	cases := []struct {
+		name    string
+		names   []string
+		crosses [][]string
+		profile *UserProfile
+		want    []int
+	}{
+		{"request and creative", []string{"carrier", "package"}, nil, nil,
+			[]int{FeatureHash("carrier", "72402"), FeatureHash("package", "a")}},
+		{"cross with a disabled feature", []string{"package"}, [][]string{{"package", "country"}}, nil,
+			[]int{FeatureHash("package", "a"), FeatureHash("package*country", "a*BR")}},
+		{"user features without profile", []string{"user_package"}, [][]string{{"user_category", "placement"}}, nil,
+			[]int{FeatureHash("user_package", "none"), FeatureHash("user_category*placement", "none*p1")}},
+		{"user features", []string{"user_package", "user_category"}, nil, profile,
+			[]int{FeatureHash("user_package", "installed"), FeatureHash("user_category", "seen")}},
+	}
+	for _, c := range cases {
+		extractor, err := NewFeatureExtractor(c.names, c.crosses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		featureRequest := *req
+		featureRequest.Profile = c.profile
+		if got := extractor.Extract(&featureRequest, record); !equalInts(got, c.want) {
+			t.Errorf("%v: features = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 线上打分和日志还原出的请求抽出的特征必须一致
+func TestFeaturesFromModelDataLog(t *testing.T) {
+	names := append(append(append([]string{}, requestFeatureNames...), creativeFeatureNames...), userFeatureNames...)
+	extractor, err := NewFeatureExtractor(names, DefaultFeatureCrosses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &ParsedRequest{
+		Id: "r", PlacementId: "p1", OsVersion: "4.4", ClientVersion: "134", Network: 9, M: "72402",
+		L: "pt_BR", Hp: "com.host", IpLib: &IpLib{CountryCode: "BR", IpHashLevel2: 3, IpHashLevel3: 4},
+		Profile: NewUserProfileFromStates("a", "clicked", "game", "engaged"),
+	}
+	record := &Inventory{AdId: 1, PackageName: "a", Category: "game", ModelSign1: 7, AdType: "big"}
+	req.Creatives = CreativesForRedis(req, []*Inventory{record})
+	online := extractor.Extract(req, record)
+
+	line, err := GetModelDataLog(req, 0, record, "impression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := &ModelData{}
+	if err := json.Unmarshal(line, data); err != nil {
+		t.Fatal(err)
+	}
+	if offline := extractor.Extract(data.Request(), data.SelectedCreative); !equalInts(offline, online) {
+		t.Errorf("offline features %v, online %v", offline, online)
+	}
+}
+
+// 修改或加载配置不能改到默认的交叉特征
+func TestNewConfigureCopiesFeatureCrosses(t *testing.T) {
+	want := make([]string, len(DefaultFeatureCrosses))
+	for i, cross := range DefaultFeatureCrosses {
+		want[i] = fmt.Sprint(cross)
+	}
+	cases := []struct {
+		name   string
+		modify func(configure *Configure)
+	}{
+		{"edit cross", func(configure *Configure) { configure.FeatureCrosses[0][0] = "changed" }},
+		{"append to cross", func(configure *Configure) {
+			configure.FeatureCrosses[0] = append(configure.FeatureCrosses[0][:1], "changed")
+		}},
+		{"unmarshal", func(configure *Configure) {
+			json.Unmarshal([]byte(`{"FeatureCrosses": [["changed", "changed"]]}`), configure)
+		}},
+	}
+	for _, c := range cases {
+		c.modify(NewConfigure())
+		for i, cross := range NewConfigure().FeatureCrosses {
+			if fmt.Sprint(cross) != want[i] || fmt.Sprint(DefaultFeatureCrosses[i]) != want[i] {
+				t.Errorf("%v: cross %v = %v, want %v", c.name, i, cross, want[i])
+			}
+		}
+	}
+}
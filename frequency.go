@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// 频控窗口，hour和day按UTC的自然小时和自然天分桶计数，lifetime只在长时间不展示后过期
+const (
+	FrequencyHour     = "hour"
+	FrequencyDay      = "day"
+	FrequencyLifetime = "lifetime"
+)
+
+var frequencyWindows = []string{FrequencyHour, FrequencyDay, FrequencyLifetime}
+
+// 频控计数的范围：单个物料，或者同一个包名、同一个广告主下的所有物料合计
+const (
+	FrequencyCreative   = "creative"
+	FrequencyPackage    = "package"
+	FrequencyAdvertiser = "advertiser"
+)
+
+var frequencyScopes = []string{FrequencyCreative, FrequencyPackage, FrequencyAdvertiser}
+
+// 一个窗口内最多展示Limit次，Scope为空时按单个物料计数
+type FrequencyCap struct {
+	Scope  string `json:"scope,omitempty"`
+	Window string `json:"window"`
+	Limit  int    `json:"limit"`
+}
+
+func (c *FrequencyCap) scope() string {
+	if c.Scope == "" {
+		return FrequencyCreative
+	}
+	return c.Scope
+}
+
+func checkFrequencyWindow(window string) error {
+	for _, value := range frequencyWindows {
+		if value == window {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown frequency window: %v", window)
+}
+
+func checkFrequencyScope(scope string) error {
+	if scope == "" {
+		return nil
+	}
+	for _, value := range frequencyScopes {
+		if value == scope {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown frequency scope: %v", scope)
+}
+
+// inventory表frequency_cap列的格式，如"hour:2,day:5,lifetime:20"，只作用于单个物料
+func ParseFrequencyCaps(value string) ([]*FrequencyCap, error) {
+	caps := make([]*FrequencyCap, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fields := strings.Split(item, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid frequency cap: %v", item)
+		}
+		window := strings.TrimSpace(fields[0])
+		if err := checkFrequencyWindow(window); err != nil {
+			return nil, err
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid frequency cap: %v", item)
+		}
+		caps = append(caps, &FrequencyCap{Window: window, Limit: limit})
+	}
+	return caps, nil
+}
+
+// 配置中的频控规则，AdId、PackageName、Advertiser为空的不参与匹配，全为空时对所有物料生效。
+// 如{"scope": "package", "window": "day", "limit": 3}限制同一个包名每天对一个用户最多展示3次
+type FrequencyCapRule struct {
+	AdId        int    `json:"ad_id,omitempty"`
+	PackageName string `json:"package_name,omitempty"`
+	Advertiser  string `json:"advertiser,omitempty"`
+	FrequencyCap
+}
+
+func (rule *FrequencyCapRule) Match(record *Inventory) bool {
+	return (rule.AdId == 0 || rule.AdId == record.AdId) &&
+		(rule.PackageName == "" || rule.PackageName == record.PackageName) &&
+		(rule.Advertiser == "" || rule.Advertiser == record.Advertiser)
+}
+
+// 候选物料的频次和是否超频，与候选一一对应
+type Frequencies struct {
+	Counts []int // lifetime窗口的次数，记录到user_frequency
+	Capped []bool
+}
+
+func NewFrequencies(n int) *Frequencies {
+	return &Frequencies{
+		Counts: make([]int, n),
+		Capped: make([]bool, n),
+	}
+}
+
+type FrequencyCapper struct {
+	rules        []*FrequencyCapRule
+	redisWrapper *RedisWrapper
+	configure    *Configure
+	logger       *logging.Logger
+}
+
+func NewFrequencyCapper(configure *Configure, redisWrapper *RedisWrapper, logger *logging.Logger) (*FrequencyCapper, error) {
+	rules := configure.FrequencyCaps
+	if len(rules) == 0 {
+		// 兼容原来的全局频控：超过RedisFrequencyPerId才过滤，即最多展示RedisFrequencyPerId+1次
+		rules = []*FrequencyCapRule{{
+			FrequencyCap: FrequencyCap{Window: FrequencyLifetime, Limit: configure.RedisFrequencyPerId + 1},
+		}}
+	}
+	for _, rule := range rules {
+		if err := checkFrequencyWindow(rule.Window); err != nil {
+			return nil, err
+		}
+		if err := checkFrequencyScope(rule.Scope); err != nil {
+			return nil, err
+		}
+	}
+	return &FrequencyCapper{
+		rules:        rules,
+		redisWrapper: redisWrapper,
+		configure:    configure,
+		logger:       logger,
+	}, nil
+}
+
+// 物料自己配置了频控时替换掉单个物料范围的规则，包名和广告主范围的规则始终生效
+func (fc *FrequencyCapper) Caps(record *Inventory) []*FrequencyCap {
+	caps := make([]*FrequencyCap, 0, len(fc.rules)+len(record.FrequencyCaps))
+	caps = append(caps, record.FrequencyCaps...)
+	for _, rule := range fc.rules {
+		if len(record.FrequencyCaps) > 0 && rule.scope() == FrequencyCreative {
+			continue
+		}
+		if rule.Match(record) {
+			caps = append(caps, &rule.FrequencyCap)
+		}
+	}
+	return caps
+}
+
+// 单个物料的lifetime沿用原来的key，原有的计数继续有效
+func (fc *FrequencyCapper) key(req *ParsedRequest, record *Inventory, scope string, window string, now time.Time) string {
+	var base string
+	switch scope {
+	case FrequencyPackage:
+		base = fmt.Sprintf("%v%v_p:%v", fc.configure.RedisFrequencyPrefix, req.Cid, record.PackageName)
+	case FrequencyAdvertiser:
+		base = fmt.Sprintf("%v%v_a:%v", fc.configure.RedisFrequencyPrefix, req.Cid, record.Advertiser)
+	default:
+		base = fmt.Sprintf("%v%v_%v", fc.configure.RedisFrequencyPrefix, req.Cid, record.ModelSign1)
+	}
+	switch window {
+	case FrequencyHour:
+		return base + ":h" + now.UTC().Format("2006010215")
+	case FrequencyDay:
+		return base + ":d" + now.UTC().Format("20060102")
+	}
+	return base
+}
+
+func (fc *FrequencyCapper) expire(window string) int {
+	switch window {
+	case FrequencyHour:
+		return 2 * 3600
+	case FrequencyDay:
+		return 2 * 86400
+	}
+	return fc.configure.FrequencyLifetimeTtl
+}
+
+// 一次MGET取回所有候选用到的计数，同一个包名或广告主的key只取一次
+func (fc *FrequencyCapper) Check(req *ParsedRequest, creatives []*Inventory, now time.Time) (*Frequencies, error) {
+	frequencies := NewFrequencies(len(creatives))
+	if len(creatives) == 0 {
+		return frequencies, nil
+	}
+	keys := make([]string, 0, len(creatives))
+	slots := make(map[string]int)
+	slot := func(key string) int {
+		if index, ok := slots[key]; ok {
+			return index
+		}
+		slots[key] = len(keys)
+		keys = append(keys, key)
+		return slots[key]
+	}
+	lifetime := make([]int, len(creatives))
+	caps := make([][]*FrequencyCap, len(creatives))
+	capSlots := make([][]int, len(creatives))
+	for index, record := range creatives {
+		lifetime[index] = slot(fc.key(req, record, FrequencyCreative, FrequencyLifetime, now))
+		caps[index] = fc.Caps(record)
+		capSlots[index] = make([]int, len(caps[index]))
+		for i, c := range caps[index] {
+			capSlots[index][i] = slot(fc.key(req, record, c.scope(), c.Window, now))
+		}
+	}
+	counts, err := fc.redisWrapper.GetCounters(keys)
+	if err != nil {
+		return frequencies, err
+	}
+	for index := range creatives {
+		frequencies.Counts[index] = counts[lifetime[index]]
+		for i, c := range caps[index] {
+			if counts[capSlots[index][i]] >= c.Limit {
+				frequencies.Capped[index] = true
+				break
+			}
+		}
+	}
+	return frequencies, nil
+}
+
+// 每次展示所有范围和窗口都计数，改规则之后不用等计数重新积累
+func (fc *FrequencyCapper) Incr(req *ParsedRequest, record *Inventory, now time.Time) error {
+	keys := make([]string, 0, len(frequencyScopes)*len(frequencyWindows))
+	expires := make([]int, 0, len(frequencyScopes)*len(frequencyWindows))
+	for _, scope := range frequencyScopes {
+		for _, window := range frequencyWindows {
+			keys = append(keys, fc.key(req, record, scope, window, now))
+			expires = append(expires, fc.expire(window))
+		}
+	}
+	return fc.redisWrapper.IncrCounters(keys, expires)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFrequencyCaps(t *testing.T) {
+	cases := []struct {
+		value string
+		want  []*FrequencyCap
+		ok    bool
+	}{
+		{"", []*FrequencyCap{}, true},
+		{"hour:2, day:5,lifetime:20,", []*FrequencyCap{
+			{Window: FrequencyHour, Limit: 2}, {Window: FrequencyDay, Limit: 5}, {Window: FrequencyLifetime, Limit: 20},
+		}, true},
+		{"week:2", nil, false},
+		{"day", nil, false},
+		{"day:x", nil, false},
+		{"day:1:2", nil, false},
+	}
+	for _, c := range cases {
+		got, err := ParseFrequencyCaps(c.value)
+		if (err == nil) != c.ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseFrequencyCaps(%q) = %v, %v", c.value, got, err)
+		}
+	}
+}
+
+func TestNewFrequencyCapper(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []*FrequencyCapRule
+		ok    bool
+	}{
+		{"default", nil, true},
+		{"rules", []*FrequencyCapRule{{FrequencyCap: FrequencyCap{Window: FrequencyDay, Limit: 3}}}, true},
+		{"unknown window", []*FrequencyCapRule{{FrequencyCap: FrequencyCap{Window: "week", Limit: 3}}}, false},
+	}
+	for _, c := range cases {
+		configure := NewConfigure()
+		configure.FrequencyCaps = c.rules
+		if _, err := NewFrequencyCapper(configure, nil, testLogger); (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+		}
+	}
+	// 没有规则时沿用原来的全局频控
+	configure := NewConfigure()
+	configure.RedisFrequencyPerId = 4
+	capper, _ := NewFrequencyCapper(configure, nil, testLogger)
+	caps := capper.Caps(&Inventory{})
+	if len(caps) != 1 || caps[0].Window != FrequencyLifetime || caps[0].Limit != 5 {
+		t.Errorf("default caps = %v", caps)
+	}
+}
+
+func TestFrequencyCapsOverride(t *testing.T) {
+	configure := NewConfigure()
+	configure.FrequencyCaps = []*FrequencyCapRule{
+		{FrequencyCap: FrequencyCap{Window: FrequencyLifetime, Limit: 10}},
+		{AdId: 7, FrequencyCap: FrequencyCap{Window: FrequencyHour, Limit: 1}},
+	}
+	capper, err := NewFrequencyCapper(configure, nil, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := []*FrequencyCap{{Window: FrequencyDay, Limit: 2}}
+	cases := []struct {
+		name   string
+		record *Inventory
+		want   []*FrequencyCap
+	}{
+		{"rules", &Inventory{AdId: 1}, []*FrequencyCap{{Window: FrequencyLifetime, Limit: 10}}},
+		{"matching ad_id", &Inventory{AdId: 7}, []*FrequencyCap{{Window: FrequencyLifetime, Limit: 10}, {Window: FrequencyHour, Limit: 1}}},
+		// 物料自己配置的频控替换掉单个物料范围的规则
+		{"own caps", &Inventory{AdId: 7, FrequencyCaps: own}, own},
+	}
+	for _, c := range cases {
+		if got := capper.Caps(c.record); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: caps = %v", c.name, got)
+		}
+	}
+}
+
+func TestFrequencyKeys(t *testing.T) {
+	configure := NewConfigure()
+	configure.RedisFrequencyPrefix = "f_"
+	capper, err := NewFrequencyCapper(configure, nil, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &ParsedRequest{Cid: "u"}
+	a := &Inventory{ModelSign1: 11, PackageName: "pkg", Advertiser: "adv"}
+	b := &Inventory{ModelSign1: 12, PackageName: "pkg", Advertiser: "adv"}
+	now := time.Date(2017, 3, 4, 5, 6, 7, 0, time.FixedZone("CST", 8*3600))
+	cases := []struct {
+		scope, window string
+		want          string
+		shared        bool // 同一个包名和广告主的两个物料共用计数
+	}{
+		{"", FrequencyLifetime, "f_u_11", false},
+		{FrequencyCreative, FrequencyHour, "f_u_11:h2017030321", false},
+		{FrequencyPackage, FrequencyDay, "f_u_p:pkg:d20170303", true},
+		{FrequencyAdvertiser, FrequencyLifetime, "f_u_a:adv", true},
+	}
+	for _, c := range cases {
+		key := capper.key(req, a, c.scope, c.window, now)
+		if key != c.want {
+			t.Errorf("key(%q, %v) = %v, want %v", c.scope, c.window, key, c.want)
+		}
+		if shared := key == capper.key(req, b, c.scope, c.window, now); shared != c.shared {
+			t.Errorf("key(%q, %v) shared = %v", c.scope, c.window, shared)
+		}
+	}
+	expires := map[string]int{FrequencyHour: 7200, FrequencyDay: 172800, FrequencyLifetime: configure.FrequencyLifetimeTtl}
+	for window, want := range expires {
+		if got := capper.expire(window); got != want {
+			t.Errorf("expire(%v) = %v, want %v", window, got, want)
+		}
+	}
+}
+
+func TestFrequencyCapRuleMatch(t *testing.T) {
+	record := &Inventory{AdId: 1, PackageName: "pkg", Advertiser: "adv"}
+	cases := []struct {
+		rule FrequencyCapRule
+		want bool
+	}{
+		{FrequencyCapRule{}, true},
+		{FrequencyCapRule{AdId: 1, PackageName: "pkg"}, true},
+		{FrequencyCapRule{AdId: 2}, false},
+		{FrequencyCapRule{Advertiser: "other"}, false},
+		{FrequencyCapRule{PackageName: "pkg", Advertiser: "adv"}, true},
+	}
+	for _, c := range cases {
+		if got := c.rule.Match(record); got != c.want {
+			t.Errorf("%+v Match = %v", c.rule, got)
+		}
+	}
+	configure := NewConfigure()
+	configure.FrequencyCaps = []*FrequencyCapRule{{FrequencyCap: FrequencyCap{Scope: "campaign", Window: FrequencyDay, Limit: 1}}}
+	if _, err := NewFrequencyCapper(configure, nil, testLogger); err == nil {
+		t.Errorf("unknown scope accepted")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// 特征哈希都是非负的，偏置项用-1
+const ftrlBiasFeature = -1
+
+type pendingExample struct {
+	key      string
+	features []int
+	time     time.Time
+	holdout  bool
+}
+
+type scoredExample struct {
+	score float64
+	label float64
+}
+
+// FTRL-Proximal逻辑回归，用展示和点击的关联在线训练：
+// 展示先挂起，窗口内等到点击就作为正样本，超时作为负样本。
+// 按request_id哈希留出一部分样本只评估不训练，用来算AUC和logloss。
+// 挂起的展示按时间先后排成队列，超时只看队头；超过FtrlMaxPending时丢掉最早的
+type FtrlLearner struct {
+	configure *Configure
+	extractor *FeatureExtractor
+	logger    *logging.Logger
+
+	lock    sync.Mutex
+	z       map[int]float64
+	n       map[int]float64
+	pending map[string]*list.Element
+	queue   *list.List // *pendingExample，按展示时间排序
+	holdout []scoredExample
+	next    int // holdout环形缓冲的写入位置
+
+	trained        int64
+	positives      int64
+	lateClicks     int64
+	dropped        int64
+	lastCheckpoint time.Time
+}
+
+func NewFtrlLearner(configure *Configure, extractor *FeatureExtractor, logger *logging.Logger) *FtrlLearner {
+	return &FtrlLearner{
+		configure: configure,
+		extractor: extractor,
+		logger:    logger,
+		z:         make(map[int]float64),
+		n:         make(map[int]float64),
+		pending:   make(map[string]*list.Element),
+		queue:     list.New(),
+		holdout:   make([]scoredExample, 0),
+	}
+}
+
+func (fl *FtrlLearner) weight(feature int) float64 {
+	z := fl.z[feature]
+	if math.Abs(z) <= fl.configure.FtrlL1 {
+		return 0
+	}
+	sign := 1.0
+	if z < 0 {
+		sign = -1
+	}
+	return -(z - sign*fl.configure.FtrlL1) /
+		((fl.configure.FtrlBeta+math.Sqrt(fl.n[feature]))/fl.configure.FtrlAlpha + fl.configure.FtrlL2)
+}
+
+func (fl *FtrlLearner) predict(features []int) float64 {
+	wx := fl.weight(ftrlBiasFeature)
+	for _, feature := range features {
+		wx += fl.weight(feature)
+	}
+	return Sigmoid(wx)
+}
+
+func (fl *FtrlLearner) update(features []int, label float64) {
+	p := fl.predict(features)
+	g := p - label
+	for _, feature := range append([]int{ftrlBiasFeature}, features...) {
+		w := fl.weight(feature)
+		n := fl.n[feature]
+		sigma := (math.Sqrt(n+g*g) - math.Sqrt(n)) / fl.configure.FtrlAlpha
+		fl.z[feature] += g - sigma*w
+		fl.n[feature] = n + g*g
+	}
+}
+
+// 调用方持有锁
+func (fl *FtrlLearner) learn(example *pendingExample, label float64) {
+	if example.holdout {
+		scored := scoredExample{score: fl.predict(example.features), label: label}
+		if len(fl.holdout) < fl.configure.FtrlHoldoutWindow {
+			fl.holdout = append(fl.holdout, scored)
+		} else if len(fl.holdout) > 0 {
+			fl.holdout[fl.next] = scored
+			fl.next = (fl.next + 1) % len(fl.holdout)
+		}
+		return
+	}
+	fl.update(example.features, label)
+	fl.trained += 1
+	if label > 0 {
+		fl.positives += 1
+	}
+}
+
+func (fl *FtrlLearner) isHoldout(requestId string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(requestId))
+	return int(h.Sum32()%100) < fl.configure.FtrlHoldoutPercent
+}
+
+func (fl *FtrlLearner) OnImpression(req *ParsedRequest, index int, record *Inventory) {
+	featureRequest := *req
+	featureRequest.Profile = req.ProfileAt(index, record)
+	example := &pendingExample{
+		key:      fmt.Sprintf("%v-%v", req.Id, index),
+		features: fl.extractor.Extract(&featureRequest, record),
+		holdout:  fl.isHoldout(req.Id),
+	}
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	// 在锁内取时间，保证队列按时间有序
+	example.time = time.Now()
+	if element, ok := fl.pending[example.key]; ok {
+		fl.queue.Remove(element)
+	}
+	fl.pending[example.key] = fl.queue.PushBack(example)
+	for fl.queue.Len() > fl.configure.FtrlMaxPending {
+		oldest := fl.queue.Remove(fl.queue.Front()).(*pendingExample)
+		delete(fl.pending, oldest.key)
+		fl.dropped += 1
+	}
+}
+
+func (fl *FtrlLearner) OnClick(req *ParsedRequest, index int, record *Inventory) {
+	key := fmt.Sprintf("%v-%v", req.Id, index)
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	element, ok := fl.pending[key]
+	if !ok {
+		// 展示已经作为负样本学过了，或者展示没有关联上
+		fl.lateClicks += 1
+		return
+	}
+	delete(fl.pending, key)
+	fl.learn(fl.queue.Remove(element).(*pendingExample), 1)
+}
+
+// 窗口内没有等到点击的展示作为负样本
+func (fl *FtrlLearner) Expire(now time.Time) {
+	window := time.Duration(fl.configure.FtrlLabelWindow) * time.Second
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	for element := fl.queue.Front(); element != nil; element = fl.queue.Front() {
+		example := element.Value.(*pendingExample)
+		if now.Sub(example.time) < window {
+			break
+		}
+		fl.queue.Remove(element)
+		delete(fl.pending, example.key)
+		fl.learn(example, 0)
+	}
+}
+
+func (fl *FtrlLearner) Model() *LinearModel {
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	model := &LinearModel{
+		Bias:     fl.weight(ftrlBiasFeature),
+		Weights:  make(map[int]float64),
+		Path:     fl.configure.FtrlCheckpointPath,
+		LoadTime: time.Now(),
+	}
+	for feature := range fl.z {
+		if feature == ftrlBiasFeature {
+			continue
+		}
+		if w := fl.weight(feature); w != 0 {
+			model.Weights[feature] = w
+		}
+	}
+	return model
+}
+
+// 权重写到FtrlCheckpointPath，和ModelPath配成同一个文件时即可上线打分；
+// z和n另存一份用于重启后继续训练
+func (fl *FtrlLearner) Checkpoint() error {
+	if err := fl.Model().Save(fl.configure.FtrlCheckpointPath); err != nil {
+		return err
+	}
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	stateFile := fl.configure.FtrlCheckpointPath + ".state"
+	f, err := os.Create(stateFile + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	for feature, z := range fl.z {
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", feature, z, fl.n[feature])
+	}
+	if err := writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fl.lastCheckpoint = time.Now()
+	return os.Rename(stateFile+".tmp", stateFile)
+}
+
+func (fl *FtrlLearner) Restore() error {
+	f, err := os.Open(fl.configure.FtrlCheckpointPath + ".state")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	z := make(map[int]float64)
+	n := make(map[int]float64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		feature, err1 := strconv.Atoi(fields[0])
+		zValue, err2 := strconv.ParseFloat(fields[1], 64)
+		nValue, err3 := strconv.ParseFloat(fields[2], 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		z[feature] = zValue
+		n[feature] = nValue
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fl.lock.Lock()
+	defer fl.lock.Unlock()
+	fl.z = z
+	fl.n = n
+	return nil
+}
+
+func (fl *FtrlLearner) Run() {
+	expireTicker := time.NewTicker(time.Second)
+	checkpointTicker := time.NewTicker(time.Duration(fl.configure.FtrlCheckpointInterval) * time.Second)
+	for {
+		select {
+		case now := <-expireTicker.C:
+			fl.Expire(now)
+		case <-checkpointTicker.C:
+			if err := fl.Checkpoint(); err != nil {
+				fl.logger.Warning("fail to checkpoint ftrl model: %v", err.Error())
+			}
+		}
+	}
+}
+
+type FtrlStatus struct {
+	Trained        int64     `json:"trained"`
+	Positives      int64     `json:"positives"`
+	LateClicks     int64     `json:"late_clicks"`
+	Dropped        int64     `json:"dropped"`
+	Pending        int       `json:"pending"`
+	Features       int       `json:"features"`
+	Holdout        int       `json:"holdout"`
+	Auc            float64   `json:"auc"`
+	LogLoss        float64   `json:"logloss"`
+	LastCheckpoint time.Time `json:"last_checkpoint"`
+}
+
+func (fl *FtrlLearner) Status() *FtrlStatus {
+	fl.lock.Lock()
+	holdout := make([]scoredExample, len(fl.holdout))
+	copy(holdout, fl.holdout)
+	status := &FtrlStatus{
+		Trained:        fl.trained,
+		Positives:      fl.positives,
+		LateClicks:     fl.lateClicks,
+		Dropped:        fl.dropped,
+		Pending:        len(fl.pending),
+		Features:       len(fl.z),
+		Holdout:        len(holdout),
+		LastCheckpoint: fl.lastCheckpoint,
+	}
+	fl.lock.Unlock()
+	scores := make([]float64, len(holdout))
+	labels := make([]float64, len(holdout))
+	for i, example := range holdout {
+		scores[i], labels[i] = example.score, example.label
+	}
+	status.Auc = Auc(scores, labels)
+	status.LogLoss = LogLoss(scores, labels)
+	return status
+}
+
+// 正负样本对中正样本得分更高的比例，得分相同算一半
+func Auc(scores []float64, labels []float64) float64 {
+	index := make([]int, len(scores))
+	for i := range index {
+		index[i] = i
+	}
+	sort.Slice(index, func(i, j int) bool { return scores[index[i]] < scores[index[j]] })
+	var positives, negatives, rankSum float64
+	for i := 0; i < len(index); {
+		j := i
+		for j < len(index) && scores[index[j]] == scores[index[i]] {
+			j++
+		}
+		// 并列的取平均名次
+		averageRank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if labels[index[k]] > 0 {
+				positives += 1
+				rankSum += averageRank
+			} else {
+				negatives += 1
+			}
+		}
+		i = j
+	}
+	if positives == 0 || negatives == 0 {
+		return 0
+	}
+	return (rankSum - positives*(positives+1)/2) / (positives * negatives)
+}
+
+func LogLoss(scores []float64, labels []float64) float64 {
+	if len(scores) == 0 {
+		return 0
+	}
+	loss := 0.0
+	for i, score := range scores {
+		p := math.Max(math.Min(score, 1-1e-15), 1e-15)
+		if labels[i] > 0 {
+			loss -= math.Log(p)
+		} else {
+			loss -= math.Log(1 - p)
+		}
+	}
+	return loss / float64(len(scores))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFtrlLearner(t *testing.T) *FtrlLearner {
+	configure := NewConfigure()
+	configure.FtrlHoldoutPercent = 0
+	configure.FtrlCheckpointPath = filepath.Join(filepath.Dir(writeTempFile(t, "placeholder", "")), "ftrl.model")
+	extractor, err := NewFeatureExtractor([]string{"package"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFtrlLearner(configure, extractor, testLogger)
+}
+
+func TestFtrlLearns(t *testing.T) {
+	fl := newTestFtrlLearner(t)
+	ctr := map[string]float64{"a": 0.3, "b": 0.05}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		packageName := "a"
+		if i%2 == 1 {
+			packageName = "b"
+		}
+		label := 0.0
+		if r.Float64() < ctr[packageName] {
+			label = 1
+		}
+		fl.learn(&pendingExample{features: fl.extractor.Extract(&ParsedRequest{}, &Inventory{PackageName: packageName})}, label)
+	}
+	for packageName, want := range ctr {
+		got := fl.predict(fl.extractor.Extract(&ParsedRequest{}, &Inventory{PackageName: packageName}))
+		if math.Abs(got-want) > 0.03 {
+			t.Errorf("pCTR of %v = %.3f, want %.3f", packageName, got, want)
+		}
+	}
+}
+
+func TestFtrlPending(t *testing.T) {
+	cases := []struct {
+		name       string
+		maxPending int
+		clicks     []int
+		expireAt   time.Duration
+		trained    int64
+		positives  int64
+		pending    int
+		dropped    int64
+		lateClicks int64
+	}{
+		{"click before expiry", 10, []int{1}, 0, 1, 1, 2, 0, 0},
+		{"expired", 10, nil, time.Hour, 3, 0, 0, 0, 0},
+		{"late click", 10, []int{1, 1}, 0, 1, 1, 2, 0, 1},
+		{"drop oldest", 2, []int{0}, time.Hour, 2, 0, 0, 1, 1},
+	}
+	for _, c := range cases {
+		fl := newTestFtrlLearner(t)
+		fl.configure.FtrlMaxPending = c.maxPending
+		req := &ParsedRequest{Id: "r"}
+		for index := 0; index < 3; index++ {
+			fl.OnImpression(req, index, &Inventory{PackageName: fmt.Sprintf("p%v", index)})
+		}
+		for _, index := range c.clicks {
+			fl.OnClick(req, index, nil)
+		}
+		// 窗口还没到时什么也不做
+		fl.Expire(time.Now())
+		if c.expireAt > 0 {
+			fl.Expire(time.Now().Add(c.expireAt))
+		}
+		status := fl.Status()
+		if status.Trained != c.trained || status.Positives != c.positives || status.Pending != c.pending ||
+			status.Dropped != c.dropped || status.LateClicks != c.lateClicks || fl.queue.Len() != c.pending {
+			t.Errorf("%v: status = %+v, queue %v", c.name, status, fl.queue.Len())
+		}
+	}
+}
+
+func TestFtrlCheckpointRestore(t *testing.T) {
+	fl := newTestFtrlLearner(t)
+	features := fl.extractor.Extract(&ParsedRequest{}, &Inventory{PackageName: "a"})
+	for i := 0; i < 100; i++ {
+		fl.learn(&pendingExample{features: features}, float64(i%3/2))
+	}
+	if err := fl.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewFtrlLearner(fl.configure, fl.extractor, testLogger)
+	if err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restored.predict(features), fl.predict(features); math.Abs(got-want) > 1e-12 {
+		t.Errorf("restored pCTR %v, want %v", got, want)
+	}
+	model, err := LoadLinearModel(fl.configure.FtrlCheckpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := model.Predict(features), fl.predict(features); math.Abs(got-want) > 1e-9 {
+		t.Errorf("checkpoint model pCTR %v, want %v", got, want)
+	}
+}
+
+func TestAucAndLogLoss(t *testing.T) {
+	cases := []struct {
+		scores, labels []float64
+		auc, logLoss   float64
+	}{
+		{nil, nil, 0, 0},
+		{[]float64{0.9, 0.1}, []float64{1, 0}, 1, -math.Log(0.9)},
+		{[]float64{0.1, 0.9}, []float64{1, 0}, 0, -math.Log(0.1)},
+		{[]float64{0.5, 0.5}, []float64{1, 0}, 0.5, math.Log(2)},
+		{[]float64{0.8, 0.4, 0.6, 0.2}, []float64{1, 1, 0, 0}, 0.75, 0},
+		{[]float64{0.3, 0.7}, []float64{1, 1}, 0, 0},
+	}
+	for _, c := range cases {
+		if got := Auc(c.scores, c.labels); math.Abs(got-c.auc) > 1e-12 {
+			t.Errorf("Auc(%v, %v) = %v, want %v", c.scores, c.labels, got, c.auc)
+		}
+		if c.logLoss > 0 {
+			if got := LogLoss(c.scores, c.labels); math.Abs(got-c.logLoss) > 1e-12 {
+				t.Errorf("LogLoss(%v, %v) = %v, want %v", c.scores, c.labels, got, c.logLoss)
+			}
+		}
+	}
+}
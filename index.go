@@ -0,0 +1,231 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 按主版本号分桶，超过的都落在最后一个桶
+const osBucketCount = 32
+
+func osBucket(osVersionNum int) int {
+	bucket := osVersionNum / 10000
+	if bucket < 0 {
+		return 0
+	} else if bucket >= osBucketCount {
+		return osBucketCount - 1
+	}
+	return bucket
+}
+
+// 一个定向维度的倒排表，位置都是InventoryCollection.Data的下标，升序
+type postingIndex struct {
+	any    []int // 该维度不限的物料
+	values map[string][]int
+}
+
+func (p *postingIndex) add(position int, keys []string) {
+	if len(keys) == 0 {
+		p.any = append(p.any, position)
+		return
+	}
+	for _, key := range keys {
+		list := p.values[key]
+		// 同一条规则里重复的取值只记一次
+		if len(list) == 0 || list[len(list)-1] != position {
+			p.values[key] = append(list, position)
+		}
+	}
+}
+
+func (p *postingIndex) lookup(keys []string) []int {
+	result := p.any
+	for _, key := range keys {
+		if list, ok := p.values[key]; ok {
+			result = unionPositions(result, list)
+		}
+	}
+	return result
+}
+
+type targetingDimension struct {
+	fromRule    func(t *TargetingRule) []string
+	fromRequest func(req *ParsedRequest) []string
+}
+
+// 建索引的定向维度，应用版本是范围条件，留给Eligible做最后的精确检查
+var targetingDimensions = []targetingDimension{
+	{
+		fromRule: func(t *TargetingRule) []string {
+			keys := make([]string, 0, len(t.Networks))
+			for _, network := range t.Networks {
+				keys = append(keys, strconv.Itoa(network))
+			}
+			return keys
+		},
+		fromRequest: func(req *ParsedRequest) []string {
+			return []string{strconv.Itoa(req.Network)}
+		},
+	},
+	{
+		fromRule: func(t *TargetingRule) []string {
+			return trimAll(t.Carriers)
+		},
+		fromRequest: func(req *ParsedRequest) []string {
+			return trimAll(strings.Split(req.M, ","))
+		},
+	},
+	{
+		fromRule: func(t *TargetingRule) []string {
+			keys := make([]string, 0, len(t.Languages))
+			for _, language := range t.Languages {
+				keys = append(keys, normalizeLanguage(language))
+			}
+			return keys
+		},
+		fromRequest: func(req *ParsedRequest) []string {
+			// pt_BR同时命中pt_br和pt两种规则
+			language := normalizeLanguage(req.L)
+			keys := []string{language}
+			for i := len(language) - 1; i > 0; i-- {
+				if language[i] == '_' {
+					keys = append(keys, language[:i])
+				}
+			}
+			return keys
+		},
+	},
+	{
+		fromRule: func(t *TargetingRule) []string {
+			return hashAll(t.Regions)
+		},
+		fromRequest: func(req *ParsedRequest) []string {
+			if req.IpLib == nil {
+				return nil
+			}
+			return []string{strconv.Itoa(req.IpLib.IpHashLevel2)}
+		},
+	},
+	{
+		fromRule: func(t *TargetingRule) []string {
+			return hashAll(t.Cities)
+		},
+		fromRequest: func(req *ParsedRequest) []string {
+			if req.IpLib == nil {
+				return nil
+			}
+			return []string{strconv.Itoa(req.IpLib.IpHashLevel3)}
+		},
+	},
+	{
+		fromRule: func(t *TargetingRule) []string {
+			return trimAll(t.HostPackages)
+		},
+		fromRequest: func(req *ParsedRequest) []string {
+			return []string{req.Hp}
+		},
+	},
+}
+
+// 国家 × 系统版本桶 × 定向维度的倒排索引，加载时构建，之后只读
+type InventoryIndex struct {
+	osBuckets  [osBucketCount][]int
+	dimensions []*postingIndex
+}
+
+func NewInventoryIndex(data []*Inventory) *InventoryIndex {
+	index := &InventoryIndex{
+		dimensions: make([]*postingIndex, len(targetingDimensions)),
+	}
+	for i := range index.dimensions {
+		index.dimensions[i] = &postingIndex{
+			any:    make([]int, 0),
+			values: make(map[string][]int),
+		}
+	}
+	for position, record := range data {
+		if record.MinOsNum > record.MaxOsNum {
+			continue
+		}
+		for bucket := osBucket(record.MinOsNum); bucket <= osBucket(record.MaxOsNum); bucket++ {
+			index.osBuckets[bucket] = append(index.osBuckets[bucket], position)
+		}
+		for i, dimension := range targetingDimensions {
+			var keys []string
+			if record.Targeting != nil {
+				keys = dimension.fromRule(record.Targeting)
+			}
+			index.dimensions[i].add(position, keys)
+		}
+	}
+	return index
+}
+
+// 返回可能满足条件的物料位置，保持排序后的先后顺序
+func (index *InventoryIndex) Lookup(req *ParsedRequest) []int {
+	positions := index.osBuckets[osBucket(req.OsVersionNum)]
+	for i, dimension := range targetingDimensions {
+		if len(positions) == 0 {
+			break
+		}
+		positions = intersectPositions(positions, index.dimensions[i].lookup(dimension.fromRequest(req)))
+	}
+	return positions
+}
+
+func unionPositions(a, b []int) []int {
+	result := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+func intersectPositions(a, b []int) []int {
+	result := make([]int, 0)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func trimAll(values []string) []string {
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			keys = append(keys, value)
+		}
+	}
+	return keys
+}
+
+func hashAll(values []string) []string {
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		keys = append(keys, strconv.Itoa(HiveHash(strings.TrimSpace(value))))
+	}
+	return keys
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPositionSetOperations(t *testing.T) {
+	cases := []struct {
+		a, b         []int
+		union, inter []int
+	}{
+		{nil, nil, []int{}, []int{}},
+		{[]int{1, 3}, nil, []int{1, 3}, []int{}},
+		{[]int{1, 3, 5}, []int{2, 3, 6}, []int{1, 2, 3, 5, 6}, []int{3}},
+		{[]int{1, 2}, []int{1, 2}, []int{1, 2}, []int{1, 2}},
+	}
+	for _, c := range cases {
+		if got := unionPositions(c.a, c.b); !equalInts(got, c.union) {
+			t.Errorf("union(%v, %v) = %v", c.a, c.b, got)
+		}
+		if got := intersectPositions(c.a, c.b); !equalInts(got, c.inter) {
+			t.Errorf("intersect(%v, %v) = %v", c.a, c.b, got)
+		}
+	}
+}
+
+func TestOsBucket(t *testing.T) {
+	cases := []struct{ version, bucket int }{
+		{-1, 0}, {0, 0}, {40300, 4}, {999999, osBucketCount - 1},
+	}
+	for _, c := range cases {
+		if got := osBucket(c.version); got != c.bucket {
+			t.Errorf("osBucket(%v) = %v, want %v", c.version, got, c.bucket)
+		}
+	}
+}
+
+// 索引只是预筛选，加上Eligible之后必须和逐条检查的结果一致
+func TestInventoryIndexMatchesScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pick := func(values []string) []string {
+		picked := make([]string, 0)
+		for _, value := range values {
+			if r.Intn(3) == 0 {
+				picked = append(picked, value)
+			}
+		}
+		return picked
+	}
+	carriers := []string{"72402", "72403", "46000"}
+	languages := []string{"pt", "pt_BR", "en", "zh_CN"}
+	regions := []string{"BR|27", "BR|26", "CN|11"}
+	hosts := []string{"com.a", "com.b"}
+
+	collection := NewInventoryCollection(&RankTable{rank: map[string]int{}}, nil)
+	for i := 0; i < 300; i++ {
+		minOs := r.Intn(8) * 10000
+		record := &Inventory{Id: i, AdId: i, PackageName: "p", MinOsNum: minOs, MaxOsNum: minOs + r.Intn(6)*10000}
+		if r.Intn(4) != 0 {
+			rule := &TargetingRule{
+				Carriers:     pick(carriers),
+				Languages:    pick(languages),
+				Regions:      pick(regions),
+				HostPackages: pick(hosts),
+			}
+			if r.Intn(2) == 0 {
+				rule.Networks = []int{r.Intn(3)}
+			}
+			rule.prepare()
+			record.Targeting = rule
+		}
+		collection.Append(record)
+	}
+	collection.Build()
+
+	for i := 0; i < 500; i++ {
+		region := regions[r.Intn(len(regions))]
+		request := &ParsedRequest{
+			M:            carriers[r.Intn(len(carriers))],
+			L:            languages[r.Intn(len(languages))],
+			Network:      r.Intn(3),
+			Hp:           hosts[r.Intn(len(hosts))],
+			OsVersionNum: r.Intn(10) * 10000,
+			IpLib:        &IpLib{IpHashLevel2: HiveHash(region)},
+		}
+		got := adIds(collection.Candidates(request))
+		want := make([]int, 0)
+		for _, record := range collection.Data {
+			if record.Eligible(request) {
+				want = append(want, record.AdId)
+			}
+		}
+		if !equalInts(got, want) {
+			t.Fatalf("request %+v: index %v, scan %v", request, got, want)
+		}
+	}
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/op/go-logging"
 )
 
@@ -45,25 +46,95 @@ type Inventory struct {
 	MinOsNum    int    `json:"min_os_num"`
 	MaxOsNum    int    `json:"max_os_num"`
 	Ts          string `json:"ts"`
+	// 物料自己的频控，如"hour:2,day:5"，为空时使用配置中的规则
+	FrequencyCap string `json:"frequency_cap"`
 
-	Frequency int `json:"user_frequency"`
+	Frequency  int     `json:"user_frequency"`
+	Propensity float64 `json:"propensity,omitempty"` // 前面位置已定时，选择策略在该位置选中该包名的概率
+	Category   string  `json:"category,omitempty"`   // 来自extensions，用户画像按类目统计
+
+	// 加载时由Price和Extension解析得到
+	Bid           Bid             `json:"-"`
+	Targeting     *TargetingRule  `json:"-"`
+	FrequencyCaps []*FrequencyCap `json:"-"`
+	Advertiser    string          `json:"-"` // extensions中的advertiser，没有时用ad_type
+}
+
+// extensions字段的内容
+type InventoryExtension struct {
+	Targeting  *TargetingRule `json:"targeting"`
+	BidType    string         `json:"bid_type"` // cpi, cpc, cpm，默认cpi
+	Currency   string         `json:"currency"` // 默认USD
+	Category   string         `json:"category"`
+	Advertiser string         `json:"advertiser"`
+}
+
+// 加载时调用一次，解析出价和extensions，出价解析失败或币种没有汇率的物料不上线。
+// extensions不是合法json时记日志并按空处理，与只透传该字段时一样可以投放
+func (record *Inventory) Prepare(rates map[string]float64, logger *logging.Logger) error {
+	record.Targeting = nil
+	extension := &InventoryExtension{}
+	if strings.TrimSpace(record.Extension) != "" {
+		if err := json.Unmarshal([]byte(record.Extension), extension); err != nil {
+			logger.Warning("invalid extensions ignored [id: %v][err: %v]", record.Id, err.Error())
+			extension = &InventoryExtension{}
+		}
+	}
+	bid, err := ParseBid(record.Price, extension.BidType, extension.Currency)
+	if err != nil {
+		return err
+	}
+	if err := bid.Normalize(rates); err != nil {
+		return err
+	}
+	record.Bid = bid
+	caps, err := ParseFrequencyCaps(record.FrequencyCap)
+	if err != nil {
+		return err
+	}
+	record.FrequencyCaps = caps
+	record.Advertiser = extension.Advertiser
+	if record.Advertiser == "" {
+		record.Advertiser = record.AdType
+	}
+	if extension.Category != "" {
+		record.Category = extension.Category
+	}
+	if extension.Targeting != nil {
+		extension.Targeting.prepare()
+		record.Targeting = extension.Targeting
+	}
+	return nil
 }
 
 type InventoryForRedis struct {
-	AdId      int `json:"ad_id"`
-	Frequency int `json:"user_frequency"`
+	AdId       int     `json:"ad_id"`
+	Frequency  int     `json:"user_frequency"`
+	Position   int     `json:"position"`
+	Propensity float64 `json:"propensity,omitempty"`
+	// 选择时用户画像的状态，用于离线还原画像特征
+	UserPackage  string `json:"user_package,omitempty"`
+	UserCategory string `json:"user_category,omitempty"`
+
+	// win/loss通知回填
+	ClearingPrice float64 `json:"clearing_price,omitempty"`
+	LossReason    string  `json:"loss_reason,omitempty"`
 }
 
 type InventoryCollection struct {
 	Data          []*Inventory
 	PriorityTable *RankTable
-	r             *rand.Rand
+	Index         *InventoryIndex
+	// 不为空时按eCPM排序，否则按排序表
+	Estimator RateEstimator
+	r         *rand.Rand
 }
 
-func NewInventoryCollection(rankTable *RankTable) *InventoryCollection {
+func NewInventoryCollection(rankTable *RankTable, estimator RateEstimator) *InventoryCollection {
 	return &InventoryCollection{
 		Data:          make([]*Inventory, 0),
 		PriorityTable: rankTable,
+		Estimator:     estimator,
 		r:             rand.New(rand.NewSource(time.Now().Unix())),
 	}
 }
@@ -72,6 +143,36 @@ func (iq *InventoryCollection) Append(inv *Inventory) {
 	iq.Data = append(iq.Data, inv)
 }
 
+// 全部Append之后调用，排序并建立倒排索引
+func (iq *InventoryCollection) Build() {
+	if iq.Estimator != nil {
+		sort.Sort(newEcpmOrder(iq.Data, iq.Estimator))
+	} else {
+		sort.Sort(iq)
+	}
+	iq.Index = NewInventoryIndex(iq.Data)
+}
+
+// 通过索引取出满足系统版本和定向规则的物料，保持排序后的先后顺序
+func (iq *InventoryCollection) Candidates(req *ParsedRequest) []*Inventory {
+	var positions []int
+	if iq.Index != nil {
+		positions = iq.Index.Lookup(req)
+	} else {
+		positions = make([]int, len(iq.Data))
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+	candidates := make([]*Inventory, 0, len(positions))
+	for _, position := range positions {
+		if record := iq.Data[position]; record.Eligible(req) {
+			candidates = append(candidates, record)
+		}
+	}
+	return candidates
+}
+
 func (iq InventoryCollection) Len() int { return len(iq.Data) }
 func (iq InventoryCollection) Less(i, j int) bool {
 	iIndex, iOk := iq.PriorityTable.rank[iq.Data[i].PackageName]
@@ -84,49 +185,118 @@ func (iq InventoryCollection) Less(i, j int) bool {
 	}
 
 	if iIndex == jIndex {
-		return iq.Data[i].Price > iq.Data[j].Price
+		return iq.Data[i].Bid.UsdMicros > iq.Data[j].Bid.UsdMicros
 	}
 	return iIndex < jIndex
 }
 
 func (iq InventoryCollection) Swap(i, j int) { iq.Data[i], iq.Data[j] = iq.Data[j], iq.Data[i] }
 
+// 物料快照，发布之后只读，不允许再修改其中的任何记录
+type InventorySnapshot struct {
+	Version   int64
+	LoadTime  time.Time
+	ByCountry map[string]*InventoryCollection
+	ById      map[int]*Inventory // 主键id索引，增量更新时用来定位旧记录
+	ByAdId    map[int]*Inventory // ad_id索引，事件处理时查物料
+	RankTable *RankTable
+	WarmStart bool // 来自落盘快照，而不是数据源
+}
+
+func (s *InventorySnapshot) Age() time.Duration {
+	return time.Since(s.LoadTime)
+}
+
+func (s *InventorySnapshot) Country(countryCode string) (*InventoryCollection, bool) {
+	collection, ok := s.ByCountry[countryCode]
+	return collection, ok
+}
+
 type InventoryCache struct {
-	databaseHandler *sql.DB
-	configure       *Configure
-	cacheByCountry  map[string]*InventoryCollection
-	rankTable       *RankTable
+	source    InventorySource
+	configure *Configure
+	rankTable *RankTable
+	estimator RateEstimator // 排序模式为ecpm时不为空
+	version   int64
+	snapshot  atomic.Value // *InventorySnapshot
+
+	// 增量更新的水位线，取已加载记录中最大的ts
+	watermark    string
+	lastFullLoad time.Time
+	// 最近一次落盘的快照版本和时间
+	persistedVersion int64
+	persistedAt      time.Time
+	// 最近一次全量加载中不合法的记录数
+	invalidCount int64
+
+	// 在线物料之外，事件处理还需要的最近下线和回源的物料
+	adIndex *adIdIndex
 
+	// 只用于串行化Load和排序表的更新，读取快照不需要加锁
 	lock   sync.Mutex
 	logger *logging.Logger
 }
 
-func NewInventoryCache(configure *Configure, logger *logging.Logger) (*InventoryCache, error) {
+// estimator为实时统计的点击率转化率，ecpm排序时使用，为空则用默认值
+func NewInventoryCache(configure *Configure, logger *logging.Logger, estimator RateEstimator) (*InventoryCache, error) {
 	rankTable, err := NewRankTable(configure.RankTablePath)
 	if err != nil {
-		return nil, err
+		// 排序文件读不出来时退回到快照中的排序表，排序文件修好之后由UpdateRankTable换回
+		saved, snapshotErr := loadSnapshotRankTable(configure)
+		if snapshotErr != nil {
+			return nil, err
+		}
+		logger.Warning("fail to load rank table, using the one in %v: %v", configure.InventorySnapshotPath, err.Error())
+		rankTable = saved
 	}
-	if err = rankTable.Load(); err != nil {
+	source, err := NewInventorySource(configure, logger)
+	if err != nil {
 		return nil, err
 	}
-	return &InventoryCache{
+	cache := &InventoryCache{
+		source:    source,
 		configure: configure,
 		logger:    logger,
 		rankTable: rankTable,
-	}, nil
+		adIndex:   newAdIdIndex(),
+	}
+	switch configure.RankMode {
+	case "", "table":
+	case "ecpm":
+		if estimator == nil {
+			estimator = NewConstRateEstimator(configure.DefaultCtr, configure.DefaultCvr)
+		}
+		cache.estimator = estimator
+	default:
+		return nil, fmt.Errorf("unknown rank mode: %v", configure.RankMode)
+	}
+	cache.snapshot.Store(&InventorySnapshot{
+		ByCountry: make(map[string]*InventoryCollection),
+		ById:      make(map[int]*Inventory),
+		ByAdId:    make(map[int]*Inventory),
+		RankTable: rankTable,
+	})
+	return cache, nil
+}
+
+// 当前生效的快照，请求处理期间应只取一次
+func (inv *InventoryCache) Snapshot() *InventorySnapshot {
+	return inv.snapshot.Load().(*InventorySnapshot)
 }
 
 func (inv *InventoryCache) UpdateRankTable() error {
 	inv.lock.Lock()
 	defer inv.lock.Unlock()
 	inv.logger.Notice("begin to update rank table")
-	err := inv.rankTable.Load()
+	// 新建一张表替换，旧快照仍然引用旧表
+	rankTable, err := NewRankTable(inv.configure.RankTablePath)
 	if err != nil {
 		inv.logger.Notice("updating interrupted, %v", err.Error())
-	} else {
-		inv.logger.Notice("updating done, %v item(s) loaded", inv.rankTable.Len())
+		return err
 	}
-	return err
+	inv.rankTable = rankTable
+	inv.logger.Notice("updating done, %v item(s) loaded", rankTable.Len())
+	return nil
 }
 
 func (inv *InventoryCache) GetRankTable() *RankTable {
@@ -136,93 +306,43 @@ func (inv *InventoryCache) GetRankTable() *RankTable {
 	return rankTable
 }
 
-type RowScanner interface {
-	Scan(dest ...interface{}) error
+func (inv *InventoryCache) Estimator() RateEstimator {
+	return inv.estimator
 }
 
-func RowToObject(row RowScanner, record *Inventory) error {
-	return row.Scan(&record.Id, &record.AdId, &record.PackageName,
-		&record.IconUrl, &record.Label, &record.ClickUrl,
-		&record.Price, &record.MaxOs, &record.MinOs,
-		&record.BannerUrl, &record.Country, &record.AdType,
-		&record.Status, &record.ModelSign1, &record.Extension,
-		&record.MaxOsNum, &record.MinOsNum, &record.Ts)
-}
-
-// 用ad_id查询，包含已下线的物料
-func (inv *InventoryCache) FetchOne(adId int, record *Inventory) error {
-	row := inv.databaseHandler.QueryRow(`
-		SELECT id, ad_id, package_name,
-		       icon_url, label, click_url,
-		       price, max_os, min_os,
-		       banner_url, country, ad_type,
-		       status, model_sign1, extensions,
-		       max_os_num, min_os_num, ts
-		FROM inventory
-		WHERE ad_id=?
-		LIMIT 1
-	`, adId)
-	return RowToObject(row, record)
+func (inv *InventoryCache) InvalidCount() int64 {
+	return atomic.LoadInt64(&inv.invalidCount)
 }
 
 func (inv *InventoryCache) Load() error {
 	inv.lock.Lock()
 	defer inv.lock.Unlock()
-	// 重连
-	if inv.databaseHandler == nil {
-		c := inv.configure
-		dsn := fmt.Sprintf("%v:%v@tcp(%v)/%v",
-			c.MySqlUser, c.MySqlPassword, c.MySqlAddress, c.MySqlDatabase)
-		if conn, err := sql.Open("mysql", dsn); err != nil {
-			inv.logger.Warning("fail to connect to mysql: %v", err.Error())
-			return err
-		} else {
-			inv.databaseHandler = conn
-		}
-	}
 	meter := NewTimeMeter()
-	rows, err := inv.databaseHandler.Query(`
-		SELECT id, ad_id, package_name,
-		       icon_url, label, click_url,
-		       price, max_os, min_os,
-		       banner_url, country, ad_type,
-		       status, model_sign1, extensions,
-		       max_os_num, min_os_num, ts
-		FROM inventory
-		WHERE status='online'
-	`)
+	records, err := inv.source.LoadOnline()
 	if err != nil {
-		// 释放掉下次重连
-		inv.logger.Warning("fail to execute sql: %v", err.Error())
-		inv.databaseHandler = nil
+		inv.logger.Warning("fail to load inventory: %v", err.Error())
 		return err
 	}
-	sqlTimeSpent := meter.TimeElapsed()
+	records, invalidCount := inv.prepare(records)
+	atomic.StoreInt64(&inv.invalidCount, int64(invalidCount))
+	sourceTimeSpent := meter.TimeElapsed()
 	countryMap := make(map[string]*InventoryCollection)
-	countLoaded := 0
-	errorCount := 0
-	for rows.Next() {
-		record := Inventory{}
-		err := RowToObject(rows, &record)
-		if err != nil {
-			if errorCount < 10 {
-				inv.logger.Warning(err.Error())
-			} else if errorCount == 10 {
-				inv.logger.Warning("to many errors, ignored")
-			}
-			errorCount += 1
-			continue
-		}
+	idMap := make(map[int]*Inventory)
+	watermark := ""
+	for _, record := range records {
 		if _, ok := countryMap[record.Country]; !ok {
-			countryMap[record.Country] = NewInventoryCollection(inv.rankTable)
+			countryMap[record.Country] = NewInventoryCollection(inv.rankTable, inv.estimator)
+		}
+		countryMap[record.Country].Append(record)
+		idMap[record.Id] = record
+		if record.Ts > watermark {
+			watermark = record.Ts
 		}
-		countryMap[record.Country].Append(&record)
-		countLoaded += 1
 	}
-	recordTimeSpent := meter.TimeElapsed() - sqlTimeSpent
-	inv.logger.Notice("%v record loaded, %v countries, %v errors", countLoaded, len(countryMap), errorCount)
+	recordTimeSpent := meter.TimeElapsed() - sourceTimeSpent
+	inv.logger.Notice("%v record loaded, %v countries, %v errors", len(records), len(countryMap), invalidCount)
 	for _, queue := range countryMap {
-		sort.Sort(queue)
+		queue.Build()
 	}
 	sortTimeSpent := meter.TimeElapsed() - recordTimeSpent
 	//	uniqueMap := make(map[string]InventoryCollection)
@@ -240,9 +360,181 @@ func (inv *InventoryCache) Load() error {
 	//		uniqueMap[countryCode] = newQueue
 	//	}
 	//	uniqTimeSpent := meter.TimeElapsed() - recordTimeSpent
-	inv.cacheByCountry = countryMap
+	inv.publish(countryMap, idMap)
+	inv.watermark = watermark
+	inv.lastFullLoad = time.Now()
+	inv.persist(true)
 	totallySpent := meter.TimeElapsed()
-	inv.logger.Notice("cache updated, totallySpent = %v,  sqlTimeSpent = %v, recordTimeSpent = %v, sortTimeSpent = %v",
-		totallySpent, sqlTimeSpent, recordTimeSpent, sortTimeSpent)
+	inv.logger.Notice("cache updated, version = %v, totallySpent = %v,  sourceTimeSpent = %v, recordTimeSpent = %v, sortTimeSpent = %v",
+		inv.version, totallySpent, sourceTimeSpent, recordTimeSpent, sortTimeSpent)
 	return nil
 }
+
+// 解析每条记录的出价和扩展字段，不合法的记录丢弃并计数
+func (inv *InventoryCache) prepare(records []*Inventory) ([]*Inventory, int) {
+	prepared := make([]*Inventory, 0, len(records))
+	errorCount := 0
+	for _, record := range records {
+		if err := record.Prepare(inv.configure.CurrencyRates, inv.logger); err != nil {
+			if errorCount < 10 {
+				inv.logger.Warning("invalid inventory [id: %v][err: %v]", record.Id, err.Error())
+			} else if errorCount == 10 {
+				inv.logger.Warning("to many errors, ignored")
+			}
+			errorCount += 1
+			continue
+		}
+		prepared = append(prepared, record)
+	}
+	return prepared, errorCount
+}
+
+func (inv *InventoryCache) publish(countryMap map[string]*InventoryCollection, idMap map[int]*Inventory) {
+	inv.version += 1
+	now := time.Now()
+	byAdId := indexByAdId(idMap)
+	inv.retire(inv.Snapshot(), byAdId, now)
+	inv.snapshot.Store(&InventorySnapshot{
+		Version:   inv.version,
+		LoadTime:  now,
+		ByCountry: countryMap,
+		ById:      idMap,
+		ByAdId:    byAdId,
+		RankTable: inv.rankTable,
+	})
+}
+
+// 定时刷新入口：数据源支持时做增量，否则或到了全量周期时全量重载
+func (inv *InventoryCache) Refresh() error {
+	inv.lock.Lock()
+	_, incremental := inv.source.(IncrementalInventorySource)
+	fullReload := !inv.configure.InventoryIncrementalEnable || !incremental || inv.watermark == "" ||
+		time.Since(inv.lastFullLoad) >= time.Duration(inv.configure.InventoryFullReloadInterval)*time.Second
+	inv.lock.Unlock()
+	if fullReload {
+		return inv.Load()
+	}
+	return inv.LoadDelta()
+}
+
+// 只读取ts不早于水位线的记录（包括下线的），只重建受影响国家的队列。
+// 物理删除的行增量读不到，靠周期性的全量重载兜底
+func (inv *InventoryCache) LoadDelta() error {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	source, ok := inv.source.(IncrementalInventorySource)
+	if !ok {
+		return fmt.Errorf("inventory source does not support incremental load")
+	}
+	meter := NewTimeMeter()
+	// 用>=而不是>，同一秒内晚到的更新不会漏掉，重复应用是幂等的
+	changed, err := source.LoadChanged(inv.watermark)
+	if err != nil {
+		inv.logger.Warning("fail to load inventory delta: %v", err.Error())
+		return err
+	}
+	old := inv.Snapshot()
+	idMap := make(map[int]*Inventory, len(old.ById))
+	for id, record := range old.ById {
+		idMap[id] = record
+	}
+	affected := make(map[string]bool)
+	watermark := inv.watermark
+	applied := 0
+	for _, record := range changed {
+		if record.Ts > watermark {
+			watermark = record.Ts
+		}
+		previous, exists := idMap[record.Id]
+		if exists && previous.Ts == record.Ts && record.Status == "online" {
+			// 水位线上重复读到的记录
+			continue
+		}
+		online := record.Status == "online"
+		if online {
+			if err := record.Prepare(inv.configure.CurrencyRates, inv.logger); err != nil {
+				// 新版本不合法时按下线处理，不能让旧的定向规则继续生效
+				inv.logger.Warning("invalid inventory [id: %v][err: %v]", record.Id, err.Error())
+				online = false
+			}
+		}
+		if !exists && !online {
+			continue
+		}
+		if exists {
+			affected[previous.Country] = true
+			delete(idMap, record.Id)
+		}
+		if online {
+			affected[record.Country] = true
+			idMap[record.Id] = record
+		}
+		applied += 1
+	}
+	if applied == 0 {
+		inv.watermark = watermark
+		inv.persist(false)
+		return nil
+	}
+
+	countryMap := make(map[string]*InventoryCollection, len(old.ByCountry))
+	for countryCode, collection := range old.ByCountry {
+		if !affected[countryCode] {
+			countryMap[countryCode] = collection
+		}
+	}
+	for _, record := range idMap {
+		if !affected[record.Country] {
+			continue
+		}
+		if _, ok := countryMap[record.Country]; !ok {
+			countryMap[record.Country] = NewInventoryCollection(inv.rankTable, inv.estimator)
+		}
+		countryMap[record.Country].Append(record)
+	}
+	for countryCode := range affected {
+		if queue, ok := countryMap[countryCode]; ok {
+			queue.Build()
+		}
+	}
+	inv.publish(countryMap, idMap)
+	inv.watermark = watermark
+	inv.persist(false)
+	inv.logger.Notice("cache patched, version = %v, %v record(s) changed, %v countries affected, totallySpent = %v",
+		inv.version, applied, len(affected), meter.TimeElapsed())
+	return nil
+}
+
+// ecpm排序依赖实时统计，统计同步之后用当前快照的物料重新排序发布，不读数据源
+// 在线物料的(包名, 国家)在所有广告位汇总上的统计key，ecpm排序用的就是这些
+func (inv *InventoryCache) RateKeys() []string {
+	snapshot := inv.Snapshot()
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, record := range snapshot.ById {
+		key := RateKey(record.PackageName, record.Country, AllPlacements)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (inv *InventoryCache) Resort() {
+	if inv.estimator == nil {
+		return
+	}
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	old := inv.Snapshot()
+	countryMap := make(map[string]*InventoryCollection, len(old.ByCountry))
+	for countryCode, collection := range old.ByCountry {
+		resorted := NewInventoryCollection(inv.rankTable, inv.estimator)
+		resorted.Data = append(resorted.Data, collection.Data...)
+		resorted.Build()
+		countryMap[countryCode] = resorted
+	}
+	inv.publish(countryMap, old.ById)
+	inv.logger.Debug("inventory resorted, version = %v", inv.version)
+}
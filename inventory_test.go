@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// 以json文件为数据源的InventoryCache，返回的函数用来改写数据源
+func newTestInventoryCache(t *testing.T, records []*Inventory, rank []string) (*InventoryCache, func([]*Inventory)) {
+	rankContent, _ := json.Marshal(rank)
+	rankPath := writeTempFile(t, "adrank.json", string(rankContent))
+	sourcePath := writeTempFile(t, "inventory.json", "[]")
+	write := func(records []*Inventory) {
+		content, err := json.Marshal(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(sourcePath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(records)
+	configure := NewConfigure()
+	configure.InventorySource = "json"
+	configure.InventoryFilePath = sourcePath
+	configure.RankTablePath = rankPath
+	configure.InventorySnapshotPath = ""
+	cache, err := NewInventoryCache(configure, testLogger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, write
+}
+
+func testRecord(id int, packageName string, country string, ts string) *Inventory {
+	return &Inventory{
+		Id: id, AdId: 100 + id, PackageName: packageName, Price: "1000000",
+		Country: country, Status: "online", MaxOsNum: 999999, Ts: ts,
+	}
+}
+
+func collectionPackages(collection *InventoryCollection) []string {
+	names := make([]string, 0, len(collection.Data))
+	for _, record := range collection.Data {
+		names = append(names, record.PackageName)
+	}
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestInventoryLoadPublishesSnapshot(t *testing.T) {
+	cache, write := newTestInventoryCache(t, []*Inventory{
+		testRecord(1, "a", "US", "1"),
+		testRecord(2, "b", "US", "1"),
+		testRecord(3, "c", "BR", "1"),
+	}, []string{"b", "a", "c"})
+
+	empty := cache.Snapshot()
+	if empty.Version != 0 || len(empty.ByCountry) != 0 {
+		t.Fatalf("initial snapshot = %+v", empty)
+	}
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	first := cache.Snapshot()
+	if first.Version != 1 || len(first.ById) != 3 || len(first.ByAdId) != 3 {
+		t.Fatalf("first snapshot = %+v", first)
+	}
+	us, ok := first.Country("US")
+	if !ok || !equalStrings(collectionPackages(us), []string{"b", "a"}) {
+		t.Errorf("US = %v", collectionPackages(us))
+	}
+	if _, ok := first.Country("JP"); ok {
+		t.Errorf("unexpected JP collection")
+	}
+
+	// 新的加载发布新快照，已经取到的旧快照不受影响
+	write([]*Inventory{testRecord(1, "a", "US", "2")})
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	second := cache.Snapshot()
+	if second == first || second.Version != 2 || len(second.ById) != 1 {
+		t.Errorf("second snapshot = %+v", second)
+	}
+	if len(first.ById) != 3 || len(collectionPackages(us)) != 2 {
+		t.Errorf("old snapshot modified")
+	}
+	if _, ok := second.Country("BR"); ok {
+		t.Errorf("BR should be gone")
+	}
+}
+
+func TestInventoryLoadSkipsInvalid(t *testing.T) {
+	invalid := testRecord(2, "b", "US", "1")
+	invalid.Price = "abc"
+	cache, _ := newTestInventoryCache(t, []*Inventory{testRecord(1, "a", "US", "1"), invalid}, nil)
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cache.Snapshot().ById); n != 1 || cache.InvalidCount() != 1 {
+		t.Errorf("loaded %v, invalid %v", n, cache.InvalidCount())
+	}
+}
+
+func TestInventoryLoadDelta(t *testing.T) {
+	records := []*Inventory{
+		testRecord(1, "a", "US", "2017-01-01"),
+		testRecord(2, "b", "US", "2017-01-01"),
+		testRecord(3, "c", "BR", "2017-01-01"),
+	}
+	cache, write := newTestInventoryCache(t, records, []string{"a", "b", "c", "d"})
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	base := cache.Snapshot()
+	br, _ := base.Country("BR")
+
+	// 水位线上的重复记录不产生新版本
+	if err := cache.LoadDelta(); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Snapshot() != base {
+		t.Fatalf("unchanged delta published a new snapshot")
+	}
+
+	offline := testRecord(1, "a", "US", "2017-01-02")
+	offline.Status = "offline"
+	invalid := testRecord(2, "b", "US", "2017-01-02")
+	invalid.Price = "abc"
+	write([]*Inventory{offline, invalid, records[2], testRecord(4, "d", "JP", "2017-01-02")})
+	if err := cache.LoadDelta(); err != nil {
+		t.Fatal(err)
+	}
+	patched := cache.Snapshot()
+	if patched.Version != base.Version+1 {
+		t.Errorf("version = %v", patched.Version)
+	}
+	if cache.watermark != "2017-01-02" {
+		t.Errorf("watermark = %v", cache.watermark)
+	}
+	// 下线和新版本不合法的都移除，US整个队列空了
+	if _, ok := patched.Country("US"); ok {
+		t.Errorf("US should be empty")
+	}
+	if jp, ok := patched.Country("JP"); !ok || !equalStrings(collectionPackages(jp), []string{"d"}) {
+		t.Errorf("JP = %v", jp)
+	}
+	// 没有受影响的国家直接复用旧队列
+	if patchedBr, _ := patched.Country("BR"); patchedBr != br {
+		t.Errorf("BR collection was rebuilt")
+	}
+	if _, ok := patched.ByAdId[101]; ok {
+		t.Errorf("offline record still indexed")
+	}
+	if _, ok := base.ById[1]; !ok {
+		t.Errorf("old snapshot modified")
+	}
+}
+
+func TestInventoryRefreshMode(t *testing.T) {
+	cases := []struct {
+		name        string
+		incremental bool
+		loaded      bool
+		wantVersion int64
+	}{
+		{"first refresh is full", true, false, 1},
+		{"incremental without change", true, true, 1},
+		{"incremental disabled", false, true, 2},
+	}
+	for _, c := range cases {
+		cache, _ := newTestInventoryCache(t, []*Inventory{testRecord(1, "a", "US", "1")}, nil)
+		cache.configure.InventoryIncrementalEnable = c.incremental
+		if c.loaded {
+			if err := cache.Load(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cache.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if v := cache.Snapshot().Version; v != c.wantVersion {
+			t.Errorf("%v: version = %v, want %v", c.name, v, c.wantVersion)
+		}
+	}
+}
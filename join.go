@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/op/go-logging"
+)
+
+var errCreativeIndex = errors.New("creative index out of range")
+
+type recentRequest struct {
+	req  *ParsedRequest
+	time time.Time
+	elem *list.Element
+}
+
+// 按request_id取保存的请求和win/loss通知，即RedisWrapper
+type requestStore interface {
+	GetRequest(id string) (*ParsedRequest, error)
+	GetNotices(id string) (map[int]*AuctionNotice, error)
+}
+
+// 重试队列检查到期事件的间隔，也是第一次重试的退避时间
+const joinRetryTick = 50 * time.Millisecond
+
+// 等待重试的事件，task可以序列化，重启时从文件恢复后重新提交
+type pendingJoin struct {
+	task    *AsyncTask
+	token   *TrackingToken
+	handle  func(parsed *ParsedRequest)
+	start   time.Time
+	next    time.Time // 下次重试的时间
+	backoff time.Duration
+}
+
+// 事件和请求的关联：先查进程内最近的请求，再查redis，关联不上的放进重试队列，
+// 由后台并发地再试：截止时间之前带退避地重试，之后定期重试，超过最长等待时间后放弃。
+// 重试队列每轮写到AsyncSpillDir下的join.retry，重启后重新提交，最多丢掉一轮之内的变化
+type EventJoiner struct {
+	requests  requestStore
+	profiler  *Profiler
+	configure *Configure
+	logger    *logging.Logger
+
+	lock   sync.Mutex
+	recent map[string]*recentRequest
+	order  *list.List // 按放入的先后，用于淘汰
+
+	retryLock sync.Mutex
+	retries   []*pendingJoin
+	retryFile string
+	// 重试关联上之后处理时panic的次数，和WorkerPool一样只记日志
+	panics int64
+}
+
+func NewEventJoiner(configure *Configure, redisWrapper *RedisWrapper, profiler *Profiler, logger *logging.Logger) *EventJoiner {
+	return newEventJoiner(configure, redisWrapper, profiler, logger)
+}
+
+func newEventJoiner(configure *Configure, requests requestStore, profiler *Profiler, logger *logging.Logger) *EventJoiner {
+	return &EventJoiner{
+		requests:  requests,
+		profiler:  profiler,
+		configure: configure,
+		logger:    logger,
+		recent:    make(map[string]*recentRequest),
+		order:     list.New(),
+		retries:   make([]*pendingJoin, 0),
+		retryFile: path.Join(configure.AsyncSpillDir, "join.retry"),
+	}
+}
+
+// 放入和取出时都复制，缓存中的请求不和任何处理中的请求共享可变的部分，
+// 处理事件时的修改和UpdateRequest的序列化都不会和缓存互相影响
+func copyParsedRequest(req *ParsedRequest) *ParsedRequest {
+	copied := *req
+	copied.Creatives = make([]*InventoryForRedis, len(req.Creatives))
+	for index, value := range req.Creatives {
+		creative := *value
+		copied.Creatives[index] = &creative
+	}
+	if req.IpLib != nil {
+		ipLib := *req.IpLib
+		copied.IpLib = &ipLib
+	}
+	copied.Candidates = append([]string(nil), req.Candidates...)
+	// 画像只在选择物料时使用
+	copied.Profile = nil
+	return &copied
+}
+
+// 写响应之前调用，避免事件比redis写入先到
+func (j *EventJoiner) Remember(req *ParsedRequest) {
+	if j.configure.JoinCacheSize <= 0 {
+		return
+	}
+	copied := copyParsedRequest(req)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if old, ok := j.recent[req.Id]; ok {
+		j.order.Remove(old.elem)
+	}
+	j.recent[req.Id] = &recentRequest{req: copied, time: time.Now(), elem: j.order.PushBack(req.Id)}
+	for j.order.Len() > j.configure.JoinCacheSize {
+		oldest := j.order.Front()
+		j.order.Remove(oldest)
+		delete(j.recent, oldest.Value.(string))
+	}
+}
+
+func (j *EventJoiner) lookup(id string) *ParsedRequest {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	recent, ok := j.recent[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().Sub(recent.time) > time.Duration(j.configure.JoinCacheTtl)*time.Second {
+		j.order.Remove(recent.elem)
+		delete(j.recent, id)
+		return nil
+	}
+	return copyParsedRequest(recent.req)
+}
+
+func (j *EventJoiner) fetch(token *TrackingToken) (*ParsedRequest, error) {
+	parsed := j.lookup(token.RequestId)
+	if parsed == nil {
+		var err error
+		if parsed, err = j.requests.GetRequest(token.RequestId); err != nil {
+			return nil, err
+		}
+	}
+	if token.Index < 0 || token.Index >= len(parsed.Creatives) {
+		return nil, errCreativeIndex
+	}
+	// 通知和请求分开保存，取不到时不影响关联
+	notices, err := j.requests.GetNotices(token.RequestId)
+	if err != nil {
+		j.logger.Warning("fail to get auction notices [err: %s][id: %s]", err.Error(), token.RequestId)
+	}
+	applyNotices(parsed, notices)
+	return parsed, nil
+}
+
+func applyNotices(parsed *ParsedRequest, notices map[int]*AuctionNotice) {
+	for index, notice := range notices {
+		if index < 0 || index >= len(parsed.Creatives) {
+			continue
+		}
+		parsed.Creatives[index].ClearingPrice = notice.ClearingPrice
+		parsed.Creatives[index].LossReason = notice.LossReason
+	}
+}
+
+// 在调用方的goroutine里只关联一次，关联上就直接处理，否则交给重试队列，不占着worker等待。
+// 物料位置越界说明param本身有问题，重试也没有用，直接放弃
+func (j *EventJoiner) Join(task *AsyncTask, token *TrackingToken, handle func(parsed *ParsedRequest)) {
+	event, param := task.Event, task.Param
+	start := time.Now()
+	if token.stateless {
+		j.profiler.OnJoin(event, 0, true)
+		handle(token.Request())
+		return
+	}
+	parsed, err := j.fetch(token)
+	if err == nil {
+		j.profiler.OnJoin(event, time.Now().Sub(start).Seconds(), true)
+		handle(parsed)
+		return
+	}
+	if err == errCreativeIndex {
+		j.profiler.OnJoin(event, time.Now().Sub(start).Seconds(), false)
+		j.logger.Error("join %v failed [err: %s][param: %s]", event, err.Error(), param)
+		return
+	}
+	if err != redis.ErrNil {
+		j.logger.Warning("join %v failed [err: %s][param: %s]", event, err.Error(), param)
+	}
+	pending := &pendingJoin{task: task, token: token, handle: handle, start: start, backoff: joinRetryTick}
+	pending.next = j.nextRetry(pending, start)
+	j.retryLock.Lock()
+	defer j.retryLock.Unlock()
+	if len(j.retries) >= j.configure.JoinRetryQueueSize {
+		j.profiler.OnJoin(event, time.Now().Sub(start).Seconds(), false)
+		j.logger.Error("join failed, retry queue full [event: %s][param: %s]", event, param)
+		return
+	}
+	j.retries = append(j.retries, pending)
+}
+
+// JoinDeadline之内按指数退避重试，之后每JoinRetryInterval秒一次
+func (j *EventJoiner) nextRetry(pending *pendingJoin, now time.Time) time.Time {
+	deadline := pending.start.Add(time.Duration(j.configure.JoinDeadline) * time.Millisecond)
+	if next := now.Add(pending.backoff); !next.After(deadline) {
+		pending.backoff *= 2
+		return next
+	}
+	return now.Add(time.Duration(j.configure.JoinRetryInterval) * time.Second)
+}
+
+// 重试一轮：队列中到期的事件由最多JoinRetryWorkers个goroutine并发关联，
+// 关联不上且没有超过JoinRetryMaxAge的排好下次重试的时间放回去
+func (j *EventJoiner) retryOnce(now time.Time) {
+	maxAge := time.Duration(j.configure.JoinRetryMaxAge) * time.Second
+	j.retryLock.Lock()
+	batch := make([]*pendingJoin, 0)
+	waiting := make([]*pendingJoin, 0, len(j.retries))
+	for _, pending := range j.retries {
+		if pending.next.After(now) {
+			waiting = append(waiting, pending)
+		} else {
+			batch = append(batch, pending)
+		}
+	}
+	j.retries = waiting
+	j.retryLock.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	kept := make([]*pendingJoin, len(batch))
+	concurrency := j.configure.JoinRetryWorkers
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	workers := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i, pending := range batch {
+		wg.Add(1)
+		workers <- true
+		go func(i int, pending *pendingJoin) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			event := pending.task.Event
+			parsed, err := j.fetch(pending.token)
+			if err == nil {
+				j.profiler.OnJoin(event, time.Now().Sub(pending.start).Seconds(), true)
+				j.handleRetried(pending, parsed)
+				return
+			}
+			// 按事件发生的时间算，重启之后恢复的也不会无限期重试
+			if err != errCreativeIndex && now.Sub(pending.task.Time) < maxAge {
+				pending.next = j.nextRetry(pending, now)
+				kept[i] = pending
+				return
+			}
+			j.profiler.OnJoin(event, time.Now().Sub(pending.start).Seconds(), false)
+			j.logger.Error("join failed [event: %s][err: %s][param: %s]", event, err.Error(), pending.task.Param)
+		}(i, pending)
+	}
+	wg.Wait()
+
+	j.retryLock.Lock()
+	defer j.retryLock.Unlock()
+	retries := make([]*pendingJoin, 0, len(batch)+len(j.retries))
+	for _, pending := range kept {
+		if pending != nil {
+			retries = append(retries, pending)
+		}
+	}
+	j.retries = append(retries, j.retries...)
+}
+
+// 重试的处理不在worker里，panic不能让整个进程退出
+func (j *EventJoiner) handleRetried(pending *pendingJoin, parsed *ParsedRequest) {
+	defer func() {
+		if err := recover(); err != nil {
+			atomic.AddInt64(&j.panics, 1)
+			j.logger.Error("%v join retry panic: %v\n%s", pending.task.Event, err, debug.Stack())
+		}
+	}()
+	pending.handle(parsed)
+}
+
+// 重试队列的状态，和worker池的状态放在一起展示
+func (j *EventJoiner) Status() *WorkerPoolStatus {
+	j.retryLock.Lock()
+	depth := len(j.retries)
+	j.retryLock.Unlock()
+	return &WorkerPoolStatus{
+		Depth:    depth,
+		Capacity: j.configure.JoinRetryQueueSize,
+		Workers:  j.configure.JoinRetryWorkers,
+		Overflow: OverflowDrop,
+		Panics:   atomic.LoadInt64(&j.panics),
+	}
+}
+
+// 把重试队列写到文件，重启后恢复
+func (j *EventJoiner) persistRetries() {
+	j.retryLock.Lock()
+	tasks := make([]*AsyncTask, len(j.retries))
+	for i, pending := range j.retries {
+		tasks[i] = pending.task
+	}
+	j.retryLock.Unlock()
+	if err := j.saveRetries(tasks); err != nil {
+		j.logger.Warning("fail to save join retries: %v", err.Error())
+	}
+}
+
+func (j *EventJoiner) saveRetries(tasks []*AsyncTask) error {
+	if len(tasks) == 0 {
+		if err := os.Remove(j.retryFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(j.retryFile), 0755); err != nil {
+		return err
+	}
+	tmpFile := j.retryFile + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	for _, task := range tasks {
+		line, err := json.Marshal(task)
+		if err != nil {
+			continue
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, j.retryFile)
+}
+
+// 读出上次退出时还在重试队列里的事件，由调用方重新提交。
+// 读完就删掉文件，再次关联不上的会重新进队列，在下一轮写回
+func (j *EventJoiner) LoadRetries() ([]*AsyncTask, error) {
+	f, err := os.Open(j.retryFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer os.Remove(j.retryFile)
+	defer f.Close()
+	tasks := make([]*AsyncTask, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		task := &AsyncTask{}
+		if err := json.Unmarshal(scanner.Bytes(), task); err != nil {
+			j.logger.Warning("invalid join retry: %v", err.Error())
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, scanner.Err()
+}
+
+// 每joinRetryTick检查一次到期的事件，每JoinRetryInterval秒写一次文件
+func (j *EventJoiner) RetryLoop() {
+	interval := time.Duration(j.configure.JoinRetryInterval) * time.Second
+	saved := time.Now()
+	for {
+		time.Sleep(joinRetryTick)
+		now := time.Now()
+		j.retryOnce(now)
+		if now.Sub(saved) >= interval {
+			j.persistRetries()
+			saved = now
+		}
+	}
+}
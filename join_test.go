@@ -0,0 +1,292 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 内存中的requestStore，没有的请求按redis.ErrNil返回
+type fakeRequestStore struct {
+	lock     sync.Mutex
+	requests map[string]*ParsedRequest
+	notices  map[string]map[int]*AuctionNotice
+}
+
+func (s *fakeRequestStore) GetRequest(id string) (*ParsedRequest, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if req, ok := s.requests[id]; ok {
+		return copyParsedRequest(req), nil
+	}
+	return nil, redis.ErrNil
+}
+
+func (s *fakeRequestStore) GetNotices(id string) (map[int]*AuctionNotice, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	notices := make(map[int]*AuctionNotice)
+	for index, notice := range s.notices[id] {
+		copied := *notice
+		notices[index] = &copied
+	}
+	return notices, nil
+}
+
+func (s *fakeRequestStore) saveNotice(id string, index int, notice *AuctionNotice) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.notices[id] == nil {
+		s.notices[id] = make(map[int]*AuctionNotice)
+	}
+	s.notices[id][index] = notice
+}
+
+func (s *fakeRequestStore) put(req *ParsedRequest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests[req.Id] = req
+}
+
+func newTestEventJoiner(t *testing.T) (*EventJoiner, *fakeRequestStore) {
+	configure := NewConfigure()
+	configure.JoinDeadline = 0
+	configure.AsyncSpillDir = filepath.Dir(writeTempFile(t, "placeholder", ""))
+	store := &fakeRequestStore{requests: make(map[string]*ParsedRequest), notices: make(map[string]map[int]*AuctionNotice)}
+	return newEventJoiner(configure, store, NewProfiler(configure, testLogger), testLogger), store
+}
+
+func testJoinRequest(id string, creatives int) *ParsedRequest {
+	req := &ParsedRequest{Id: id, IpLib: &IpLib{CountryCode: "US"}}
+	for index := 0; index < creatives; index++ {
+		req.Creatives = append(req.Creatives, &InventoryForRedis{AdId: index + 1, Position: index})
+	}
+	return req
+}
+
+func TestEventJoinerRemember(t *testing.T) {
+	joiner, _ := newTestEventJoiner(t)
+	joiner.configure.JoinCacheSize = 2
+	req := testJoinRequest("r1", 2)
+	joiner.Remember(req)
+	// 缓存的是副本，之后的修改互不影响
+	req.Creatives[0].ClearingPrice = 9
+	req.IpLib.CountryCode = "BR"
+	found := joiner.lookup("r1")
+	if found == nil || found.Creatives[0].ClearingPrice != 0 || found.IpLib.CountryCode != "US" {
+		t.Fatalf("lookup = %+v", found)
+	}
+	found.Creatives[1].LossReason = "102"
+	found.IpLib.CountryCode = "CN"
+	if again := joiner.lookup("r1"); again.Creatives[1].LossReason != "" || again.IpLib.CountryCode != "US" {
+		t.Errorf("cached request modified: %+v", again)
+	}
+
+	joiner.Remember(testJoinRequest("r2", 1))
+	joiner.Remember(testJoinRequest("r3", 1))
+	if joiner.lookup("r1") != nil || joiner.lookup("r3") == nil {
+		t.Errorf("oldest request not evicted")
+	}
+	joiner.configure.JoinCacheTtl = -1
+	if joiner.lookup("r3") != nil {
+		t.Errorf("expired request found")
+	}
+}
+
+func TestEventJoinerJoin(t *testing.T) {
+	cases := []struct {
+		name     string
+		remember bool
+		index    int
+		handled  bool
+		retries  int
+	}{
+		{"cached", true, 1, true, 0},
+		{"not saved yet", false, 0, false, 1},
+		// 位置越界重试也没有用，直接放弃
+		{"bad index", true, 5, false, 0},
+	}
+	for _, c := range cases {
+		joiner, _ := newTestEventJoiner(t)
+		if c.remember {
+			joiner.Remember(testJoinRequest("r", 2))
+		}
+		handled := false
+		task := &AsyncTask{Event: "click", Param: "r-1", Time: time.Now()}
+		joiner.Join(task, &TrackingToken{RequestId: "r", Index: c.index}, func(parsed *ParsedRequest) {
+			handled = parsed.Creatives[c.index].AdId == c.index+1
+		})
+		if handled != c.handled || len(joiner.retries) != c.retries {
+			t.Errorf("%v: handled %v, %v retries", c.name, handled, len(joiner.retries))
+		}
+	}
+
+	// 无状态的token不需要关联
+	joiner, _ := newTestEventJoiner(t)
+	handled := false
+	token := &TrackingToken{RequestId: "r", Index: 1, AdId: 3, stateless: true}
+	joiner.Join(&AsyncTask{Event: "click"}, token, func(parsed *ParsedRequest) { handled = parsed.Creatives[1].AdId == 3 })
+	if !handled {
+		t.Errorf("stateless token not handled")
+	}
+}
+
+func TestEventJoinerRetry(t *testing.T) {
+	joiner, store := newTestEventJoiner(t)
+	joiner.configure.JoinRetryWorkers = 4
+	now := time.Now()
+	// 四个事件的处理互相等待，串行处理时会卡住
+	var barrier sync.WaitGroup
+	barrier.Add(4)
+	handled := make(chan string, 10)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		id := id
+		joiner.Join(&AsyncTask{Event: "impression", Param: id + "-0", Time: now}, &TrackingToken{RequestId: id}, func(parsed *ParsedRequest) {
+			barrier.Done()
+			barrier.Wait()
+			handled <- parsed.Id
+		})
+		store.put(testJoinRequest(id, 1))
+	}
+	joiner.Join(&AsyncTask{Event: "click", Param: "late-0", Time: now}, &TrackingToken{RequestId: "late"}, func(parsed *ParsedRequest) {
+		handled <- parsed.Id
+	})
+	joiner.Join(&AsyncTask{Event: "click", Param: "old-0", Time: now.Add(-time.Hour)}, &TrackingToken{RequestId: "old"}, func(parsed *ParsedRequest) {
+		handled <- parsed.Id
+	})
+	if len(joiner.retries) != 6 {
+		t.Fatalf("%v retries", len(joiner.retries))
+	}
+
+	// 还没到重试时间的不处理
+	joiner.retryOnce(now)
+	if len(handled) != 0 || len(joiner.retries) != 6 {
+		t.Fatalf("retried before due: %v handled, %v retries", len(handled), len(joiner.retries))
+	}
+	due := now.Add(time.Minute)
+	done := make(chan bool)
+	go func() {
+		joiner.retryOnce(due)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retries handled serially")
+	}
+	if len(handled) != 4 {
+		t.Errorf("%v handled", len(handled))
+	}
+	// 没有超时的留在队列里并写到文件，超时的放弃
+	if len(joiner.retries) != 1 || joiner.retries[0].task.Param != "late-0" {
+		t.Fatalf("retries = %v", joiner.retries)
+	}
+	joiner.persistRetries()
+
+	restarted, _ := newTestEventJoiner(t)
+	restarted.retryFile = joiner.retryFile
+	tasks, err := restarted.LoadRetries()
+	if err != nil || len(tasks) != 1 || tasks[0].Event != "click" || tasks[0].Param != "late-0" || !tasks[0].Time.Equal(now) {
+		t.Errorf("LoadRetries = %v, %v", tasks, err)
+	}
+	if tasks, err := restarted.LoadRetries(); err != nil || len(tasks) != 0 {
+		t.Errorf("retries loaded twice: %v, %v", tasks, err)
+	}
+
+	// 都关联上之后文件删掉
+	store.put(testJoinRequest("late", 1))
+	joiner.retryOnce(due.Add(time.Minute))
+	joiner.persistRetries()
+	if tasks, _ := joiner.LoadRetries(); len(joiner.retries) != 0 || len(tasks) != 0 {
+		t.Errorf("retries left: %v, %v", joiner.retries, tasks)
+	}
+}
+
+func TestEventJoinerNextRetry(t *testing.T) {
+	joiner, _ := newTestEventJoiner(t)
+	joiner.configure.JoinDeadline = 300
+	joiner.configure.JoinRetryInterval = 10
+	start := time.Now()
+	pending := &pendingJoin{start: start, backoff: joinRetryTick}
+	// 截止时间之内指数退避，之后按固定间隔
+	cases := []struct {
+		now  time.Duration
+		wait time.Duration
+	}{
+		{0, 50 * time.Millisecond},
+		{50 * time.Millisecond, 100 * time.Millisecond},
+		{150 * time.Millisecond, 10 * time.Second},
+		{10150 * time.Millisecond, 10 * time.Second},
+	}
+	for _, c := range cases {
+		now := start.Add(c.now)
+		if next := joiner.nextRetry(pending, now); next.Sub(now) != c.wait {
+			t.Errorf("at %v: next retry after %v, want %v", c.now, next.Sub(now), c.wait)
+		}
+	}
+}
+
+func TestEventJoinerNotices(t *testing.T) {
+	cases := []struct {
+		name     string
+		remember bool
+		notices  map[int]*AuctionNotice
+		prices   []float64
+		reasons  []string
+	}{
+		{"none", false, nil, []float64{0, 0, 0}, []string{"", "", ""}},
+		// 不同imp的通知互不覆盖
+		{"win and loss", false, map[int]*AuctionNotice{0: {ClearingPrice: 1.5}, 2: {ClearingPrice: 2, LossReason: "102"}},
+			[]float64{1.5, 0, 2}, []string{"", "", "102"}},
+		// 进程内缓存的请求也带上其他实例收到的通知
+		{"cached request", true, map[int]*AuctionNotice{1: {ClearingPrice: 3}}, []float64{0, 3, 0}, []string{"", "", ""}},
+		{"index out of range", false, map[int]*AuctionNotice{5: {ClearingPrice: 3}}, []float64{0, 0, 0}, []string{"", "", ""}},
+	}
+	for _, c := range cases {
+		joiner, store := newTestEventJoiner(t)
+		if c.remember {
+			joiner.Remember(testJoinRequest("r", 3))
+		}
+		for index, notice := range c.notices {
+			store.saveNotice("r", index, notice)
+		}
+		// 请求比通知晚写入也不会冲掉通知
+		store.put(testJoinRequest("r", 3))
+		parsed, err := joiner.fetch(&TrackingToken{RequestId: "r", Index: 0})
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		for index, creative := range parsed.Creatives {
+			if creative.ClearingPrice != c.prices[index] || creative.LossReason != c.reasons[index] {
+				t.Errorf("%v: creative %v = %+v", c.name, index, creative)
+			}
+		}
+	}
+}
+
+func TestEventJoinerRetryRecover(t *testing.T) {
+	joiner, store := newTestEventJoiner(t)
+	now := time.Now()
+	handled := make(chan string, 2)
+	for _, id := range []string{"panic", "ok"} {
+		id := id
+		joiner.Join(&AsyncTask{Event: "click", Param: id + "-0", Time: now}, &TrackingToken{RequestId: id}, func(parsed *ParsedRequest) {
+			if parsed.Id == "panic" {
+				panic("bad event")
+			}
+			handled <- parsed.Id
+		})
+		store.put(testJoinRequest(id, 1))
+	}
+	// 一个事件的处理panic不影响同一轮的其他事件，也不会让进程退出
+	joiner.retryOnce(now.Add(time.Minute))
+	if len(handled) != 1 || <-handled != "ok" {
+		t.Errorf("other retries not handled")
+	}
+	if status := joiner.Status(); status.Panics != 1 || status.Depth != 0 {
+		t.Errorf("status = %+v", status)
+	}
+}
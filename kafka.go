@@ -76,7 +76,8 @@ func GetEventKafkaMessage(req *ParsedRequest, event string, record *Inventory) s
 	case "td_postback":
 		message = append(message, 0, 0, 0, 1, record.Price)
 	}
-	return fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v", message...)
+	message = append(message, NanIfEmpty(req.Experiments))
+	return fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v", message...)
 }
 
 func GetReqeustKafkaMessage(req *ParsedRequest) string {
@@ -97,6 +98,36 @@ func GetReqeustKafkaMessage(req *ParsedRequest) string {
 		req.Adgroup,
 		1,
 		len(req.Creatives),
+		NanIfEmpty(req.Experiments),
+	}
+	return fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v", message...)
+}
+
+func GetWinKafkaMessage(req *ParsedRequest, record *Inventory, clearingPrice float64) string {
+	// carrier只取第一个
+	carrier, err := strconv.Atoi(strings.Split(req.M, ",")[0])
+	if err != nil {
+		carrier = -1
+	}
+
+	message := []interface{}{
+		time.Now().UTC().Format("2006-01-02 15:04:05Z"),
+		req.PlacementId,
+		record.AdType,
+		HiveHash(record.IconUrl),
+		record.PackageName,
+		carrier,
+		NanIfEmpty(req.IpLib.CountryCode),
+		NanIfEmpty(req.OsVersion),
+		NanIfEmpty(req.ClientVersion),
+		req.Network,
+		req.Adgroup,
+		NanIfEmpty(req.Cid),
+		req.Id,
+		record.AdId,
+		record.Price,
+		clearingPrice,
+		NanIfEmpty(req.Experiments),
 	}
-	return fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v", message...)
+	return fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v", message...)
 }
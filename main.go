@@ -22,9 +22,26 @@ func init() {
 
 var rank *RankTable
 
+// 离线子命令：rtblite <command> [options]
+var commands = map[string]func(args []string) error{
+	"ope":    RunOpe,
+	"eval":   RunEval,
+	"export": RunExport,
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 	configure := NewConfigure()
 	if PrintExampleConfig {
@@ -66,17 +83,31 @@ func main() {
 		fmt.Println("fail to fetch initial inventory:", err.Error())
 		return
 	}
+	// 按加载到的物料读回其他机器写入的统计，读到之后马上按eCPM重排
+	rtblite.RunRateSync()
 	rtblite.RunProfiler()
+	rtblite.RunModelWatcher()
+	rtblite.RunLearner()
+	rtblite.RunWorkers()
+	rtblite.RunJoinRetry()
 
 	listenOn := configure.HttpAddress
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/request", rtblite.Request)        //设定访问的路径
-	mux.HandleFunc("/impression", rtblite.Impression)  //设定访问的路径
-	mux.HandleFunc("/click", rtblite.Click)            //设定访问的路径
-	mux.HandleFunc("/event", rtblite.Conversion)       //设定访问的路径
-	mux.HandleFunc("/rank/update", rtblite.UpdateRank) //设定访问的路径
-	mux.HandleFunc("/rank", rtblite.GetRank)           //设定访问的路径
+	mux.HandleFunc("/request", rtblite.Request)                     //设定访问的路径
+	mux.HandleFunc("/openrtb", rtblite.OpenRtb)                     //设定访问的路径
+	mux.HandleFunc("/impression", rtblite.Impression)               //设定访问的路径
+	mux.HandleFunc("/click", rtblite.Click)                         //设定访问的路径
+	mux.HandleFunc("/event", rtblite.Conversion)                    //设定访问的路径
+	mux.HandleFunc("/win", rtblite.Win)                             //设定访问的路径
+	mux.HandleFunc("/loss", rtblite.Loss)                           //设定访问的路径
+	mux.HandleFunc("/rank/update", rtblite.UpdateRank)              //设定访问的路径
+	mux.HandleFunc("/rank", rtblite.GetRank)                        //设定访问的路径
+	mux.HandleFunc("/inventory/status", rtblite.GetInventoryStatus) //设定访问的路径
+	mux.HandleFunc("/stats/rates", rtblite.GetRates)                //设定访问的路径
+	mux.HandleFunc("/model/ftrl", rtblite.GetFtrlStatus)            //设定访问的路径
+	mux.HandleFunc("/profile", rtblite.GetProfile)                  //设定访问的路径
+	mux.HandleFunc("/stats/queues", rtblite.GetQueues)              //设定访问的路径
 
 	fmt.Println("server start on ", listenOn)
 
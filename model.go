@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
 	"time"
 )
 
@@ -34,9 +38,24 @@ type ModelData struct {
 	RequestId        string     `json:"request_id"`
 	AppVersion       string     `json:"app_version"`
 	Event            string     `json:"event"`
+	InventoryVersion int64      `json:"inventory_version"`
+	Position         int        `json:"position"`
+	Propensity       float64    `json:"propensity"`
+	Experiments      string     `json:"experiments"`
+	UserPackage      string     `json:"user_package,omitempty"`
+	UserCategory     string     `json:"user_category,omitempty"`
+	Candidates       []string   `json:"candidates,omitempty"`
 }
 
-func GetModelDataLog(req *ParsedRequest, record *Inventory, event string) ([]byte, error) {
+// index为物料在请求中的位置
+func GetModelDataLog(req *ParsedRequest, index int, record *Inventory, event string) ([]byte, error) {
+	propensity := 0.0
+	userPackage, userCategory := "", ""
+	if index >= 0 && index < len(req.Creatives) {
+		propensity = req.Creatives[index].Propensity
+		userPackage = req.Creatives[index].UserPackage
+		userCategory = req.Creatives[index].UserCategory
+	}
 	data := ModelData{
 		ConnectionType:   req.Network,
 		C:                req.C,
@@ -58,7 +77,129 @@ func GetModelDataLog(req *ParsedRequest, record *Inventory, event string) ([]byt
 		RequestId:  req.Id,
 		AppVersion: req.ClientVersion,
 		Event:      event,
+
+		InventoryVersion: req.InventoryVersion,
+		Position:         index,
+		Propensity:       propensity,
+		Experiments:      req.Experiments,
+		UserPackage:      userPackage,
+		UserCategory:     userCategory,
+		Candidates:       req.Candidates,
 	}
 	jsonData, err := json.Marshal(data)
 	return jsonData, err
 }
+
+// 逐行读取model.save文件（包括轮转出来的旧文件），解析失败的行跳过并计数
+func ReadModelDataLogs(paths []string, handle func(data *ModelData)) (int, error) {
+	invalid := 0
+	for _, file := range paths {
+		f, err := os.Open(file)
+		if err != nil {
+			return invalid, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			data := &ModelData{}
+			if err := json.Unmarshal(line, data); err != nil || data.SelectedCreative == nil {
+				invalid += 1
+				continue
+			}
+			handle(data)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return invalid, err
+		}
+	}
+	return invalid, nil
+}
+
+// 从日志还原出请求，用于离线打分，字段和在线特征抽取用到的保持一致
+func (data *ModelData) Request() *ParsedRequest {
+	return &ParsedRequest{
+		Limit:            data.Limit,
+		PlacementId:      data.AdUnitId,
+		L:                data.Lauguage,
+		M:                data.Carrier,
+		Ip:               data.Ip,
+		Cid:              data.UserId,
+		OsVersion:        data.OsVersion,
+		ClientVersion:    data.AppVersion,
+		Network:          data.ConnectionType,
+		Cc:               data.Cc,
+		Hp:               data.Hp,
+		P:                data.P,
+		C:                data.C,
+		Adgroup:          data.AdgroupId,
+		Id:               data.RequestId,
+		IpLib:            data.IpLib,
+		OsVersionNum:     VersionToInt(data.OsVersion),
+		InventoryVersion: data.InventoryVersion,
+		Experiments:      data.Experiments,
+		Profile: NewUserProfileFromStates(data.SelectedCreative.PackageName, data.UserPackage,
+			data.SelectedCreative.Category, data.UserCategory),
+	}
+}
+
+// 一个请求中一个物料的展示、点击和激活
+type ModelFunnel struct {
+	// 有展示时为展示的记录，否则为最早读到的记录
+	Data       *ModelData
+	Impression bool
+	Click      bool
+	Activate   bool
+}
+
+func (f *ModelFunnel) Label(event string) float64 {
+	if (event == "click" && f.Click) || (event == "activate" && f.Activate) {
+		return 1
+	}
+	return 0
+}
+
+// 按request_id和ad_id把各事件串起来，结果按时间排序
+func JoinModelDataLogs(paths []string) ([]*ModelFunnel, int, error) {
+	funnels := make(map[string]*ModelFunnel)
+	invalid, err := ReadModelDataLogs(paths, func(data *ModelData) {
+		key := fmt.Sprintf("%v-%v", data.RequestId, data.SelectedCreative.AdId)
+		funnel, ok := funnels[key]
+		if !ok {
+			funnel = &ModelFunnel{Data: data}
+			funnels[key] = funnel
+		}
+		switch data.Event {
+		case "impression":
+			funnel.Data = data
+			funnel.Impression = true
+		case "click":
+			funnel.Click = true
+		case "activate":
+			funnel.Activate = true
+		}
+	})
+	if err != nil {
+		return nil, invalid, err
+	}
+	result := make([]*ModelFunnel, 0, len(funnels))
+	for _, funnel := range funnels {
+		result = append(result, funnel)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Data, result[j].Data
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		if a.RequestId != b.RequestId {
+			return a.RequestId < b.RequestId
+		}
+		return a.Position < b.Position
+	})
+	return result, invalid, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// OpenRTB Native 1.x，只支持物料能提供的标题和图片
+
+const (
+	NativeImageIcon = 1
+	NativeImageLogo = 2
+	NativeImageMain = 3
+)
+
+type OpenRtbNativeRequest struct {
+	Ver    string                `json:"ver,omitempty"`
+	Assets []*OpenRtbNativeAsset `json:"assets"`
+}
+
+type OpenRtbNativeAsset struct {
+	Id       int `json:"id"`
+	Required int `json:"required,omitempty"`
+	Title    *struct {
+		Len int `json:"len"`
+	} `json:"title,omitempty"`
+	Img *struct {
+		Type int `json:"type,omitempty"`
+	} `json:"img,omitempty"`
+	// data、video等素材物料提供不了，必需时不出价
+}
+
+type OpenRtbNativeResponse struct {
+	Native *OpenRtbNativeAd `json:"native"`
+}
+
+type OpenRtbNativeAd struct {
+	Ver         string                     `json:"ver,omitempty"`
+	Assets      []*OpenRtbNativeAssetValue `json:"assets"`
+	Link        *OpenRtbNativeLink         `json:"link"`
+	ImpTrackers []string                   `json:"imptrackers,omitempty"`
+}
+
+type OpenRtbNativeAssetValue struct {
+	Id    int                `json:"id"`
+	Title *OpenRtbNativeText `json:"title,omitempty"`
+	Img   *OpenRtbNativeImg  `json:"img,omitempty"`
+}
+
+type OpenRtbNativeText struct {
+	Text string `json:"text"`
+}
+
+type OpenRtbNativeImg struct {
+	Url string `json:"url"`
+}
+
+type OpenRtbNativeLink struct {
+	Url string `json:"url"`
+}
+
+// imp.native.request是json字符串，1.0外面包了一层native，1.1之后没有
+func ParseOpenRtbNativeRequest(native *OpenRtbNative) (*OpenRtbNativeRequest, error) {
+	wrapped := &struct {
+		Native *OpenRtbNativeRequest `json:"native"`
+		OpenRtbNativeRequest
+	}{}
+	if err := json.Unmarshal([]byte(native.Request), wrapped); err != nil {
+		return nil, err
+	}
+	if wrapped.Native != nil {
+		return wrapped.Native, nil
+	}
+	return &wrapped.OpenRtbNativeRequest, nil
+}
+
+// 按请求的素材列表填充，必需的素材填不了就返回错误，可选的跳过
+func NewOpenRtbNativeResponse(native *OpenRtbNative, record *Inventory, clickTracker string, impressionTracker string) (*OpenRtbNativeResponse, error) {
+	request, err := ParseOpenRtbNativeRequest(native)
+	if err != nil {
+		return nil, err
+	}
+	ad := &OpenRtbNativeAd{
+		Ver:         native.Ver,
+		Assets:      make([]*OpenRtbNativeAssetValue, 0, len(request.Assets)),
+		Link:        &OpenRtbNativeLink{Url: clickTracker},
+		ImpTrackers: []string{impressionTracker},
+	}
+	for _, asset := range request.Assets {
+		value := &OpenRtbNativeAssetValue{Id: asset.Id}
+		switch {
+		case asset.Title != nil && record.Label != "":
+			value.Title = &OpenRtbNativeText{Text: truncateRunes(record.Label, asset.Title.Len)}
+		case asset.Img != nil:
+			url := record.BannerUrl
+			if asset.Img.Type == NativeImageIcon || asset.Img.Type == NativeImageLogo {
+				url = record.IconUrl
+			}
+			if url != "" {
+				value.Img = &OpenRtbNativeImg{Url: url}
+			}
+		}
+		if value.Title == nil && value.Img == nil {
+			if asset.Required == 1 {
+				return nil, fmt.Errorf("required native asset %v not available", asset.Id)
+			}
+			continue
+		}
+		ad.Assets = append(ad.Assets, value)
+	}
+	return &OpenRtbNativeResponse{Native: ad}, nil
+}
+
+// length不大于0表示不限
+func truncateRunes(text string, length int) string {
+	if length <= 0 || utf8.RuneCountInString(text) <= length {
+		return text
+	}
+	return string([]rune(text)[:length])
+}
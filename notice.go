@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 成交价宏由交易平台替换，不能转义，也不在签名里
+func (rl *RtbLite) WinNotice(parsed *ParsedRequest, index int, record *Inventory) string {
+	return fmt.Sprintf("http://%v/win?%v&price=%v",
+		rl.configure.CallbackAddress, rl.noticeValues(parsed, index, record, "win"), AuctionPriceMacro)
+}
+
+func (rl *RtbLite) LossNotice(parsed *ParsedRequest, index int, record *Inventory) string {
+	return fmt.Sprintf("http://%v/loss?%v&price=%v&reason=%v",
+		rl.configure.CallbackAddress, rl.noticeValues(parsed, index, record, "loss"), AuctionPriceMacro, AuctionLossMacro)
+}
+
+func (rl *RtbLite) noticeValues(parsed *ParsedRequest, index int, record *Inventory, event string) string {
+	values := url.Values{}
+	values.Set("param", rl.TrackingParam(parsed, index, record))
+	if rl.signer != nil {
+		rl.signer.Sign(values, event, time.Now())
+	}
+	return values.Encode()
+}
+
+// 一个请求里有的imp赢有的输，通知统一按展示的过期时间保存，
+// 不能让loss缩短赢了的物料后续关联展示和点击的时间
+func (rl *RtbLite) noticeTimeout() int {
+	return rl.configure.RedisImpressionTimeout
+}
+
+func (rl *RtbLite) Win(rw http.ResponseWriter, req *http.Request) {
+	if !rl.VerifyTracker(rw, req, "win") {
+		return
+	}
+	param := req.URL.Query().Get("param")
+	if _, err := rl.DecodeParam(param); err != nil {
+		rl.logger.Error("fail to get id from param: %v", err.Error())
+		return
+	}
+	clearingPrice, err := DecodeAuctionPrice(rl.configure, req.URL.Query().Get("price"))
+	if err != nil {
+		rl.logger.Error("fail to decode price [err: %s][param: %s]", err.Error(), param)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	response := `{"error_code": 0, "error_message": "success"}`
+	io.WriteString(rw, response)
+
+	// 提前把结果发出去，后续操作交给后台的worker
+	rl.workers.Submit(&AsyncTask{Event: "win", Param: param, Price: clearingPrice, Time: time.Now()})
+}
+
+// 成交价按imp保存并打日志
+func (rl *RtbLite) processWin(task *AsyncTask) {
+	param := task.Param
+	token, err := rl.DecodeParam(param)
+	if err != nil {
+		rl.logger.Error("fail to get id from param: %v", err.Error())
+		return
+	}
+	// 通知按request_id和位置保存，token也只用来取id
+	index := token.Index
+	token = &TrackingToken{RequestId: token.RequestId, Index: index}
+	clearingPrice := task.Price
+	rl.joiner.Join(task, token, func(parsed *ParsedRequest) {
+		record := &Inventory{}
+		if err := rl.cache.FetchOne(parsed.Creatives[index].AdId, record); err != nil {
+			rl.logger.Error("fetch from db failed [err: %s][param: %s]", err.Error(), param)
+			return
+		}
+		parsed.Creatives[index].ClearingPrice = clearingPrice
+		notice := &AuctionNotice{ClearingPrice: clearingPrice}
+		if err := rl.redisWrapper.SaveNotice(parsed.Id, index, notice, rl.noticeTimeout()); err != nil {
+			rl.logger.Error("fail to save clearing price [err: %s][param: %s]", err.Error(), param)
+		}
+		// 赢了的请求要保留到展示和点击关联完
+		rl.redisWrapper.SetExpire(parsed.Id, rl.noticeTimeout())
+		rl.producer.Log(rl.configure.KafkaWinTopic, GetWinKafkaMessage(parsed, record, clearingPrice))
+	})
+}
+
+func (rl *RtbLite) Loss(rw http.ResponseWriter, req *http.Request) {
+	if !rl.VerifyTracker(rw, req, "loss") {
+		return
+	}
+	param := req.URL.Query().Get("param")
+	if _, err := rl.DecodeParam(param); err != nil {
+		rl.logger.Error("fail to get id from param: %v", err.Error())
+		return
+	}
+	reason := req.URL.Query().Get("reason")
+	// 输掉竞价时价格宏通常是最高出价，可能没有替换
+	clearingPrice, _ := DecodeAuctionPrice(rl.configure, req.URL.Query().Get("price"))
+
+	response := `{"error_code": 0, "error_message": "success"}`
+	io.WriteString(rw, response)
+
+	// 提前把结果发出去，后续操作交给后台的worker
+	rl.workers.Submit(&AsyncTask{Event: "loss", Param: param, Price: clearingPrice, Reason: reason, Time: time.Now()})
+}
+
+// 落败原因和价格按imp保存
+func (rl *RtbLite) processLoss(task *AsyncTask) {
+	param := task.Param
+	token, err := rl.DecodeParam(param)
+	if err != nil {
+		rl.logger.Error("fail to get id from param: %v", err.Error())
+		return
+	}
+	// 通知按request_id和位置保存，token也只用来取id
+	index := token.Index
+	token = &TrackingToken{RequestId: token.RequestId, Index: index}
+	reason, clearingPrice := task.Reason, task.Price
+	rl.joiner.Join(task, token, func(parsed *ParsedRequest) {
+		notice := &AuctionNotice{ClearingPrice: clearingPrice, LossReason: reason}
+		if err := rl.redisWrapper.SaveNotice(parsed.Id, index, notice, rl.noticeTimeout()); err != nil {
+			rl.logger.Error("fail to save loss notice [err: %s][param: %s]", err.Error(), param)
+		}
+		rl.logger.Info("auction lost [reason: %s][price: %v][param: %s]", reason, clearingPrice, param)
+	})
+}
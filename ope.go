@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// 一次展示，即某个请求某个位置上的物料
+type opeSlot struct {
+	RequestId   string
+	Position    int
+	PackageName string
+	Propensity  float64
+	Reward      float64
+}
+
+func opeSlotKey(requestId string, position int) string {
+	return fmt.Sprintf("%v-%v", requestId, position)
+}
+
+// 一个请求实际展示的物料，以及选择时的候选包名
+type opeRequest struct {
+	Slots      []*opeSlot
+	Candidates []string
+}
+
+type opeResult struct {
+	Slots        int // 参与评估的展示
+	Skipped      int // 没有选中概率或者前面的位置缺失，无法评估的展示
+	NoCandidates int // 没有记录候选包名的请求
+	Matched      int // 候选策略与实际前缀一致的展示
+	LoggedRate   float64
+	IPS          float64
+	SNIPS        float64
+	ESS          float64
+	DR           float64
+}
+
+// rtblite ope -rank adrank.json model.save model.save.20160101 ...
+// 用记录下来的选中概率，对一张候选排序表做离线评估：
+// 候选策略把每个请求的候选包名按排序表排序后依次展示，
+// 估计它在各个位置上的点击（或激活）率，给出IPS、SNIPS和DR的结果。
+// 需要开启OpeLogCandidates。有几点限制：
+// 候选是频控和画像过滤之后的，评估的只是排序，不包括召回和过滤；
+// 选中概率是给定前面位置时的条件概率，权重按前缀连乘，
+// 只有从第0位开始连续有展示的位置可以评估，中间缺了展示的，后面的位置都计入skipped
+func RunOpe(args []string) error {
+	flags := flag.NewFlagSet("ope", flag.ExitOnError)
+	rankFile := flags.String("rank", "adrank.json", "待评估的排序表")
+	event := flags.String("reward", "click", "作为回报的事件，click或activate")
+	clip := flags.Float64("clip", 100, "重要性权重的上限")
+	priorWeight := flags.Float64("prior", 10, "直接法中(包名,位置)点击率的平滑强度")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: rtblite ope [options] model.save ...")
+	}
+	rankTable, err := NewRankTable(*rankFile)
+	if err != nil {
+		return err
+	}
+
+	slots := make(map[string]*opeSlot)
+	rewards := make(map[string]bool)
+	requests := make(map[string]*opeRequest)
+	invalid, err := ReadModelDataLogs(flags.Args(), func(data *ModelData) {
+		key := opeSlotKey(data.RequestId, data.Position)
+		switch data.Event {
+		case "impression":
+			if _, ok := slots[key]; ok {
+				return
+			}
+			slot := &opeSlot{
+				RequestId:   data.RequestId,
+				Position:    data.Position,
+				PackageName: data.SelectedCreative.PackageName,
+				Propensity:  data.Propensity,
+			}
+			slots[key] = slot
+			request, ok := requests[data.RequestId]
+			if !ok {
+				request = &opeRequest{}
+				requests[data.RequestId] = request
+			}
+			request.Slots = append(request.Slots, slot)
+			if len(data.Candidates) > 0 {
+				request.Candidates = data.Candidates
+			}
+		case *event:
+			rewards[key] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for key, slot := range slots {
+		if rewards[key] {
+			slot.Reward = 1
+		}
+	}
+
+	result, err := evaluateOpe(requests, rankTable, *clip, *priorWeight)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("impressions:\t%v (%v skipped, %v requests without candidates, %v invalid lines)\n",
+		result.Slots, result.Skipped, result.NoCandidates, invalid)
+	fmt.Printf("matched:\t%v\n", result.Matched)
+	fmt.Printf("logged %v rate:\t%.6f\n", *event, result.LoggedRate)
+	fmt.Printf("IPS:\t\t%.6f\n", result.IPS)
+	if result.ESS > 0 {
+		fmt.Printf("SNIPS:\t\t%.6f\n", result.SNIPS)
+		fmt.Printf("ESS:\t\t%.1f\n", result.ESS)
+	}
+	fmt.Printf("DR:\t\t%.6f\n", result.DR)
+	return nil
+}
+
+// 对每个请求，候选策略的展示顺序是候选包名按排序表的稳定排序。
+// 第k位的权重是前k位选中概率倒数的连乘，只有候选策略的前k位与实际展示一致时才非零
+func evaluateOpe(requests map[string]*opeRequest, rankTable *RankTable, clip float64, priorWeight float64) (*opeResult, error) {
+	result := &opeResult{}
+	evaluated := make([]*opeSlot, 0)
+	targets := make([][]string, 0)
+	for _, request := range requests {
+		if len(request.Candidates) == 0 {
+			result.NoCandidates += 1
+			result.Skipped += len(request.Slots)
+			continue
+		}
+		sort.Slice(request.Slots, func(i, j int) bool { return request.Slots[i].Position < request.Slots[j].Position })
+		target := make([]string, len(request.Candidates))
+		copy(target, request.Candidates)
+		sort.SliceStable(target, func(i, j int) bool { return rankOf(rankTable, target[i]) < rankOf(rankTable, target[j]) })
+		for k, slot := range request.Slots {
+			if slot.Position != k || slot.Propensity <= 0 || k >= len(target) {
+				result.Skipped += len(request.Slots) - k
+				break
+			}
+			evaluated = append(evaluated, slot)
+			targets = append(targets, target)
+		}
+	}
+	if len(evaluated) == 0 {
+		return nil, errors.New("no impression with propensity and candidates found")
+	}
+
+	// 直接法的回报模型：(包名, 位置)的平滑点击率
+	totalReward := 0.0
+	for _, slot := range evaluated {
+		totalReward += slot.Reward
+	}
+	prior := totalReward / float64(len(evaluated))
+	type cell struct{ count, reward float64 }
+	cells := make(map[string]*cell)
+	for _, slot := range evaluated {
+		key := opeSlotKey(slot.PackageName, slot.Position)
+		if _, ok := cells[key]; !ok {
+			cells[key] = &cell{}
+		}
+		cells[key].count += 1
+		cells[key].reward += slot.Reward
+	}
+	q := func(packageName string, position int) float64 {
+		c, ok := cells[opeSlotKey(packageName, position)]
+		if !ok {
+			return prior
+		}
+		return (c.reward + prior*priorWeight) / (c.count + priorWeight)
+	}
+
+	var ips, weightSum, weightSquareSum, dr float64
+	// 同一个请求的位置在evaluated中是连续且从0开始的
+	prefix := 0.0
+	for index, slot := range evaluated {
+		k := slot.Position
+		target := targets[index]
+		if k == 0 {
+			prefix = 1
+		}
+		if target[k] == slot.PackageName {
+			prefix /= slot.Propensity
+		} else {
+			prefix = 0
+		}
+		weight := math.Min(prefix, clip)
+		if weight > 0 {
+			result.Matched += 1
+		}
+		ips += weight * slot.Reward
+		weightSum += weight
+		weightSquareSum += weight * weight
+		dr += q(target[k], k) + weight*(slot.Reward-q(slot.PackageName, k))
+	}
+
+	n := float64(len(evaluated))
+	result.Slots = len(evaluated)
+	result.LoggedRate = prior
+	result.IPS = ips / n
+	result.DR = dr / n
+	if weightSum > 0 {
+		result.SNIPS = ips / weightSum
+		result.ESS = weightSum * weightSum / weightSquareSum
+	}
+	return result, nil
+}
+
+func rankOf(rankTable *RankTable, packageName string) int {
+	if index, ok := rankTable.rank[packageName]; ok {
+		return index
+	}
+	return rankTable.Len()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// 记录策略均匀随机排列候选，每个(包名,位置)的点击率已知，
+// 评估结果应当接近候选策略的真实点击率
+func TestEvaluateOpe(t *testing.T) {
+	candidates := []string{"a", "b", "c"}
+	ctr := map[string][]float64{"a": {0.05, 0.03}, "b": {0.2, 0.1}, "c": {0.1, 0.05}}
+	cases := []struct {
+		name string
+		rank map[string]int
+	}{
+		{"b first", map[string]int{"b": 0, "c": 1, "a": 2}},
+		{"a first", map[string]int{"a": 0, "c": 1}},
+	}
+	r := rand.New(rand.NewSource(11))
+	requests := make(map[string]*opeRequest)
+	for i := 0; i < 60000; i++ {
+		id := fmt.Sprintf("r%v", i)
+		request := &opeRequest{Candidates: candidates}
+		for k, index := range r.Perm(len(candidates))[:2] {
+			slot := &opeSlot{RequestId: id, Position: k, PackageName: candidates[index], Propensity: 1 / float64(len(candidates)-k)}
+			if r.Float64() < ctr[slot.PackageName][k] {
+				slot.Reward = 1
+			}
+			request.Slots = append(request.Slots, slot)
+		}
+		requests[id] = request
+	}
+	// 没有候选的请求和缺了第0位的请求不参与评估
+	requests["no candidates"] = &opeRequest{Slots: []*opeSlot{{Position: 0, PackageName: "a", Propensity: 1}}}
+	requests["gap"] = &opeRequest{Candidates: candidates, Slots: []*opeSlot{{Position: 1, PackageName: "a", Propensity: 0.5}}}
+
+	for _, c := range cases {
+		rankTable := &RankTable{rank: c.rank}
+		result, err := evaluateOpe(requests, rankTable, 100, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 按排序表排序后前两位的平均点击率
+		target := []string{"b", "c", "a"}
+		if c.name == "a first" {
+			target = []string{"a", "c", "b"}
+		}
+		want := (ctr[target[0]][0] + ctr[target[1]][1]) / 2
+		if result.Slots != 120000 || result.Skipped != 2 || result.NoCandidates != 1 {
+			t.Errorf("%v: result = %+v", c.name, result)
+		}
+		for name, got := range map[string]float64{"IPS": result.IPS, "SNIPS": result.SNIPS, "DR": result.DR} {
+			if math.Abs(got-want) > 0.01 {
+				t.Errorf("%v: %v = %.4f, want %.4f", c.name, name, got, want)
+			}
+		}
+	}
+
+	if _, err := evaluateOpe(map[string]*opeRequest{}, &RankTable{rank: map[string]int{}}, 100, 10); err == nil {
+		t.Errorf("empty logs evaluated")
+	}
+}
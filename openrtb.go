@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yangzhao28/go.uuid"
+)
+
+// OpenRTB 2.5，只保留映射到ParsedRequest需要的字段
+
+type OpenRtbBidRequest struct {
+	Id     string          `json:"id"`
+	Imp    []*OpenRtbImp   `json:"imp"`
+	App    *OpenRtbApp     `json:"app,omitempty"`
+	Device *OpenRtbDevice  `json:"device,omitempty"`
+	User   *OpenRtbUser    `json:"user,omitempty"`
+	Test   int             `json:"test,omitempty"`
+	At     int             `json:"at,omitempty"`
+	TMax   int             `json:"tmax,omitempty"`
+	Cur    []string        `json:"cur,omitempty"`
+	Ext    json.RawMessage `json:"ext,omitempty"`
+}
+
+type OpenRtbImp struct {
+	Id          string          `json:"id"`
+	Banner      *OpenRtbBanner  `json:"banner,omitempty"`
+	Native      *OpenRtbNative  `json:"native,omitempty"`
+	TagId       string          `json:"tagid,omitempty"`
+	BidFloor    float64         `json:"bidfloor,omitempty"`
+	BidFloorCur string          `json:"bidfloorcur,omitempty"`
+	Instl       int             `json:"instl,omitempty"`
+	Ext         json.RawMessage `json:"ext,omitempty"`
+}
+
+type OpenRtbBanner struct {
+	W int `json:"w,omitempty"`
+	H int `json:"h,omitempty"`
+}
+
+type OpenRtbNative struct {
+	Request string `json:"request"`
+	Ver     string `json:"ver,omitempty"`
+}
+
+type OpenRtbApp struct {
+	Id     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Bundle string `json:"bundle,omitempty"`
+	Ver    string `json:"ver,omitempty"`
+}
+
+type OpenRtbDevice struct {
+	Ua             string      `json:"ua,omitempty"`
+	Geo            *OpenRtbGeo `json:"geo,omitempty"`
+	Ip             string      `json:"ip,omitempty"`
+	Os             string      `json:"os,omitempty"`
+	Osv            string      `json:"osv,omitempty"`
+	Language       string      `json:"language,omitempty"`
+	Carrier        string      `json:"carrier,omitempty"`
+	MccMnc         string      `json:"mccmnc,omitempty"`
+	ConnectionType int         `json:"connectiontype,omitempty"`
+	Ifa            string      `json:"ifa,omitempty"`
+}
+
+type OpenRtbGeo struct {
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	City    string `json:"city,omitempty"`
+}
+
+type OpenRtbUser struct {
+	Id       string `json:"id,omitempty"`
+	BuyerUid string `json:"buyeruid,omitempty"`
+}
+
+type OpenRtbBidResponse struct {
+	Id      string            `json:"id"`
+	SeatBid []*OpenRtbSeatBid `json:"seatbid"`
+	BidId   string            `json:"bidid,omitempty"`
+	Cur     string            `json:"cur,omitempty"`
+}
+
+type OpenRtbSeatBid struct {
+	Bid  []*OpenRtbBid `json:"bid"`
+	Seat string        `json:"seat,omitempty"`
+}
+
+type OpenRtbBid struct {
+	Id      string   `json:"id"`
+	ImpId   string   `json:"impid"`
+	Price   float64  `json:"price"`
+	AdId    string   `json:"adid,omitempty"`
+	NUrl    string   `json:"nurl,omitempty"`
+	LUrl    string   `json:"lurl,omitempty"`
+	AdM     string   `json:"adm,omitempty"`
+	ADomain []string `json:"adomain,omitempty"`
+	Bundle  string   `json:"bundle,omitempty"`
+	IUrl    string   `json:"iurl,omitempty"`
+	CId     string   `json:"cid,omitempty"`
+	CrId    string   `json:"crid,omitempty"`
+	W       int      `json:"w,omitempty"`
+	H       int      `json:"h,omitempty"`
+}
+
+// 把BidRequest映射成内部请求，每个imp最多出一个物料
+func (rl *RtbLite) ParseOpenRtb(bidRequest *OpenRtbBidRequest) *ParsedRequest {
+	r := newRequestFromOpenRtb(bidRequest)
+	rl.Locate(r)
+	// ip查不到国家时用设备上报的
+	if r.IpLib.CountryCode == "" && r.Cc != "" {
+		r.IpLib.CountryCode = r.Cc
+		r.IpLib.IpHashLevel1 = HiveHash(r.Cc)
+	}
+	return r
+}
+
+func newRequestFromOpenRtb(bidRequest *OpenRtbBidRequest) *ParsedRequest {
+	r := &ParsedRequest{
+		Limit: len(bidRequest.Imp),
+		Id:    uuid.NewV4().Hex(),
+	}
+	if len(bidRequest.Imp) > 0 {
+		r.PlacementId = bidRequest.Imp[0].TagId
+	}
+	if app := bidRequest.App; app != nil {
+		r.Hp = app.Bundle
+		r.ClientVersion = app.Ver
+	}
+	if device := bidRequest.Device; device != nil {
+		r.L = device.Language
+		// 2.5里的mccmnc形如310-005
+		r.M = strings.Replace(device.MccMnc, "-", "", -1)
+		r.Ip = device.Ip
+		r.Cid = device.Ifa
+		r.OsVersion = device.Osv
+		r.Network = device.ConnectionType
+		if device.Geo != nil {
+			r.Cc = CountryAlpha2(device.Geo.Country)
+		}
+	}
+	if r.Cid == "" && bidRequest.User != nil {
+		r.Cid = bidRequest.User.Id
+	}
+	r.OsVersionNum = VersionToInt(r.OsVersion)
+	return r
+}
+
+// 只处理banner和native，其他类型的imp不参与选物料
+func supportedImps(imps []*OpenRtbImp) []*OpenRtbImp {
+	supported := make([]*OpenRtbImp, 0, len(imps))
+	for _, imp := range imps {
+		if imp.Banner != nil || imp.Native != nil {
+			supported = append(supported, imp)
+		}
+	}
+	return supported
+}
+
+// cur为空表示不限，否则必须包含出价的币种
+func acceptsCurrency(allowed []string, currency string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, value := range allowed {
+		if strings.EqualFold(strings.TrimSpace(value), currency) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenRTB的出价是CPM，按预估的eCPM出价
+func (rl *RtbLite) OpenRtbPrice(record *Inventory) float64 {
+	estimator := rl.cache.Estimator()
+	if estimator == nil {
+		estimator = NewConstRateEstimator(rl.configure.DefaultCtr, rl.configure.DefaultCvr)
+	}
+	return EstimateEcpm(estimator, record)
+}
+
+// 物料填不满native请求中必需的素材时返回错误，这个imp不出价
+func OpenRtbAdMarkup(imp *OpenRtbImp, record *Inventory, clickTracker string, impressionTracker string) (string, error) {
+	if imp.Banner != nil {
+		return fmt.Sprintf(`<a href="%v" target="_blank"><img src="%v" width="%v" height="%v" border="0"/></a><img src="%v" width="1" height="1" style="display:none"/>`,
+			html.EscapeString(clickTracker), html.EscapeString(record.BannerUrl), imp.Banner.W, imp.Banner.H,
+			html.EscapeString(impressionTracker)), nil
+	}
+	if imp.Native == nil {
+		return "", errors.New("neither banner nor native")
+	}
+	response, err := NewOpenRtbNativeResponse(imp.Native, record, clickTracker, impressionTracker)
+	if err != nil {
+		return "", err
+	}
+	adm, err := json.Marshal(response)
+	return string(adm), err
+}
+
+func (rl *RtbLite) OpenRtb(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	defer rl.profiler.OnRequest(time.Now().Sub(start).Seconds())
+
+	bidRequest := &OpenRtbBidRequest{}
+	if err := json.NewDecoder(req.Body).Decode(bidRequest); err != nil {
+		rl.logger.Warning("invalid bid request: %v", err.Error())
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if bidRequest.Id == "" || len(bidRequest.Imp) == 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// 不做汇率换算，只出美元价
+	bidRequest.Imp = supportedImps(bidRequest.Imp)
+	if len(bidRequest.Imp) == 0 || !acceptsCurrency(bidRequest.Cur, "USD") {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	parsed := rl.ParseOpenRtb(bidRequest)
+	creatives, ok := rl.Select(parsed)
+	if !ok || len(creatives) == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	bids := make([]*OpenRtbBid, 0, len(creatives))
+	for index, record := range creatives {
+		if index >= len(bidRequest.Imp) {
+			break
+		}
+		imp := bidRequest.Imp[index]
+		if record.Bid.Currency != "USD" {
+			continue
+		}
+		if imp.BidFloorCur != "" && imp.BidFloorCur != "USD" {
+			continue
+		}
+		price := rl.OpenRtbPrice(record)
+		if price <= 0 || price < imp.BidFloor {
+			continue
+		}
+		clickTracker, impressionTracker := rl.Trackers(parsed, index, record)
+		adm, err := OpenRtbAdMarkup(imp, record, clickTracker, impressionTracker)
+		if err != nil {
+			rl.logger.Debug("no markup for imp %v [ad_id: %v][err: %v]", imp.Id, record.AdId, err.Error())
+			continue
+		}
+		bid := &OpenRtbBid{
+			Id:     fmt.Sprintf("%v-%v", parsed.Id, index),
+			ImpId:  imp.Id,
+			Price:  price,
+			AdId:   strconv.Itoa(record.AdId),
+			NUrl:   rl.WinNotice(parsed, index, record),
+			LUrl:   rl.LossNotice(parsed, index, record),
+			AdM:    adm,
+			Bundle: record.PackageName,
+			IUrl:   record.BannerUrl,
+			CId:    strconv.Itoa(record.ModelSign1),
+			CrId:   strconv.Itoa(record.AdId),
+		}
+		if imp.Banner != nil {
+			bid.W, bid.H = imp.Banner.W, imp.Banner.H
+		}
+		bids = append(bids, bid)
+	}
+	if len(bids) == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rl.RememberSelected(parsed, creatives)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Openrtb-Version", "2.5")
+	json.NewEncoder(rw).Encode(&OpenRtbBidResponse{
+		Id:      bidRequest.Id,
+		SeatBid: []*OpenRtbSeatBid{{Bid: bids}},
+		BidId:   parsed.Id,
+		Cur:     "USD",
+	})
+
+	rl.OnSelected(parsed)
+}
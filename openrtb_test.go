@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCountryAlpha2(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"BRA", "BR"}, {"usa", "US"}, {" CHN ", "CN"}, {"BR", "BR"}, {"XXX", ""}, {"", ""}, {"BRAZ", ""},
+	}
+	for _, c := range cases {
+		if got := CountryAlpha2(c.in); got != c.want {
+			t.Errorf("CountryAlpha2(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestNewRequestFromOpenRtb(t *testing.T) {
+	bidRequest := &OpenRtbBidRequest{}
+	err := json.Unmarshal([]byte(`{
+		"id": "1",
+		"imp": [{"id": "1", "tagid": "p1", "banner": {"w": 320, "h": 50}}, {"id": "2", "native": {"request": "{}"}}],
+		"app": {"bundle": "com.host", "ver": "1.2"},
+		"device": {"ip": "1.2.3.4", "osv": "4.4.2", "language": "pt", "mccmnc": "724-02",
+			"connectiontype": 2, "ifa": "gaid", "geo": {"country": "BRA"}},
+		"user": {"id": "uid"}
+	}`), bidRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRequestFromOpenRtb(bidRequest)
+	if r.Limit != 2 || r.PlacementId != "p1" || r.Hp != "com.host" || r.ClientVersion != "1.2" {
+		t.Errorf("request = %+v", r)
+	}
+	if r.M != "72402" || r.Cc != "BR" || r.Cid != "gaid" || r.OsVersionNum != 40402 || r.Network != 2 {
+		t.Errorf("device = %+v", r)
+	}
+
+	bidRequest.Device.Ifa = ""
+	if r := newRequestFromOpenRtb(bidRequest); r.Cid != "uid" {
+		t.Errorf("Cid = %v, want user.id fallback", r.Cid)
+	}
+}
+
+func TestSupportedImpsAndCurrency(t *testing.T) {
+	imps := []*OpenRtbImp{
+		{Id: "1", Banner: &OpenRtbBanner{}},
+		{Id: "2"},
+		{Id: "3", Native: &OpenRtbNative{}},
+	}
+	got := make([]string, 0)
+	for _, imp := range supportedImps(imps) {
+		got = append(got, imp.Id)
+	}
+	if !equalStrings(got, []string{"1", "3"}) {
+		t.Errorf("supportedImps = %v", got)
+	}
+
+	cases := []struct {
+		cur  []string
+		want bool
+	}{
+		{nil, true},
+		{[]string{"usd"}, true},
+		{[]string{"EUR", "USD"}, true},
+		{[]string{"EUR"}, false},
+	}
+	for _, c := range cases {
+		if got := acceptsCurrency(c.cur, "USD"); got != c.want {
+			t.Errorf("acceptsCurrency(%v) = %v", c.cur, got)
+		}
+	}
+}
+
+func TestOpenRtbAdMarkup(t *testing.T) {
+	record := &Inventory{Label: "Game of War", IconUrl: "http://icon", BannerUrl: "http://banner?a=1&b=2"}
+
+	banner, err := OpenRtbAdMarkup(&OpenRtbImp{Banner: &OpenRtbBanner{W: 320, H: 50}}, record, "http://click", "http://imp")
+	if err != nil || !strings.Contains(banner, `src="http://banner?a=1&amp;b=2"`) || !strings.Contains(banner, `width="320"`) {
+		t.Errorf("banner = %v, %v", banner, err)
+	}
+	if _, err := OpenRtbAdMarkup(&OpenRtbImp{}, record, "", ""); err == nil {
+		t.Errorf("expected error for imp without banner or native")
+	}
+
+	cases := []struct {
+		name    string
+		request string
+		ok      bool
+		assets  string
+	}{
+		{
+			"1.0 wrapped",
+			`{"native": {"assets": [{"id": 1, "required": 1, "title": {"len": 4}}, {"id": 2, "img": {"type": 1}}]}}`,
+			true, `[{"id":1,"title":{"text":"Game"}},{"id":2,"img":{"url":"http://icon"}}]`,
+		},
+		{
+			"1.1 unwrapped main image",
+			`{"assets": [{"id": 5, "required": 1, "img": {"type": 3}}]}`,
+			true, `[{"id":5,"img":{"url":"http://banner?a=1\u0026b=2"}}]`,
+		},
+		{
+			"optional data skipped",
+			`{"assets": [{"id": 1, "title": {"len": 0}}, {"id": 2, "data": {"type": 2}}]}`,
+			true, `[{"id":1,"title":{"text":"Game of War"}}]`,
+		},
+		{
+			"required data",
+			`{"assets": [{"id": 2, "required": 1, "data": {"type": 2}}]}`,
+			false, "",
+		},
+		{"invalid", `not json`, false, ""},
+	}
+	for _, c := range cases {
+		imp := &OpenRtbImp{Native: &OpenRtbNative{Request: c.request}}
+		adm, err := OpenRtbAdMarkup(imp, record, "http://click", "http://imp")
+		if (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		response := &struct {
+			Native struct {
+				Assets      json.RawMessage `json:"assets"`
+				Link        struct{ Url string }
+				ImpTrackers []string `json:"imptrackers"`
+			} `json:"native"`
+		}{}
+		if err := json.Unmarshal([]byte(adm), response); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if string(response.Native.Assets) != c.assets {
+			t.Errorf("%v: assets = %s, want %s", c.name, response.Native.Assets, c.assets)
+		}
+		if response.Native.Link.Url != "http://click" || !equalStrings(response.Native.ImpTrackers, []string{"http://imp"}) {
+			t.Errorf("%v: adm = %v", c.name, adm)
+		}
+	}
+}
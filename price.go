@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPriceSignature = errors.New("invalid price signature")
+
+// 成交价宏
+const AuctionPriceMacro = "${AUCTION_PRICE}"
+const AuctionLossMacro = "${AUCTION_LOSS}"
+
+// 解析win/loss通知中替换后的成交价，单位同OpenRTB的price（每千次）。
+// 配置了PriceEncryptionKey时按DoubleClick的方式解密：
+// websafe base64(iv[16] | price[8] ^ hmac(ekey, iv)[:8] | hmac(ikey, price|iv)[:4])，
+// 解出来的是微单位
+func DecodeAuctionPrice(configure *Configure, raw string) (float64, error) {
+	if configure.PriceEncryptionKey == "" {
+		price, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return 0, err
+		}
+		// ParseFloat接受NaN和Inf
+		if math.IsNaN(price) || math.IsInf(price, 0) || price < 0 {
+			return 0, fmt.Errorf("invalid price %q", raw)
+		}
+		return price, nil
+	}
+	encryptionKey, err := decodePriceKey(configure.PriceEncryptionKey)
+	if err != nil {
+		return 0, err
+	}
+	integrityKey, err := decodePriceKey(configure.PriceIntegrityKey)
+	if err != nil {
+		return 0, err
+	}
+	data, err := base64.URLEncoding.DecodeString(padBase64(raw))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 28 {
+		return 0, errors.New("invalid encrypted price length")
+	}
+	iv, cipher, signature := data[:16], data[16:24], data[24:]
+
+	mac := hmac.New(sha1.New, encryptionKey)
+	mac.Write(iv)
+	pad := mac.Sum(nil)
+	plain := make([]byte, 8)
+	for i := range plain {
+		plain[i] = cipher[i] ^ pad[i]
+	}
+
+	mac = hmac.New(sha1.New, integrityKey)
+	mac.Write(plain)
+	mac.Write(iv)
+	if !hmac.Equal(mac.Sum(nil)[:4], signature) {
+		return 0, ErrInvalidPriceSignature
+	}
+	return float64(binary.BigEndian.Uint64(plain)) / 1e6, nil
+}
+
+// 密钥按websafe base64配置
+func decodePriceKey(key string) ([]byte, error) {
+	return base64.URLEncoding.DecodeString(padBase64(key))
+}
+
+func padBase64(value string) string {
+	value = strings.TrimRight(value, "=")
+	if remain := len(value) % 4; remain != 0 {
+		value += strings.Repeat("=", 4-remain)
+	}
+	return value
+}
+
+type BidType int
+
+const (
+	BidTypeCPI BidType = iota
+	BidTypeCPC
+	BidTypeCPM
+)
+
+func (t BidType) String() string {
+	switch t {
+	case BidTypeCPC:
+		return "cpc"
+	case BidTypeCPM:
+		return "cpm"
+	}
+	return "cpi"
+}
+
+func ParseBidType(value string) (BidType, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "cpi", "cpa":
+		return BidTypeCPI, nil
+	case "cpc":
+		return BidTypeCPC, nil
+	case "cpm":
+		return BidTypeCPM, nil
+	}
+	return BidTypeCPI, fmt.Errorf("unknown bid type: %v", value)
+}
+
+// 物料出价，price字段为微单位。UsdMicros为折算成美元之后的出价，排序只用它
+type Bid struct {
+	Type      BidType
+	Micros    int64
+	Currency  string
+	UsdMicros int64
+}
+
+func ParseBid(price string, bidType string, currency string) (Bid, error) {
+	bid := Bid{Currency: "USD"}
+	var err error
+	if bid.Type, err = ParseBidType(bidType); err != nil {
+		return bid, err
+	}
+	if currency != "" {
+		if len(currency) != 3 {
+			return bid, fmt.Errorf("invalid currency: %v", currency)
+		}
+		bid.Currency = strings.ToUpper(currency)
+	}
+	micros, err := strconv.ParseFloat(strings.TrimSpace(price), 64)
+	if err != nil {
+		return bid, fmt.Errorf("invalid price %q: %v", price, err.Error())
+	}
+	if math.IsNaN(micros) || math.IsInf(micros, 0) || micros < 0 {
+		return bid, fmt.Errorf("invalid price %q", price)
+	}
+	bid.Micros = int64(micros + 0.5)
+	if bid.Currency == "USD" {
+		bid.UsdMicros = bid.Micros
+	}
+	return bid, nil
+}
+
+// 按rates折算成美元，rates为1单位该币种折合的美元数，没有汇率时返回错误
+func (b *Bid) Normalize(rates map[string]float64) error {
+	if b.Currency == "USD" {
+		b.UsdMicros = b.Micros
+		return nil
+	}
+	rate, ok := rates[b.Currency]
+	if !ok || math.IsNaN(rate) || math.IsInf(rate, 0) || rate <= 0 {
+		return fmt.Errorf("no exchange rate for %v", b.Currency)
+	}
+	b.UsdMicros = int64(float64(b.Micros)*rate + 0.5)
+	return nil
+}
+
+// 千次展示的预期收入，单位为美元
+func (b Bid) Ecpm(ctr float64, cvr float64) float64 {
+	amount := float64(b.UsdMicros) / 1e6
+	switch b.Type {
+	case BidTypeCPM:
+		return amount
+	case BidTypeCPC:
+		return amount * ctr * 1000
+	}
+	return amount * ctr * cvr * 1000
+}
+
+// 点击率和转化率的预估
+type RateEstimator interface {
+	Estimate(record *Inventory) (ctr float64, cvr float64)
+}
+
+type constRateEstimator struct {
+	ctr float64
+	cvr float64
+}
+
+func NewConstRateEstimator(ctr float64, cvr float64) RateEstimator {
+	return &constRateEstimator{ctr: ctr, cvr: cvr}
+}
+
+func (e *constRateEstimator) Estimate(record *Inventory) (float64, float64) {
+	return e.ctr, e.cvr
+}
+
+func EstimateEcpm(estimator RateEstimator, record *Inventory) float64 {
+	ctr, cvr := estimator.Estimate(record)
+	return record.Bid.Ecpm(ctr, cvr)
+}
+
+// 按eCPM从高到低，预先算好避免排序时重复预估
+type ecpmOrder struct {
+	data  []*Inventory
+	ecpms []float64
+}
+
+func newEcpmOrder(data []*Inventory, estimator RateEstimator) *ecpmOrder {
+	ecpms := make([]float64, len(data))
+	for i, record := range data {
+		ecpms[i] = EstimateEcpm(estimator, record)
+	}
+	return &ecpmOrder{data: data, ecpms: ecpms}
+}
+
+func (o *ecpmOrder) Len() int           { return len(o.data) }
+func (o *ecpmOrder) Less(i, j int) bool { return o.ecpms[i] > o.ecpms[j] }
+func (o *ecpmOrder) Swap(i, j int) {
+	o.data[i], o.data[j] = o.data[j], o.data[i]
+	o.ecpms[i], o.ecpms[j] = o.ecpms[j], o.ecpms[i]
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// 按DoubleClick的方式加密，用来构造测试数据
+func encryptTestPrice(encryptionKey, integrityKey []byte, iv []byte, micros uint64) string {
+	plain := make([]byte, 8)
+	binary.BigEndian.PutUint64(plain, micros)
+	mac := hmac.New(sha1.New, encryptionKey)
+	mac.Write(iv)
+	pad := mac.Sum(nil)
+	cipher := make([]byte, 8)
+	for i := range cipher {
+		cipher[i] = plain[i] ^ pad[i]
+	}
+	mac = hmac.New(sha1.New, integrityKey)
+	mac.Write(plain)
+	mac.Write(iv)
+	data := append(append(append([]byte{}, iv...), cipher...), mac.Sum(nil)[:4]...)
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+func TestDecodeAuctionPricePlain(t *testing.T) {
+	configure := NewConfigure()
+	cases := []struct {
+		raw  string
+		want float64
+		ok   bool
+	}{
+		{"1.25", 1.25, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{AuctionPriceMacro, 0, false},
+		{"-1", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"-Inf", 0, false},
+		{"1e400", 0, false},
+	}
+	for _, c := range cases {
+		got, err := DecodeAuctionPrice(configure, c.raw)
+		if (err == nil) != c.ok || (c.ok && got != c.want) {
+			t.Errorf("DecodeAuctionPrice(%q) = %v, %v", c.raw, got, err)
+		}
+	}
+}
+
+func TestDecodeAuctionPriceEncrypted(t *testing.T) {
+	encryptionKey := []byte("0123456789abcdef0123456789abcdef")
+	integrityKey := []byte("fedcba9876543210fedcba9876543210")
+	configure := NewConfigure()
+	configure.PriceEncryptionKey = base64.URLEncoding.EncodeToString(encryptionKey)
+	configure.PriceIntegrityKey = base64.URLEncoding.EncodeToString(integrityKey)
+	iv := []byte("0123456789abcdef")
+
+	valid := encryptTestPrice(encryptionKey, integrityKey, iv, 1250000)
+	tampered := []byte(valid)
+	tampered[30] ^= 1
+	cases := []struct {
+		name string
+		raw  string
+		want float64
+		err  bool
+	}{
+		{"valid", valid, 1.25, false},
+		{"padded", valid + "=", 1.25, false},
+		{"wrong integrity key", encryptTestPrice(encryptionKey, encryptionKey, iv, 1250000), 0, true},
+		{"tampered", string(tampered), 0, true},
+		{"short", valid[:20], 0, true},
+		{"not base64", "!!!", 0, true},
+		{"max", encryptTestPrice(encryptionKey, integrityKey, iv, math.MaxUint64), float64(math.MaxUint64) / 1e6, false},
+	}
+	for _, c := range cases {
+		got, err := DecodeAuctionPrice(configure, c.raw)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("%v: DecodeAuctionPrice = %v, %v", c.name, got, err)
+		}
+	}
+}
+
+func TestParseBid(t *testing.T) {
+	cases := []struct {
+		price, bidType, currency string
+		want                     Bid
+		ok                       bool
+	}{
+		{"1500000", "", "", Bid{BidTypeCPI, 1500000, "USD", 1500000}, true},
+		{" 2.6 ", "CPC", "eur", Bid{BidTypeCPC, 3, "EUR", 0}, true},
+		{"100", "cpa", "", Bid{BidTypeCPI, 100, "USD", 100}, true},
+		{"100", "cpm", "USD", Bid{BidTypeCPM, 100, "USD", 100}, true},
+		{"100", "cpx", "", Bid{}, false},
+		{"100", "", "DOLLAR", Bid{}, false},
+		{"", "", "", Bid{}, false},
+		{"-1", "", "", Bid{}, false},
+		{"NaN", "", "", Bid{}, false},
+	}
+	for _, c := range cases {
+		got, err := ParseBid(c.price, c.bidType, c.currency)
+		if (err == nil) != c.ok || (c.ok && got != c.want) {
+			t.Errorf("ParseBid(%q, %q, %q) = %+v, %v", c.price, c.bidType, c.currency, got, err)
+		}
+	}
+}
+
+func TestBidEcpm(t *testing.T) {
+	cases := []struct {
+		bid  Bid
+		want float64
+	}{
+		{Bid{Type: BidTypeCPM, UsdMicros: 2000000}, 2},
+		{Bid{Type: BidTypeCPC, UsdMicros: 500000}, 0.5 * 0.02 * 1000},
+		{Bid{Type: BidTypeCPI, UsdMicros: 3000000}, 3 * 0.02 * 0.1 * 1000},
+	}
+	for _, c := range cases {
+		if got := c.bid.Ecpm(0.02, 0.1); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%v Ecpm = %v, want %v", c.bid.Type, got, c.want)
+		}
+	}
+}
+
+type mapRateEstimator map[string]float64
+
+func (e mapRateEstimator) Estimate(record *Inventory) (float64, float64) {
+	return e[record.PackageName], 1
+}
+
+func TestEcpmOrder(t *testing.T) {
+	estimator := mapRateEstimator{"a": 0.01, "b": 0.05, "c": 0.02}
+	collection := NewInventoryCollection(&RankTable{rank: map[string]int{"a": 0, "b": 1, "c": 2}}, estimator)
+	for _, name := range []string{"a", "b", "c"} {
+		collection.Append(&Inventory{PackageName: name, Bid: Bid{Type: BidTypeCPC, UsdMicros: 1000000}})
+	}
+	collection.Append(&Inventory{PackageName: "d", Bid: Bid{Type: BidTypeCPM, UsdMicros: 30000000}})
+	collection.Build()
+	if got := collectionPackages(collection); !equalStrings(got, []string{"b", "d", "c", "a"}) {
+		t.Errorf("order = %v", got)
+	}
+}
+
+func TestBidNormalize(t *testing.T) {
+	rates := map[string]float64{"EUR": 1.1, "JPY": 0.007, "BAD": -1}
+	cases := []struct {
+		currency string
+		micros   int64
+		want     int64
+		ok       bool
+	}{
+		{"USD", 1000000, 1000000, true},
+		{"EUR", 1000000, 1100000, true},
+		{"JPY", 100000000, 700000, true},
+		{"GBP", 1000000, 0, false},
+		{"BAD", 1000000, 0, false},
+	}
+	for _, c := range cases {
+		bid := Bid{Type: BidTypeCPM, Micros: c.micros, Currency: c.currency}
+		if err := bid.Normalize(rates); (err == nil) != c.ok || bid.UsdMicros != c.want {
+			t.Errorf("%v: UsdMicros = %v, err = %v", c.currency, bid.UsdMicros, err)
+		}
+	}
+}
+
+// 不同币种按美元比较：100日元不能排在1美元前面
+func TestEcpmOrderMixedCurrencies(t *testing.T) {
+	rates := map[string]float64{"JPY": 0.007, "EUR": 1.1}
+	records := []*Inventory{
+		{PackageName: "jpy", Price: "100000000", Extension: `{"bid_type": "cpm", "currency": "JPY"}`},
+		{PackageName: "usd", Price: "1000000", Extension: `{"bid_type": "cpm"}`},
+		{PackageName: "eur", Price: "1000000", Extension: `{"bid_type": "cpm", "currency": "EUR"}`},
+	}
+	collection := NewInventoryCollection(&RankTable{rank: map[string]int{}}, mapRateEstimator{})
+	for _, record := range records {
+		if err := record.Prepare(rates, testLogger); err != nil {
+			t.Fatal(err)
+		}
+		collection.Append(record)
+	}
+	collection.Build()
+	if got := collectionPackages(collection); !equalStrings(got, []string{"eur", "usd", "jpy"}) {
+		t.Errorf("order = %v", got)
+	}
+}
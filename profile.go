@@ -0,0 +1,273 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/op/go-logging"
+)
+
+// 画像中的一项，包名或者类目
+type ProfileCounts struct {
+	Impressions int64 `json:"imp"`
+	Clicks      int64 `json:"clk"`
+	Installs    int64 `json:"ins"`
+	LastSeen    int64 `json:"ts"`
+}
+
+// 用户画像，redis中每个用户一个hash，字段为"p:包名:imp"、"c:类目:clk"这样的形式，
+// 另有一个按最近出现时间排序的zset，用来淘汰超出上限的包名和类目
+type UserProfile struct {
+	Packages   map[string]*ProfileCounts `json:"packages"`
+	Categories map[string]*ProfileCounts `json:"categories"`
+	LastSeen   int64                     `json:"ts"`
+}
+
+func NewUserProfile() *UserProfile {
+	return &UserProfile{
+		Packages:   make(map[string]*ProfileCounts),
+		Categories: make(map[string]*ProfileCounts),
+	}
+}
+
+// 作为特征的包名状态：installed、clicked、seen、none
+func (p *UserProfile) PackageState(packageName string) string {
+	if p == nil {
+		return "none"
+	}
+	counts, ok := p.Packages[packageName]
+	switch {
+	case !ok:
+		return "none"
+	case counts.Installs > 0:
+		return "installed"
+	case counts.Clicks > 0:
+		return "clicked"
+	case counts.Impressions > 0:
+		return "seen"
+	}
+	return "none"
+}
+
+// 作为特征的类目状态：engaged（点击或安装过）、seen、none
+func (p *UserProfile) CategoryState(category string) string {
+	if p == nil || category == "" {
+		return "none"
+	}
+	counts, ok := p.Categories[category]
+	switch {
+	case !ok:
+		return "none"
+	case counts.Clicks > 0 || counts.Installs > 0:
+		return "engaged"
+	case counts.Impressions > 0:
+		return "seen"
+	}
+	return "none"
+}
+
+// 由日志中记录的状态还原出一份能得到相同特征的画像，离线打分和导出用
+func NewUserProfileFromStates(packageName string, packageState string, category string, categoryState string) *UserProfile {
+	p := NewUserProfile()
+	switch packageState {
+	case "installed":
+		p.Packages[packageName] = &ProfileCounts{Installs: 1}
+	case "clicked":
+		p.Packages[packageName] = &ProfileCounts{Clicks: 1}
+	case "seen":
+		p.Packages[packageName] = &ProfileCounts{Impressions: 1}
+	}
+	switch categoryState {
+	case "engaged":
+		p.Categories[category] = &ProfileCounts{Clicks: 1}
+	case "seen":
+		p.Categories[category] = &ProfileCounts{Impressions: 1}
+	}
+	return p
+}
+
+// 事件关联回来的请求里没有画像，用选择时记下的状态还原
+func (req *ParsedRequest) ProfileAt(index int, record *Inventory) *UserProfile {
+	if index < 0 || index >= len(req.Creatives) {
+		return nil
+	}
+	creative := req.Creatives[index]
+	return NewUserProfileFromStates(record.PackageName, creative.UserPackage, record.Category, creative.UserCategory)
+}
+
+func (p *UserProfile) Installed(packageName string) bool {
+	return p.PackageState(packageName) == "installed"
+}
+
+func (p *UserProfile) Engaged(category string) bool {
+	return p.CategoryState(category) == "engaged"
+}
+
+type ProfileStore struct {
+	redisPool *redis.Pool
+	configure *Configure
+	logger    *logging.Logger
+}
+
+func NewProfileStore(redisWrapper *RedisWrapper, configure *Configure, logger *logging.Logger) *ProfileStore {
+	return &ProfileStore{
+		redisPool: redisWrapper.redisPool,
+		configure: configure,
+		logger:    logger,
+	}
+}
+
+func (ps *ProfileStore) key(cid string) string {
+	return ps.configure.RedisProfilePrefix + cid
+}
+
+func (ps *ProfileStore) Get(cid string) (*UserProfile, error) {
+	profile := NewUserProfile()
+	if cid == "" {
+		return profile, nil
+	}
+	conn := ps.redisPool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("hgetall", ps.key(cid)))
+	if err != nil {
+		ps.logger.Warning("redis error: %v", err.Error())
+		return profile, err
+	}
+	for field, value := range values {
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		if field == "ts" {
+			profile.LastSeen = number
+			continue
+		}
+		// 包名和类目里可能有冒号，只按第一个和最后一个冒号切分
+		first, last := strings.Index(field, ":"), strings.LastIndex(field, ":")
+		if first < 0 || first == last {
+			continue
+		}
+		var group map[string]*ProfileCounts
+		switch field[:first] {
+		case "p":
+			group = profile.Packages
+		case "c":
+			group = profile.Categories
+		default:
+			continue
+		}
+		name := field[first+1 : last]
+		counts, ok := group[name]
+		if !ok {
+			counts = &ProfileCounts{}
+			group[name] = counts
+		}
+		switch field[last+1:] {
+		case "imp":
+			counts.Impressions = number
+		case "clk":
+			counts.Clicks = number
+		case "ins":
+			counts.Installs = number
+		case "ts":
+			counts.LastSeen = number
+		}
+	}
+	return profile, nil
+}
+
+// event为imp、clk或ins
+func (ps *ProfileStore) Record(cid string, record *Inventory, event string, now time.Time) error {
+	if cid == "" {
+		return nil
+	}
+	members := []string{"p:" + record.PackageName}
+	if record.Category != "" {
+		members = append(members, "c:"+record.Category)
+	}
+	key := ps.key(cid)
+	seenKey := key + ":seen"
+	ts := now.Unix()
+	conn := ps.redisPool.Get()
+	defer conn.Close()
+	for _, member := range members {
+		conn.Send("hincrby", key, member+":"+event, 1)
+		conn.Send("hset", key, member+":ts", ts)
+		conn.Send("zadd", seenKey, ts, member)
+	}
+	conn.Send("hset", key, "ts", ts)
+	conn.Send("expire", key, ps.configure.ProfileTtl)
+	conn.Send("expire", seenKey, ps.configure.ProfileTtl)
+	if err := conn.Flush(); err != nil {
+		ps.logger.Warning("redis error: %v", err.Error())
+		return err
+	}
+	for i := 0; i < len(members)*3+3; i++ {
+		if _, err := conn.Receive(); err != nil {
+			ps.logger.Warning("redis error: %v", err.Error())
+			return err
+		}
+	}
+	if ps.configure.ProfileMaxEntries <= 0 {
+		return nil
+	}
+	// 超出上限的部分，即最久没有出现的那些
+	evicted, err := redis.Strings(conn.Do("zrange", seenKey, 0, -ps.configure.ProfileMaxEntries-1))
+	if err != nil {
+		ps.logger.Warning("redis error: %v", err.Error())
+		return err
+	}
+	if len(evicted) == 0 {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(evicted)*4+1)
+	fields = append(fields, key)
+	removed := make([]interface{}, 0, len(evicted)+1)
+	removed = append(removed, seenKey)
+	for _, member := range evicted {
+		fields = append(fields, member+":imp", member+":clk", member+":ins", member+":ts")
+		removed = append(removed, member)
+	}
+	conn.Send("hdel", fields...)
+	conn.Send("zrem", removed...)
+	if err := conn.Flush(); err != nil {
+		ps.logger.Warning("redis error: %v", err.Error())
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Receive(); err != nil {
+			ps.logger.Warning("redis error: %v", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// 去掉用户已经安装过的应用，不修改传入的切片
+func (ps *ProfileStore) Filter(profile *UserProfile, candidates []*Inventory) []*Inventory {
+	if !ps.configure.ProfileFilterInstalled {
+		return candidates
+	}
+	filtered := make([]*Inventory, 0, len(candidates))
+	for _, record := range candidates {
+		if !profile.Installed(record.PackageName) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+// 排序时的加权，用户点击或安装过的类目乘以1+ProfileCategoryBoost
+func (ps *ProfileStore) Boost(profile *UserProfile) func(record *Inventory) float64 {
+	if ps.configure.ProfileCategoryBoost == 0 {
+		return nil
+	}
+	return func(record *Inventory) float64 {
+		if profile.Engaged(record.Category) {
+			return 1 + ps.configure.ProfileCategoryBoost
+		}
+		return 1
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestProfileStates(t *testing.T) {
+	profile := NewUserProfile()
+	profile.Packages["installed"] = &ProfileCounts{Impressions: 3, Clicks: 1, Installs: 1}
+	profile.Packages["clicked"] = &ProfileCounts{Impressions: 3, Clicks: 1}
+	profile.Packages["seen"] = &ProfileCounts{Impressions: 3}
+	profile.Packages["empty"] = &ProfileCounts{}
+	profile.Categories["engaged"] = &ProfileCounts{Installs: 1}
+	profile.Categories["seen"] = &ProfileCounts{Impressions: 1}
+	packages := []struct{ name, state string }{
+		{"installed", "installed"}, {"clicked", "clicked"}, {"seen", "seen"}, {"empty", "none"}, {"unknown", "none"},
+	}
+	for _, c := range packages {
+		if got := profile.PackageState(c.name); got != c.state {
+			t.Errorf("PackageState(%v) = %v, want %v", c.name, got, c.state)
+		}
+		// 由状态还原出的画像得到相同的状态
+		restored := NewUserProfileFromStates(c.name, c.state, "", "")
+		if got := restored.PackageState(c.name); got != c.state {
+			t.Errorf("restored PackageState(%v) = %v, want %v", c.name, got, c.state)
+		}
+	}
+	categories := []struct{ name, state string }{
+		{"engaged", "engaged"}, {"seen", "seen"}, {"unknown", "none"}, {"", "none"},
+	}
+	for _, c := range categories {
+		if got := profile.CategoryState(c.name); got != c.state {
+			t.Errorf("CategoryState(%q) = %v, want %v", c.name, got, c.state)
+		}
+		restored := NewUserProfileFromStates("a", "", c.name, c.state)
+		if got := restored.CategoryState(c.name); got != c.state {
+			t.Errorf("restored CategoryState(%q) = %v, want %v", c.name, got, c.state)
+		}
+	}
+	var missing *UserProfile
+	if missing.PackageState("a") != "none" || missing.CategoryState("game") != "none" || missing.Installed("a") {
+		t.Errorf("nil profile has states")
+	}
+}
+
+func TestProfileAt(t *testing.T) {
+	req := &ParsedRequest{Creatives: []*InventoryForRedis{{UserPackage: "clicked", UserCategory: "engaged"}}}
+	record := &Inventory{PackageName: "a", Category: "game"}
+	if profile := req.ProfileAt(0, record); !profile.Engaged("game") || profile.PackageState("a") != "clicked" {
+		t.Errorf("ProfileAt(0) = %+v", profile)
+	}
+	for _, index := range []int{-1, 1} {
+		if profile := req.ProfileAt(index, record); profile != nil {
+			t.Errorf("ProfileAt(%v) = %+v", index, profile)
+		}
+	}
+}
+
+func TestProfileFilterAndBoost(t *testing.T) {
+	profile := NewUserProfileFromStates("a", "installed", "game", "engaged")
+	candidates := []*Inventory{{PackageName: "a", Category: "game"}, {PackageName: "b", Category: "game"}, {PackageName: "c", Category: "tool"}}
+	cases := []struct {
+		name            string
+		filterInstalled bool
+		categoryBoost   float64
+		packages        []string
+		boosts          []float64
+	}{
+		{"off", false, 0, []string{"a", "b", "c"}, nil},
+		{"filter", true, 0, []string{"b", "c"}, nil},
+		{"boost", false, 0.5, []string{"a", "b", "c"}, []float64{1.5, 1.5, 1}},
+	}
+	for _, c := range cases {
+		configure := NewConfigure()
+		configure.ProfileFilterInstalled = c.filterInstalled
+		configure.ProfileCategoryBoost = c.categoryBoost
+		store := &ProfileStore{configure: configure, logger: testLogger}
+		filtered := store.Filter(profile, candidates)
+		if !equalStrings(inventoryPackages(filtered), c.packages) || len(candidates) != 3 {
+			t.Errorf("%v: filtered %v", c.name, inventoryPackages(filtered))
+		}
+		boost := store.Boost(profile)
+		if (boost == nil) != (c.boosts == nil) {
+			t.Errorf("%v: boost set = %v", c.name, boost != nil)
+			continue
+		}
+		for i, want := range c.boosts {
+			if got := boost(candidates[i]); got != want {
+				t.Errorf("%v: boost(%v) = %v, want %v", c.name, candidates[i].PackageName, got, want)
+			}
+		}
+	}
+}
@@ -6,16 +6,33 @@ import (
 	"github.com/op/go-logging"
 )
 
+type joinSample struct {
+	event   string
+	latency float64
+	ok      bool
+}
+
+// 每种事件的关联情况
+type joinStats struct {
+	joined  float64
+	failed  float64
+	latency float64
+}
+
 type Profiler struct {
 	request    float64
 	impression float64
 	click      float64
+	rejected   float64
 	latency    float64
+	joins      map[string]*joinStats
 
 	requestNotifier    chan int
 	impressionNotifier chan int
 	clickNotifier      chan int
+	rejectedNotifier   chan int
 	latencyNotifier    chan float64
+	joinNotifier       chan *joinSample
 
 	configure *Configure
 	logger    *logging.Logger
@@ -40,12 +57,29 @@ func (p *Profiler) OnClick() {
 	}
 }
 
+// 签名校验失败的跟踪请求
+func (p *Profiler) OnRejected() {
+	if p.configure.ProfilerEnable {
+		p.rejectedNotifier <- 1
+	}
+}
+
+// 事件和请求关联的耗时，ok为false表示最终没有关联上
+func (p *Profiler) OnJoin(event string, latency float64, ok bool) {
+	if p.configure.ProfilerEnable {
+		p.joinNotifier <- &joinSample{event: event, latency: latency, ok: ok}
+	}
+}
+
 func NewProfiler(configure *Configure, logger *logging.Logger) *Profiler {
 	return &Profiler{
 		requestNotifier:    make(chan int, 2048),
 		impressionNotifier: make(chan int, 2048),
 		clickNotifier:      make(chan int, 2048),
+		rejectedNotifier:   make(chan int, 2048),
 		latencyNotifier:    make(chan float64, 2048),
+		joinNotifier:       make(chan *joinSample, 2048),
+		joins:              make(map[string]*joinStats),
 		configure:          configure,
 		logger:             logger,
 	}
@@ -55,7 +89,9 @@ func (p *Profiler) Reset() {
 	p.request = 0.0
 	p.impression = 0.0
 	p.click = 0.0
+	p.rejected = 0.0
 	p.latency = 0.0
+	p.joins = make(map[string]*joinStats)
 }
 
 func (p *Profiler) Collect() {
@@ -78,11 +114,18 @@ func (p *Profiler) Collect() {
 	request/s:		%v
 	impression/s:		%v
 	click/s:		%v
+	rejected/s:		%v
 	latency/s:		%v`,
 				p.request/timeElaped.Seconds(),
 				p.impression/timeElaped.Seconds(),
 				p.click/timeElaped.Seconds(),
+				p.rejected/timeElaped.Seconds(),
 				p.latency/p.request)
+			for event, stats := range p.joins {
+				p.logger.Info("Profiling join %v: joined/s: %v, failed/s: %v, latency: %v",
+					event, stats.joined/timeElaped.Seconds(), stats.failed/timeElaped.Seconds(),
+					stats.latency/stats.joined)
+			}
 			p.Reset()
 			t.Reset(time.Duration(p.configure.ProfilerInterval) * time.Second)
 		case <-p.requestNotifier:
@@ -91,8 +134,22 @@ func (p *Profiler) Collect() {
 			p.impression += 1
 		case <-p.clickNotifier:
 			p.click += 1
+		case <-p.rejectedNotifier:
+			p.rejected += 1
 		case l := <-p.latencyNotifier:
 			p.latency += l
+		case sample := <-p.joinNotifier:
+			stats, ok := p.joins[sample.event]
+			if !ok {
+				stats = &joinStats{}
+				p.joins[sample.event] = stats
+			}
+			if sample.ok {
+				stats.joined += 1
+				stats.latency += sample.latency
+			} else {
+				stats.failed += 1
+			}
 		}
 	}
 }
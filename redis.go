@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"strconv"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -40,43 +40,60 @@ func NewRedisWrapper(configure *Configure, logger *logging.Logger) *RedisWrapper
 	}
 }
 
-func (rw *RedisWrapper) GetFrequency(req *ParsedRequest, creatives *InventoryCollection) (response []int, err error) {
+// 取不到的计数为0，返回值与keys一一对应
+func (rw *RedisWrapper) GetCounters(keys []string) (response []int, err error) {
+	if len(keys) == 0 {
+		return []int{}, nil
+	}
 	conn := rw.redisPool.Get()
 	defer conn.Close()
-	frIds := make([]interface{}, creatives.Len())
-	for index, value := range creatives.Data {
-		frIds[index] = fmt.Sprintf("%v%v_%v",
-			rw.configure.RedisFrequencyPrefix, req.Cid, value.ModelSign1)
+	args := make([]interface{}, len(keys))
+	for index, key := range keys {
+		args[index] = key
 	}
-	if response, err = redis.Ints(conn.Do("mget", frIds...)); err != nil {
+	if response, err = redis.Ints(conn.Do("mget", args...)); err != nil {
 		rw.logger.Warning("redis error: %v", err.Error())
 	}
 	return
 }
 
-func (rw *RedisWrapper) IncrFrequency(req *ParsedRequest, modelSign1 int) (err error) {
+// 计数加一并刷新过期时间，expires单位为秒
+func (rw *RedisWrapper) IncrCounters(keys []string, expires []int) error {
 	conn := rw.redisPool.Get()
 	defer conn.Close()
-
-	frId := fmt.Sprintf("%v%v_%v",
-		rw.configure.RedisFrequencyPrefix, req.Cid, modelSign1)
-	if _, err = conn.Do("incr", frId); err != nil {
+	for index, key := range keys {
+		conn.Send("incr", key)
+		conn.Send("expire", key, expires[index])
+	}
+	if _, err := conn.Do(""); err != nil {
 		rw.logger.Warning("redis error: %v", err.Error())
+		return err
 	}
-	return
+	return nil
 }
 
-func (rw *RedisWrapper) SaveRequest(req *ParsedRequest, creatives []*Inventory, timeout int) error {
-	conn := rw.redisPool.Get()
-	defer conn.Close()
+// 请求中需要保存下来用于事件关联的物料信息
+func CreativesForRedis(req *ParsedRequest, creatives []*Inventory) []*InventoryForRedis {
 	creativesForRedis := make([]*InventoryForRedis, len(creatives))
 	for index, value := range creatives {
 		creativesForRedis[index] = &InventoryForRedis{
-			AdId:      value.AdId,
-			Frequency: value.Frequency,
+			AdId:       value.AdId,
+			Frequency:  value.Frequency,
+			Position:   index,
+			Propensity: value.Propensity,
+		}
+		if req.Profile != nil {
+			creativesForRedis[index].UserPackage = req.Profile.PackageState(value.PackageName)
+			creativesForRedis[index].UserCategory = req.Profile.CategoryState(value.Category)
 		}
 	}
-	req.Creatives = creativesForRedis
+	return creativesForRedis
+}
+
+// 保存请求，win/loss通知另外按imp保存，见SaveNotice
+func (rw *RedisWrapper) UpdateRequest(req *ParsedRequest, timeout int) error {
+	conn := rw.redisPool.Get()
+	defer conn.Close()
 	body, err := json.Marshal(*req)
 	if err != nil {
 		return err
@@ -122,6 +139,59 @@ func (rw *RedisWrapper) GetRequest(id string) (*ParsedRequest, error) {
 	}
 }
 
+// 竞价结果通知，按物料位置单独保存，不改写压缩的请求
+type AuctionNotice struct {
+	ClearingPrice float64 `json:"clearing_price,omitempty"`
+	LossReason    string  `json:"loss_reason,omitempty"`
+}
+
+func (rw *RedisWrapper) noticeKey(requestId string) string {
+	return rw.configure.RedisCachePrefix + requestId + ":notice"
+}
+
+// 每个imp一个字段，同一请求不同imp的win、loss并发写入互不覆盖，
+// 也不会被晚到的请求保存覆盖
+func (rw *RedisWrapper) SaveNotice(requestId string, index int, notice *AuctionNotice, timeout int) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	conn := rw.redisPool.Get()
+	defer conn.Close()
+	key := rw.noticeKey(requestId)
+	conn.Send("hset", key, index, body)
+	conn.Send("expire", key, timeout)
+	if _, err := conn.Do(""); err != nil {
+		rw.logger.Warning("redis error: %v", err.Error())
+		return err
+	}
+	return nil
+}
+
+// 按物料位置返回请求收到的通知，没有通知时为空
+func (rw *RedisWrapper) GetNotices(requestId string) (map[int]*AuctionNotice, error) {
+	conn := rw.redisPool.Get()
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("hgetall", rw.noticeKey(requestId)))
+	if err != nil {
+		rw.logger.Warning("redis error: %v", err.Error())
+		return nil, err
+	}
+	notices := make(map[int]*AuctionNotice, len(values))
+	for field, value := range values {
+		index, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		notice := &AuctionNotice{}
+		if err := json.Unmarshal([]byte(value), notice); err != nil {
+			continue
+		}
+		notices[index] = notice
+	}
+	return notices, nil
+}
+
 func (rw *RedisWrapper) SetExpire(requestId string, expiredTime int) (err error) {
 	conn := rw.redisPool.Get()
 	defer conn.Close()
@@ -130,3 +200,74 @@ func (rw *RedisWrapper) SetExpire(requestId string, expiredTime int) (err error)
 	}
 	return
 }
+
+// 把增量按天写入redis。写失败时不知道哪些已经生效，调用方整体重试
+func (rw *RedisWrapper) WriteRates(deltas map[string]*RateCounts, now time.Time, windowDays int) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	conn := rw.redisPool.Get()
+	defer conn.Close()
+	if windowDays < 1 {
+		windowDays = 1
+	}
+	expire := (windowDays + 1) * 86400
+	today := rw.configure.RedisRatePrefix + now.UTC().Format("20060102") + ":"
+	for key, delta := range deltas {
+		conn.Send("hincrby", today+key, "imp", delta.Impressions)
+		conn.Send("hincrby", today+key, "clk", delta.Clicks)
+		conn.Send("hincrby", today+key, "cnv", delta.Conversions)
+		conn.Send("expire", today+key, expire)
+	}
+	if err := conn.Flush(); err != nil {
+		rw.logger.Warning("redis error: %v", err.Error())
+		return err
+	}
+	for i := 0; i < len(deltas)*4; i++ {
+		if _, err := conn.Receive(); err != nil {
+			rw.logger.Warning("redis error: %v", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// 读回窗口内的合计
+func (rw *RedisWrapper) ReadRates(keys []string, now time.Time, windowDays int) (map[string]*RateCounts, error) {
+	conn := rw.redisPool.Get()
+	defer conn.Close()
+	if windowDays < 1 {
+		windowDays = 1
+	}
+	for _, key := range keys {
+		for day := 0; day < windowDays; day++ {
+			prefix := rw.configure.RedisRatePrefix + now.UTC().AddDate(0, 0, -day).Format("20060102") + ":"
+			conn.Send("hmget", prefix+key, "imp", "clk", "cnv")
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		rw.logger.Warning("redis error: %v", err.Error())
+		return nil, err
+	}
+	totals := make(map[string]*RateCounts, len(keys))
+	for _, key := range keys {
+		total := &RateCounts{}
+		for day := 0; day < windowDays; day++ {
+			values, err := redis.Values(conn.Receive())
+			if err != nil {
+				rw.logger.Warning("redis error: %v", err.Error())
+				return nil, err
+			}
+			var imp, clk, cnv int64
+			if _, err := redis.Scan(values, &imp, &clk, &cnv); err != nil {
+				return nil, err
+			}
+			total.Add(&RateCounts{Impressions: imp, Clicks: clk, Conversions: cnv})
+		}
+		// 滑出窗口的不再保留
+		if total.Impressions != 0 || total.Clicks != 0 || total.Conversions != 0 {
+			totals[key] = total
+		}
+	}
+	return totals, nil
+}
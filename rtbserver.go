@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
@@ -28,8 +29,17 @@ type RtbLite struct {
 	configure    *Configure
 	profiler     *Profiler
 	saveFile     *rotatelogger.Rotator
-
-	r *rand.Rand
+	rates        *RateStats
+	experiments  *Experiments
+	scorer       *ModelScorer
+	learner      *FtrlLearner
+	profiles     *ProfileStore
+	capper       *FrequencyCapper
+	tokens       *TrackingTokenCodec
+	signer       *UrlSigner
+	joiner       *EventJoiner
+	workers      *WorkerPools
+	rejectLogger *logging.Logger
 }
 
 func NewRtbLite(configure *Configure) (*RtbLite, error) {
@@ -47,35 +57,157 @@ func NewRtbLite(configure *Configure) (*RtbLite, error) {
 		saveFile = &rotatelogger.Rotator{}
 		saveFile.Create(path.Join(configure.ModelDataSaveDir, "model.save"), rotatelogger.DailyRotation)
 	}
-	cache, err := NewInventoryCache(configure, logger)
+	redisWrapper := NewRedisWrapper(configure, logger)
+	var rates *RateStats = nil
+	var estimator RateEstimator = nil
+	if configure.RateEnable {
+		rates = NewRateStats(configure, redisWrapper, logger)
+		estimator = rates
+	}
+	cache, err := NewInventoryCache(configure, logger, estimator)
+	if err != nil {
+		return nil, err
+	}
+	if rates != nil {
+		rates.SetKeySource(cache.RateKeys)
+	}
+	bandit, err := NewBanditPolicy(configure)
+	if err != nil {
+		return nil, err
+	}
+	if bandit != nil && rates == nil {
+		return nil, fmt.Errorf("bandit policy requires RateEnable")
+	}
+	experiments, err := NewExperiments(configure, bandit, rates != nil)
+	if err != nil {
+		return nil, err
+	}
+	extractor, err := NewFeatureExtractorFromConfigure(configure)
 	if err != nil {
 		return nil, err
 	}
-	return &RtbLite{
+	var learner *FtrlLearner = nil
+	if configure.FtrlEnable {
+		learner = NewFtrlLearner(configure, extractor, logger)
+	}
+	capper, err := NewFrequencyCapper(configure, redisWrapper, logger)
+	if err != nil {
+		return nil, err
+	}
+	var tokens *TrackingTokenCodec = nil
+	if configure.TrackingTokenEnable {
+		if tokens, err = NewTrackingTokenCodec(configure.TrackingTokenKey); err != nil {
+			return nil, err
+		}
+	}
+	signer, err := NewUrlSigner(configure.TrackingSignKeys, configure.TrackingSignTtl)
+	if err != nil {
+		return nil, err
+	}
+	var profiles *ProfileStore = nil
+	if configure.ProfileEnable {
+		profiles = NewProfileStore(redisWrapper, configure, logger)
+	}
+	profiler := NewProfiler(configure, logger)
+	rl := &RtbLite{
 		geoDb:        geoDb,
 		cache:        cache,
 		logger:       logger,
-		redisWrapper: NewRedisWrapper(configure, logger),
+		redisWrapper: redisWrapper,
 		producer:     producer,
 		configure:    configure,
-		profiler:     NewProfiler(configure, logger),
+		profiler:     profiler,
 		saveFile:     saveFile,
-		r:            rand.New(rand.NewSource(time.Now().Unix())),
-	}, nil
+		rates:        rates,
+		experiments:  experiments,
+		scorer:       NewModelScorer(configure, extractor, logger),
+		learner:      learner,
+		profiles:     profiles,
+		capper:       capper,
+		tokens:       tokens,
+		signer:       signer,
+		joiner:       NewEventJoiner(configure, redisWrapper, profiler, logger),
+		rejectLogger: rotatelogger.NewLogger("rejected", configure.LogDir, configure.LogLevel),
+	}
+	if rl.workers, err = NewWorkerPools(configure, rl.asyncHandlers(), logger); err != nil {
+		return nil, err
+	}
+	return rl, nil
 }
 
 func (rl *RtbLite) RunProfiler() {
 	go rl.profiler.Collect()
 }
 
+func (rl *RtbLite) RunModelWatcher() {
+	if rl.configure.ModelPath == "" {
+		return
+	}
+	if err := rl.scorer.Reload(); err != nil {
+		rl.logger.Warning("fail to load model: %v", err.Error())
+	}
+	go rl.scorer.WatchLoop()
+}
+
+func (rl *RtbLite) RunLearner() {
+	if rl.learner == nil {
+		return
+	}
+	if err := rl.learner.Restore(); err != nil && !os.IsNotExist(err) {
+		rl.logger.Warning("fail to restore ftrl state: %v", err.Error())
+	}
+	go rl.learner.Run()
+}
+
+func (rl *RtbLite) RunWorkers() {
+	rl.workers.Run()
+}
+
+// 上次退出时没有关联上的事件重新提交，要在RunWorkers之后调用。
+// 在后台提交，不阻塞启动，队列满时等待而不是按溢出策略丢弃
+func (rl *RtbLite) RunJoinRetry() {
+	go func() {
+		tasks, err := rl.joiner.LoadRetries()
+		if err != nil {
+			rl.logger.Warning("fail to load join retries: %v", err.Error())
+		}
+		for _, task := range tasks {
+			rl.workers.SubmitWait(task)
+		}
+		if len(tasks) > 0 {
+			rl.logger.Notice("%v join retries resubmitted", len(tasks))
+		}
+		rl.joiner.RetryLoop()
+	}()
+}
+
+// 要在首次加载物料之后调用，按在线物料读回统计之后重新按eCPM排序
+func (rl *RtbLite) RunRateSync() {
+	if rl.rates != nil {
+		if err := rl.rates.Sync(); err != nil {
+			rl.logger.Warning("fail to sync rate stats: %v", err.Error())
+		} else {
+			rl.cache.Resort()
+		}
+		go rl.rates.SyncLoop(rl.cache.Resort)
+	}
+}
+
 func (rl *RtbLite) CacheUpdateLoop() error {
 	if err := rl.cache.Load(); err != nil {
-		return err
+		// 数据库起不来时用上次落盘的快照先顶上
+		if rl.configure.InventorySnapshotPath == "" {
+			return err
+		}
+		if snapshotErr := rl.cache.LoadFromSnapshotFile(); snapshotErr != nil {
+			rl.logger.Error("fail to warm start: %v", snapshotErr.Error())
+			return err
+		}
 	}
 	timer := time.NewTimer(time.Duration(rl.configure.MysqlUpdateInterval) * time.Second)
 	go func() {
 		for range timer.C {
-			rl.cache.Load()
+			rl.cache.Refresh()
 			timer.Reset(time.Duration(rl.configure.MysqlUpdateInterval) * time.Second)
 		}
 	}()
@@ -101,6 +233,14 @@ type ParsedRequest struct {
 	Id            string               `json:"request_id"`
 	IpLib         *IpLib               `json:"ip_lib"`
 	OsVersionNum  int
+	// 选择物料时使用的快照版本
+	InventoryVersion int64 `json:"inventory_version"`
+	// 命中的实验，层名:组名，逗号分隔
+	Experiments string `json:"experiments"`
+	// 用户画像，只在选择物料时读取，不随请求保存
+	Profile *UserProfile `json:"-"`
+	// 未超频的候选包名，OpeLogCandidates时保存，离线评估用
+	Candidates []string `json:"candidates,omitempty"`
 }
 
 func (rl *RtbLite) Parse(req *http.Request) *ParsedRequest {
@@ -130,6 +270,12 @@ func (rl *RtbLite) Parse(req *http.Request) *ParsedRequest {
 		r.Network = 0
 	}
 
+	rl.Locate(r)
+	return r
+}
+
+// 用ip填充地域信息
+func (rl *RtbLite) Locate(r *ParsedRequest) {
 	location := rl.geoDb.GetLocationByIP(r.Ip)
 	if location == nil {
 		location = &libgeo.Location{}
@@ -140,68 +286,246 @@ func (rl *RtbLite) Parse(req *http.Request) *ParsedRequest {
 		IpHashLevel3: HiveHash(location.CountryCode + "|" + location.Region + "|" + location.City),
 		CountryCode:  location.CountryCode,
 	}
+}
 
-	return r
+// 快照中的记录是共享的，返回给单个请求的物料一律复制一份再填频次
+func copyWithFrequency(record *Inventory, frequency int) *Inventory {
+	copied := *record
+	copied.Frequency = frequency
+	return &copied
 }
 
-func (rl *RtbLite) SelectByPackage(req *ParsedRequest, creatives *InventoryCollection, count int) []*Inventory {
-	req.Adgroup = "4"
+// creatives为已按排序和定向过滤的候选，frequencies与之一一对应
+func (rl *RtbLite) SelectByPackage(req *ParsedRequest, creatives []*Inventory, frequencies *Frequencies, count int) []*Inventory {
 	selectedCreatives := make([]*Inventory, 0)
-	lastPackageName := ""
-	for _, record := range creatives.Data {
-		if req.OsVersionNum < record.MinOsNum || req.OsVersionNum > record.MaxOsNum {
+	// 模型重排之后同一个包名的物料不一定相邻
+	selectedPackages := make(map[string]bool)
+	for index, record := range creatives {
+		if frequencies.Capped[index] {
 			continue
 		}
-		if record.Frequency > rl.configure.RedisFrequencyPerId {
+		if !selectedPackages[record.PackageName] {
+			selectedCreatives = append(selectedCreatives, copyWithFrequency(record, frequencies.Counts[index]))
+			if len(selectedCreatives) >= count {
+				break
+			}
+			selectedPackages[record.PackageName] = true
+		}
+	}
+	return selectedCreatives
+}
+
+// 按随机排列的先后顺序返回，每个包名只取一个物料
+func (rl *RtbLite) SelectByRandom(req *ParsedRequest, creatives []*Inventory, frequencies *Frequencies, count int) []*Inventory {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomSelect := r.Perm(len(creatives))
+	uniqueCreatives := make(map[string]bool)
+	selectedCreatives := make([]*Inventory, 0)
+	for _, index := range randomSelect {
+		record := creatives[index]
+		if frequencies.Capped[index] {
 			continue
 		}
-		if lastPackageName != record.PackageName {
-			selectedCreatives = append(selectedCreatives, record)
+		if !uniqueCreatives[record.PackageName] {
+			uniqueCreatives[record.PackageName] = true
+			selectedCreatives = append(selectedCreatives, copyWithFrequency(record, frequencies.Counts[index]))
 			if len(selectedCreatives) >= count {
 				break
 			}
-			lastPackageName = record.PackageName
 		}
 	}
 	return selectedCreatives
 }
 
-func (rl *RtbLite) SelectByRandom(req *ParsedRequest, creatives *InventoryCollection, count int) []*Inventory {
-	req.Adgroup = "1"
-	r := rand.New(rand.NewSource(time.Now().Unix()))
-	randomSelect := r.Perm(creatives.Len())
-	uniqueCreatives := make(map[string]*Inventory)
-	for _, index := range randomSelect {
-		record := creatives.Data[index]
-		if req.OsVersionNum < record.MinOsNum || req.OsVersionNum > record.MaxOsNum {
+// 给返回的每个物料填上选中概率：在前面位置已经选定的条件下，该位置选中这个包名的概率，
+// 与bandit的口径一致，离线评估按前缀连乘。bandit在选择时已经填好。
+//
+// random在全部未超频物料的随机排列里按包名取第一次出现的，等价于按包内物料数加权的不放回抽样，
+// 所以包名p在第k位的条件概率是n_p / 前面没选过的包名的物料总数。
+// package是确定的。mixed按用户分桶，对一个用户来说实际运行的只有其中一种策略，按那一种计算
+func (rl *RtbLite) SetPropensities(req *ParsedRequest, strategy string,
+	creatives []*Inventory, frequencies *Frequencies, selected []*Inventory) {
+	if strategy == StrategyBandit {
+		return
+	}
+	if strategy != StrategyRandom {
+		for _, record := range selected {
+			record.Propensity = 1
+		}
+		return
+	}
+	packageSize := make(map[string]int)
+	remaining := 0
+	for index, record := range creatives {
+		if !frequencies.Capped[index] {
+			packageSize[record.PackageName] += 1
+			remaining += 1
+		}
+	}
+	for _, record := range selected {
+		n := packageSize[record.PackageName]
+		if remaining > 0 {
+			record.Propensity = float64(n) / float64(remaining)
+		}
+		remaining -= n
+	}
+}
+
+// ope评估候选策略时需要的候选包名，按排序后的先后，去掉超频的
+func candidatePackages(creatives []*Inventory, frequencies *Frequencies) []string {
+	seen := make(map[string]bool)
+	packages := make([]string, 0)
+	for index, record := range creatives {
+		if frequencies.Capped[index] || seen[record.PackageName] {
 			continue
 		}
-		if record.Frequency > rl.configure.RedisFrequencyPerId {
+		seen[record.PackageName] = true
+		packages = append(packages, record.PackageName)
+	}
+	return packages
+}
+
+// 每个包名一个臂，取排序最靠前且未超频的物料，回报来自实时统计
+func (rl *RtbLite) SelectByBandit(req *ParsedRequest, policy BanditPolicy, creatives []*Inventory, frequencies *Frequencies, count int) []*Inventory {
+	arms := make([]*BanditArm, 0)
+	seen := make(map[string]bool)
+	for index, record := range creatives {
+		if frequencies.Capped[index] || seen[record.PackageName] {
 			continue
 		}
-		if _, ok := uniqueCreatives[record.PackageName]; !ok {
-			uniqueCreatives[record.PackageName] = record
-			if len(uniqueCreatives) >= count {
-				break
-			}
+		seen[record.PackageName] = true
+		counts := rl.rates.Counts(RateKey(record.PackageName, req.IpLib.CountryCode, req.PlacementId))
+		arm := &BanditArm{
+			Record:    record,
+			Frequency: frequencies.Counts[index],
+			Trials:    float64(counts.Impressions),
+			Rewards:   float64(counts.Clicks),
 		}
+		if rl.configure.BanditReward == "conversion" {
+			arm.Rewards = float64(counts.Conversions)
+		}
+		if arm.Rewards > arm.Trials {
+			arm.Trials = arm.Rewards
+		}
+		arms = append(arms, arm)
 	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	selectedCreatives := make([]*Inventory, 0)
-	for _, record := range uniqueCreatives {
-		selectedCreatives = append(selectedCreatives, record)
+	for _, choice := range policy.Choose(arms, count, r) {
+		selected := copyWithFrequency(choice.Arm.Record, choice.Arm.Frequency)
+		selected.Propensity = choice.Propensity
+		selectedCreatives = append(selectedCreatives, selected)
 	}
 	return selectedCreatives
 }
 
-func (rl *RtbLite) Augment(req *ParsedRequest, creatives *InventoryCollection) {
-	if frequencies, err := rl.redisWrapper.GetFrequency(req, creatives); err != nil {
+// 只查候选物料的频次，返回值与creatives一一对应，不修改快照中的记录
+func (rl *RtbLite) Augment(req *ParsedRequest, creatives []*Inventory) *Frequencies {
+	frequencies, err := rl.capper.Check(req, creatives, time.Now())
+	if err != nil {
 		rl.logger.Warning("redis error: %v", err.Error())
-		return
-	} else {
-		for index, value := range creatives.Data {
-			value.Frequency = frequencies[index]
+		return NewFrequencies(len(creatives))
+	}
+	return frequencies
+}
+
+// 取候选、查频次、选物料，各个协议的入口共用，国家没有物料时返回false
+func (rl *RtbLite) Select(parsed *ParsedRequest) ([]*Inventory, bool) {
+	snapshot := rl.cache.Snapshot()
+	parsed.InventoryVersion = snapshot.Version
+	filteredByCountry, ok := snapshot.Country(parsed.IpLib.CountryCode)
+	if !ok {
+		return nil, false
+	}
+	candidates := filteredByCountry.Candidates(parsed)
+	var boost func(record *Inventory) float64 = nil
+	if rl.profiles != nil {
+		if profile, err := rl.profiles.Get(parsed.Cid); err == nil {
+			parsed.Profile = profile
+			candidates = rl.profiles.Filter(profile, candidates)
+			boost = rl.profiles.Boost(profile)
 		}
 	}
+	// 有模型时按模型打分重排，否则保持排序表的顺序
+	rl.scorer.Rank(parsed, candidates, rl.cache.Estimator(), boost)
+	frequencies := rl.Augment(parsed, candidates)
+	if rl.configure.OpeLogCandidates {
+		parsed.Candidates = candidatePackages(candidates, frequencies)
+	}
+
+	assignment := rl.experiments.Assign(parsed)
+	parsed.Experiments = assignment.String()
+	strategy := assignment.Strategy
+	if strategy == StrategyMixed {
+		// 按用户分桶，同一个用户不会在两种策略之间来回切换
+		if StickyBucket("traffic_random", parsed.Cid) < assignment.TrafficRandom {
+			strategy = StrategyRandom
+		} else {
+			strategy = StrategyPackage
+		}
+	}
+	parsed.Adgroup = strategyAdgroups[strategy]
+	if assignment.Adgroup != "" {
+		parsed.Adgroup = assignment.Adgroup
+	}
+
+	var creativesToReturn []*Inventory
+	switch strategy {
+	case StrategyBandit:
+		creativesToReturn = rl.SelectByBandit(parsed, assignment.Bandit, candidates, frequencies, parsed.Limit)
+	case StrategyRandom:
+		creativesToReturn = rl.SelectByRandom(parsed, candidates, frequencies, parsed.Limit)
+	default:
+		creativesToReturn = rl.SelectByPackage(parsed, candidates, frequencies, parsed.Limit)
+	}
+	rl.SetPropensities(parsed, strategy, candidates, frequencies, creativesToReturn)
+	return creativesToReturn, true
+}
+
+func (rl *RtbLite) Trackers(parsed *ParsedRequest, index int, record *Inventory) (clickTracker string, impressionTracker string) {
+	creativeId := rl.TrackingParam(parsed, index, record)
+	click := url.Values{}
+	click.Set("final_url", record.ClickUrl+"&"+GetParam(index, parsed, record))
+	click.Set("param", creativeId)
+	impression := url.Values{}
+	impression.Set("param", creativeId)
+	if rl.signer != nil {
+		now := time.Now()
+		rl.signer.Sign(click, "click", now)
+		rl.signer.Sign(impression, "impression", now)
+	}
+	clickTracker = "http://" + rl.configure.ClickAddress + "/click?" + click.Encode()
+	impressionTracker = "http://" + rl.configure.CallbackAddress + "/impression?" + impression.Encode()
+	return
+}
+
+// 写响应之前记下选中的物料，事件可能在请求写入redis之前就到了
+func (rl *RtbLite) RememberSelected(parsed *ParsedRequest, creatives []*Inventory) {
+	parsed.Creatives = CreativesForRedis(parsed, creatives)
+	rl.joiner.Remember(parsed)
+}
+
+// 响应发出之后保存请求，并打日志
+func (rl *RtbLite) OnSelected(parsed *ParsedRequest) {
+	// 提前把结果发出去，后续操作可以慢慢做
+	rl.workers.Submit(&AsyncTask{Event: "request", Request: parsed, Time: time.Now()})
+}
+
+func (rl *RtbLite) processRequest(task *AsyncTask) {
+	rl.redisWrapper.UpdateRequest(task.Request, rl.configure.RedisRequestTimeout)
+	rl.producer.Log(rl.configure.KafkaRequestTopic, GetReqeustKafkaMessage(task.Request))
+}
+
+// 响应之后的异步处理，每种事件一个worker池
+func (rl *RtbLite) asyncHandlers() map[string]func(task *AsyncTask) {
+	return map[string]func(task *AsyncTask){
+		"request":    rl.processRequest,
+		"impression": rl.processImpression,
+		"click":      rl.processClick,
+		"conversion": rl.processConversion,
+		"win":        rl.processWin,
+		"loss":       rl.processLoss,
+	}
 }
 
 func (rl *RtbLite) Request(rw http.ResponseWriter, req *http.Request) {
@@ -209,47 +533,35 @@ func (rl *RtbLite) Request(rw http.ResponseWriter, req *http.Request) {
 	defer rl.profiler.OnRequest(time.Now().Sub(start).Seconds())
 
 	parsed := rl.Parse(req)
-	filteredByCountry, ok := rl.cache.cacheByCountry[parsed.IpLib.CountryCode]
+	creativesToReturn, ok := rl.Select(parsed)
 	if !ok {
 		io.WriteString(rw, "")
 		return
 	}
-	rl.Augment(parsed, filteredByCountry)
-
-	chooseCreative := rl.r.Intn(100)
-	var creativesToReturn []*Inventory
-	if chooseCreative < rl.configure.TrafficRandom {
-		creativesToReturn = rl.SelectByRandom(parsed, filteredByCountry, parsed.Limit)
-	} else {
-		creativesToReturn = rl.SelectByPackage(parsed, filteredByCountry, parsed.Limit)
-	}
 	ret := make([]string, 0)
 	for index, record := range creativesToReturn {
-		creativeId := fmt.Sprintf("%v-%v", parsed.Id, index)
-		clickTracker := "http://" + rl.configure.ClickAddress + "/click?final_url=" +
-			url.QueryEscape(record.ClickUrl+"&"+GetParam(index, parsed, record)) + "&param=" + creativeId
-		impressionTracker := "http://" + rl.configure.CallbackAddress + "/impression?param=" + creativeId
+		clickTracker, impressionTracker := rl.Trackers(parsed, index, record)
 		iconUrl := record.IconUrl
 		bannerUrl := record.BannerUrl
 		ret = append(ret, fmt.Sprintf(`{ "bundle_id": "%v",  "click_url": "%v", "creative_url": "%v", "icon_url": "%v", "impression_url": "%v", "title": "%v" }`,
 			record.PackageName, clickTracker, bannerUrl, iconUrl, impressionTracker, record.Label))
 	}
-	response := `{"ad": [` + strings.Join(ret, ",") + `], "error_code": 0, "error_message": "success"}`
+	response := fmt.Sprintf(`{"ad": [%v], "inventory_version": %v, "error_code": 0, "error_message": "success"}`,
+		strings.Join(ret, ","), parsed.InventoryVersion)
+	rl.RememberSelected(parsed, creativesToReturn)
 	io.WriteString(rw, response)
 
-	// 提前把结果发出去，后续操作可以慢慢做
-	go func() {
-		rl.redisWrapper.SaveRequest(parsed, creativesToReturn, rl.configure.RedisRequestTimeout)
-		rl.producer.Log(rl.configure.KafkaRequestTopic, GetReqeustKafkaMessage(parsed))
-	}()
+	rl.OnSelected(parsed)
 }
 
 func (rl *RtbLite) Impression(rw http.ResponseWriter, req *http.Request) {
+	if !rl.VerifyTracker(rw, req, "impression") {
+		return
+	}
 	defer rl.profiler.OnImpression()
 
 	param := req.URL.Query().Get("param")
-	id, index, err := SplitId(param)
-	if err != nil {
+	if _, err := rl.DecodeParam(param); err != nil {
 		rl.logger.Error("fail to get id from param: %v", err.Error())
 		return
 	}
@@ -262,41 +574,60 @@ func (rl *RtbLite) Impression(rw http.ResponseWriter, req *http.Request) {
 		io.WriteString(rw, response)
 	}
 
-	// 提前把结果发出去，后续操作可以慢慢做
-	go func() {
-		time.Sleep(1 * time.Second) // 为了防止redis时序颠倒取不到id
-		parsed, err := rl.redisWrapper.GetRequest(id)
-		if err != nil {
-			rl.logger.Error("join failed [err: %s][param: %s]", err.Error(), param)
-		} else {
-			record := &Inventory{}
-			if err := rl.cache.FetchOne(parsed.Creatives[index].AdId, record); err != nil {
-				rl.logger.Error("fetch from db failed [err: %s][param: %s]", err.Error(), param)
-				return
-			}
-			rl.redisWrapper.IncrFrequency(parsed, record.ModelSign1)
-			rl.redisWrapper.SetExpire(param, rl.configure.RedisImpressionTimeout)
-			rl.producer.Log(rl.configure.KafkaImressionTopic, GetEventKafkaMessage(parsed, "impression", record))
+	// 提前把结果发出去，后续操作交给后台的worker
+	rl.workers.Submit(&AsyncTask{Event: "impression", Param: param, Time: time.Now()})
+}
 
-			// model
-			if rl.saveFile != nil {
-				if data, err := GetModelDataLog(parsed, record, "impression"); err != nil {
+// 关联请求之后计频次，记录统计、画像和日志
+func (rl *RtbLite) processImpression(task *AsyncTask) {
+	param := task.Param
+	token, err := rl.DecodeParam(param)
+	if err != nil {
+		rl.logger.Error("fail to get id from param: %v", err.Error())
+		return
+	}
+	index := token.Index
+	rl.joiner.Join(task, token, func(parsed *ParsedRequest) {
+		record := &Inventory{}
+		if err := rl.cache.FetchOne(parsed.Creatives[index].AdId, record); err != nil {
+			rl.logger.Error("fetch from db failed [err: %s][param: %s]", err.Error(), param)
+			return
+		}
+		rl.capper.Incr(parsed, record, time.Now())
+		if !token.stateless {
+			rl.redisWrapper.SetExpire(param, rl.configure.RedisImpressionTimeout)
+		}
+		if rl.rates != nil {
+			rl.rates.OnImpression(parsed, record)
+		}
+		if rl.profiles != nil {
+			rl.profiles.Record(parsed.Cid, record, "imp", time.Now())
+		}
+		if rl.learner != nil {
+			rl.learner.OnImpression(parsed, index, record)
+		}
+		rl.producer.Log(rl.configure.KafkaImressionTopic, GetEventKafkaMessage(parsed, "impression", record))
+
+		// model
+		if rl.saveFile != nil {
+			if data, err := GetModelDataLog(parsed, index, record, "impression"); err != nil {
+				rl.logger.Warning(err.Error())
+			} else {
+				if _, err := rl.saveFile.WriteString(fmt.Sprintln(string(data))); err != nil {
 					rl.logger.Warning(err.Error())
-				} else {
-					if _, err := rl.saveFile.WriteString(fmt.Sprintln(string(data))); err != nil {
-						rl.logger.Warning(err.Error())
-					}
 				}
 			}
 		}
-	}()
+	})
 }
 
 func (rl *RtbLite) Click(rw http.ResponseWriter, req *http.Request) {
+	if !rl.VerifyTracker(rw, req, "click") {
+		return
+	}
 	defer rl.profiler.OnClick()
 	param := req.URL.Query().Get("param")
-	id, index, err := SplitId(param)
-	if err != nil {
+	if _, err := rl.DecodeParam(param); err != nil {
 		rl.logger.Error("fail to get id from param: %v", err.Error())
 		return
 	}
@@ -309,39 +640,55 @@ func (rl *RtbLite) Click(rw http.ResponseWriter, req *http.Request) {
 		io.WriteString(rw, response)
 	}
 
-	// 提前把结果发出去，后续操作可以慢慢做
-	go func() {
-		time.Sleep(1 * time.Second) // 为了防止redis时序颠倒取不到id
-		parsed, err := rl.redisWrapper.GetRequest(id)
-		if err != nil {
-			rl.logger.Error("join failed [err: %s][param: %s]", err.Error(), param)
-		} else {
-			record := &Inventory{}
-			if err := rl.cache.FetchOne(parsed.Creatives[index].AdId, record); err != nil {
-				rl.logger.Error("fetch from db failed [err: %s][param: %s]", err.Error(), param)
-				return
-			}
-			rl.redisWrapper.SetExpire(param, rl.configure.RedisClickTimeout)
-			rl.producer.Log(rl.configure.KafkaClickTopic, GetEventKafkaMessage(parsed, "click", record))
+	// 提前把结果发出去，后续操作交给后台的worker
+	rl.workers.Submit(&AsyncTask{Event: "click", Param: param, Time: time.Now()})
+}
 
-			// model
-			if rl.saveFile != nil {
-				if data, err := GetModelDataLog(parsed, record, "click"); err != nil {
+// 关联请求之后记录统计、画像和日志
+func (rl *RtbLite) processClick(task *AsyncTask) {
+	param := task.Param
+	token, err := rl.DecodeParam(param)
+	if err != nil {
+		rl.logger.Error("fail to get id from param: %v", err.Error())
+		return
+	}
+	index := token.Index
+	rl.joiner.Join(task, token, func(parsed *ParsedRequest) {
+		record := &Inventory{}
+		if err := rl.cache.FetchOne(parsed.Creatives[index].AdId, record); err != nil {
+			rl.logger.Error("fetch from db failed [err: %s][param: %s]", err.Error(), param)
+			return
+		}
+		if !token.stateless {
+			rl.redisWrapper.SetExpire(param, rl.configure.RedisClickTimeout)
+		}
+		if rl.rates != nil {
+			rl.rates.OnClick(parsed, record)
+		}
+		if rl.profiles != nil {
+			rl.profiles.Record(parsed.Cid, record, "clk", time.Now())
+		}
+		if rl.learner != nil {
+			rl.learner.OnClick(parsed, index, record)
+		}
+		rl.producer.Log(rl.configure.KafkaClickTopic, GetEventKafkaMessage(parsed, "click", record))
+
+		// model
+		if rl.saveFile != nil {
+			if data, err := GetModelDataLog(parsed, index, record, "click"); err != nil {
+				rl.logger.Warning(err.Error())
+			} else {
+				if _, err := rl.saveFile.WriteString(fmt.Sprintln(string(data))); err != nil {
 					rl.logger.Warning(err.Error())
-				} else {
-					if _, err := rl.saveFile.WriteString(fmt.Sprintln(string(data))); err != nil {
-						rl.logger.Warning(err.Error())
-					}
 				}
 			}
 		}
-	}()
+	})
 }
 
 func (rl *RtbLite) Conversion(rw http.ResponseWriter, req *http.Request) {
 	param := req.URL.Query().Get("param")
-	id, index, err := SplitId(param)
-	if err != nil {
+	if _, err := rl.DecodeParam(param); err != nil {
 		rl.logger.Error("fail to get id from param: %v", err.Error())
 		return
 	}
@@ -349,40 +696,54 @@ func (rl *RtbLite) Conversion(rw http.ResponseWriter, req *http.Request) {
 	response := `{"error_code": 0, "error_message": "success"}`
 	io.WriteString(rw, response)
 
-	// 提前把结果发出去，后续操作可以慢慢做
-	go func() {
-		time.Sleep(1 * time.Second) // 为了防止redis时序颠倒取不到id
-		parsed, err := rl.redisWrapper.GetRequest(id)
-		if err != nil {
-			rl.logger.Error("join failed [err: %s][param: %s]", err.Error(), param)
-		} else {
-			record := &Inventory{}
-			if err := rl.cache.FetchOne(parsed.Creatives[index].AdId, record); err != nil {
-				rl.logger.Error("fetch from db failed [err: %s][param: %s]", err.Error(), param)
-				return
-			}
-			rl.redisWrapper.SetExpire(param, rl.configure.RedisConversionTimeout)
-			rl.producer.Log(rl.configure.KafkaConversionTopic, GetEventKafkaMessage(parsed, "td_postback", record))
+	// 提前把结果发出去，后续操作交给后台的worker
+	rl.workers.Submit(&AsyncTask{Event: "conversion", Param: param, Time: time.Now()})
+}
 
-			// model
-			if rl.saveFile != nil {
-				if data, err := GetModelDataLog(parsed, record, "activate"); err != nil {
+// 关联请求之后记录统计、画像和日志
+func (rl *RtbLite) processConversion(task *AsyncTask) {
+	param := task.Param
+	token, err := rl.DecodeParam(param)
+	if err != nil {
+		rl.logger.Error("fail to get id from param: %v", err.Error())
+		return
+	}
+	index := token.Index
+	rl.joiner.Join(task, token, func(parsed *ParsedRequest) {
+		record := &Inventory{}
+		if err := rl.cache.FetchOne(parsed.Creatives[index].AdId, record); err != nil {
+			rl.logger.Error("fetch from db failed [err: %s][param: %s]", err.Error(), param)
+			return
+		}
+		if !token.stateless {
+			rl.redisWrapper.SetExpire(param, rl.configure.RedisConversionTimeout)
+		}
+		if rl.rates != nil {
+			rl.rates.OnConversion(parsed, record)
+		}
+		if rl.profiles != nil {
+			rl.profiles.Record(parsed.Cid, record, "ins", time.Now())
+		}
+		rl.producer.Log(rl.configure.KafkaConversionTopic, GetEventKafkaMessage(parsed, "td_postback", record))
+
+		// model
+		if rl.saveFile != nil {
+			if data, err := GetModelDataLog(parsed, index, record, "activate"); err != nil {
+				rl.logger.Warning(err.Error())
+			} else {
+				if _, err := rl.saveFile.WriteString(fmt.Sprintln(string(data))); err != nil {
 					rl.logger.Warning(err.Error())
-				} else {
-					if _, err := rl.saveFile.WriteString(fmt.Sprintln(string(data))); err != nil {
-						rl.logger.Warning(err.Error())
-					}
 				}
 			}
 		}
-	}()
+	})
 }
 
 func (rl *RtbLite) UpdateRank(rw http.ResponseWriter, req *http.Request) {
 	if err := rl.cache.UpdateRankTable(); err != nil {
 		io.WriteString(rw, fmt.Sprintf("failed, %v", err.Error()))
 	} else {
-		io.WriteString(rw, fmt.Sprintf("success, %v item(s) loaded\n", rl.cache.rankTable.Len()))
+		io.WriteString(rw, fmt.Sprintf("success, %v item(s) loaded\n", rl.cache.GetRankTable().Len()))
 	}
 }
 
@@ -391,3 +752,58 @@ func (rl *RtbLite) GetRank(rw http.ResponseWriter, req *http.Request) {
 	encoder := json.NewEncoder(rw)
 	encoder.Encode(rt.rank)
 }
+
+func (rl *RtbLite) GetInventoryStatus(rw http.ResponseWriter, req *http.Request) {
+	snapshot := rl.cache.Snapshot()
+	encoder := json.NewEncoder(rw)
+	encoder.Encode(map[string]interface{}{
+		"version":     snapshot.Version,
+		"load_time":   snapshot.LoadTime,
+		"age_seconds": int64(snapshot.Age().Seconds()),
+		"warm_start":  snapshot.WarmStart,
+		"countries":   len(snapshot.ByCountry),
+		"records":     len(snapshot.ById),
+		"invalid":     rl.cache.InvalidCount(),
+		"ad_id_index": rl.cache.AdIdIndexStatus(),
+	})
+}
+
+func (rl *RtbLite) GetRates(rw http.ResponseWriter, req *http.Request) {
+	if rl.rates == nil {
+		io.WriteString(rw, "rate stats disabled\n")
+		return
+	}
+	query := req.URL.Query()
+	encoder := json.NewEncoder(rw)
+	encoder.Encode(rl.rates.Entries(query.Get("package"), query.Get("country"), query.Get("placement")))
+}
+
+func (rl *RtbLite) GetFtrlStatus(rw http.ResponseWriter, req *http.Request) {
+	if rl.learner == nil {
+		io.WriteString(rw, "ftrl disabled\n")
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	encoder.Encode(rl.learner.Status())
+}
+
+func (rl *RtbLite) GetProfile(rw http.ResponseWriter, req *http.Request) {
+	if rl.profiles == nil {
+		io.WriteString(rw, "profile disabled\n")
+		return
+	}
+	profile, err := rl.profiles.Get(req.URL.Query().Get("cid"))
+	if err != nil {
+		io.WriteString(rw, err.Error())
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	encoder.Encode(profile)
+}
+
+func (rl *RtbLite) GetQueues(rw http.ResponseWriter, req *http.Request) {
+	status := rl.workers.Status()
+	status["join_retry"] = rl.joiner.Status()
+	encoder := json.NewEncoder(rw)
+	encoder.Encode(status)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSetPropensities(t *testing.T) {
+	// 包a有三个物料（其中一个超频），c有两个，b和d各一个
+	creatives := []*Inventory{
+		{AdId: 1, PackageName: "a"}, {AdId: 2, PackageName: "b"}, {AdId: 3, PackageName: "a"},
+		{AdId: 4, PackageName: "c"}, {AdId: 5, PackageName: "a"}, {AdId: 6, PackageName: "c"}, {AdId: 7, PackageName: "d"},
+	}
+	frequencies := NewFrequencies(len(creatives))
+	frequencies.Capped[4] = true
+	cases := []struct {
+		name     string
+		strategy string
+	}{
+		{"random", StrategyRandom},
+		{"package", StrategyPackage},
+	}
+	rl := &RtbLite{}
+	runs := 40000
+	for _, c := range cases {
+		type slot struct {
+			prefix      string
+			packageName string
+		}
+		picks := make(map[slot]int)
+		prefixes := make(map[string]int)
+		propensities := make(map[slot]float64)
+		for run := 0; run < runs; run++ {
+			var selected []*Inventory
+			if c.strategy == StrategyRandom {
+				selected = rl.SelectByRandom(&ParsedRequest{}, creatives, frequencies, 2)
+			} else {
+				selected = rl.SelectByPackage(&ParsedRequest{}, creatives, frequencies, 2)
+			}
+			rl.SetPropensities(&ParsedRequest{}, c.strategy, creatives, frequencies, selected)
+			prefix := ""
+			for _, record := range selected {
+				key := slot{prefix, record.PackageName}
+				picks[key] += 1
+				prefixes[prefix] += 1
+				propensities[key] += record.Propensity
+				prefix += record.PackageName
+			}
+		}
+		// 选中概率是给定前缀的条件概率，和相同前缀下的实际频率比较
+		for key, n := range picks {
+			total := prefixes[key.prefix]
+			if total < runs/10 {
+				continue
+			}
+			empirical := float64(n) / float64(total)
+			logged := propensities[key] / float64(n)
+			if math.Abs(empirical-logged) > 0.03 {
+				t.Errorf("%v: %+v logged propensity %.3f, empirical %.3f", c.name, key, logged, empirical)
+			}
+		}
+	}
+}
+
+func TestCandidatePackages(t *testing.T) {
+	creatives := []*Inventory{{PackageName: "a"}, {PackageName: "b"}, {PackageName: "a"}, {PackageName: "c"}}
+	frequencies := NewFrequencies(len(creatives))
+	frequencies.Capped[1] = true
+	if got := candidatePackages(creatives, frequencies); !equalStrings(got, []string{"a", "c"}) {
+		t.Errorf("candidatePackages = %v", got)
+	}
+}
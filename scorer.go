@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// 逻辑回归/FTRL导出的线性模型。文件每行为"特征哈希\t权重"，偏置项的特征名为bias
+type LinearModel struct {
+	Bias     float64
+	Weights  map[int]float64
+	Path     string
+	ModTime  time.Time
+	LoadTime time.Time
+}
+
+func LoadLinearModel(path string) (*LinearModel, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	model := &LinearModel{
+		Weights:  make(map[int]float64),
+		Path:     path,
+		ModTime:  stat.ModTime(),
+		LoadTime: time.Now(),
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v line %v: expect 2 fields", path, line)
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", path, line, err.Error())
+		}
+		if fields[0] == "bias" {
+			model.Bias = weight
+			continue
+		}
+		feature, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", path, line, err.Error())
+		}
+		model.Weights[feature] = weight
+	}
+	return model, scanner.Err()
+}
+
+// 先写临时文件再改名，加载方不会读到写了一半的模型
+func (m *LinearModel) Save(path string) error {
+	tmpFile := path + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	fmt.Fprintf(writer, "bias\t%v\n", m.Bias)
+	for feature, weight := range m.Weights {
+		if weight != 0 {
+			fmt.Fprintf(writer, "%v\t%v\n", feature, weight)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+func Sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-math.Max(math.Min(x, 35), -35)))
+}
+
+func (m *LinearModel) Predict(features []int) float64 {
+	wx := m.Bias
+	for _, feature := range features {
+		wx += m.Weights[feature]
+	}
+	return Sigmoid(wx)
+}
+
+// 请求时给候选打pCTR分，模型文件变化后原子替换，没有模型时保持排序表的顺序
+type ModelScorer struct {
+	configure *Configure
+	extractor *FeatureExtractor
+	model     atomic.Value // *LinearModel
+	logger    *logging.Logger
+}
+
+func NewModelScorer(configure *Configure, extractor *FeatureExtractor, logger *logging.Logger) *ModelScorer {
+	return &ModelScorer{
+		configure: configure,
+		extractor: extractor,
+		logger:    logger,
+	}
+}
+
+func (s *ModelScorer) Model() *LinearModel {
+	model, _ := s.model.Load().(*LinearModel)
+	return model
+}
+
+func (s *ModelScorer) SetModel(model *LinearModel) {
+	s.model.Store(model)
+}
+
+// 文件没有变化时不重新加载，加载失败时继续用旧模型
+func (s *ModelScorer) Reload() error {
+	path := s.configure.ModelPath
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if current := s.Model(); current != nil && current.Path == path && current.ModTime.Equal(stat.ModTime()) {
+		return nil
+	}
+	model, err := LoadLinearModel(path)
+	if err != nil {
+		return err
+	}
+	s.SetModel(model)
+	s.logger.Notice("model loaded from %v, %v weight(s)", path, len(model.Weights))
+	return nil
+}
+
+func (s *ModelScorer) WatchLoop() {
+	interval := time.Duration(s.configure.ModelReloadInterval) * time.Second
+	timer := time.NewTimer(interval)
+	for range timer.C {
+		if err := s.Reload(); err != nil {
+			s.logger.Warning("fail to reload model: %v", err.Error())
+		}
+		timer.Reset(interval)
+	}
+}
+
+// 按pCTR重排候选，给了estimator时按pCTR算出的eCPM重排。
+// boost不为空时得分再乘以它的返回值；没有模型时以1/(1+原位置)作为得分加权
+func (s *ModelScorer) Rank(req *ParsedRequest, candidates []*Inventory, estimator RateEstimator, boost func(record *Inventory) float64) bool {
+	model := s.Model()
+	if (model == nil && boost == nil) || len(candidates) == 0 {
+		return false
+	}
+	var ctx *FeatureContext = nil
+	if model != nil {
+		ctx = s.extractor.Context(req)
+	}
+	scores := make(map[*Inventory]float64, len(candidates))
+	for index, record := range candidates {
+		score := 1 / float64(1+index)
+		if model != nil {
+			score = model.Predict(ctx.Extract(record))
+			if estimator != nil {
+				_, cvr := estimator.Estimate(record)
+				score = record.Bid.Ecpm(score, cvr)
+			}
+		}
+		if boost != nil {
+			score *= boost(record)
+		}
+		scores[record] = score
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i]] > scores[candidates[j]]
+	})
+	return true
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadLinearModel(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		bias    float64
+		weights int
+		ok      bool
+	}{
+		{"empty", "", 0, 0, true},
+		{"weights", "# comment\nbias\t-2\n12\t0.5\n\n-7 1.5\n", -2, 2, true},
+		{"three fields", "12\t0.5\t1\n", 0, 0, false},
+		{"bad weight", "12\tx\n", 0, 0, false},
+		{"bad feature", "abc\t0.5\n", 0, 0, false},
+	}
+	for _, c := range cases {
+		model, err := LoadLinearModel(writeTempFile(t, "model.txt", c.content))
+		if (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+			continue
+		}
+		if c.ok && (model.Bias != c.bias || len(model.Weights) != c.weights) {
+			t.Errorf("%v: bias %v, %v weights", c.name, model.Bias, len(model.Weights))
+		}
+	}
+	if _, err := LoadLinearModel(filepath.Join(os.TempDir(), "no-such-model")); err == nil {
+		t.Errorf("missing file loaded")
+	}
+}
+
+func TestLinearModelSaveAndPredict(t *testing.T) {
+	model := &LinearModel{Bias: -1, Weights: map[int]float64{3: 0.5, 5: 0, -9: 2}}
+	path := filepath.Join(filepath.Dir(writeTempFile(t, "placeholder", "")), "model.txt")
+	if err := model.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLinearModel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 权重为0的特征不写入
+	if loaded.Bias != -1 || len(loaded.Weights) != 2 || loaded.Weights[-9] != 2 {
+		t.Errorf("loaded = %+v", loaded)
+	}
+	cases := []struct {
+		features []int
+		want     float64
+	}{
+		{nil, Sigmoid(-1)},
+		{[]int{3}, Sigmoid(-0.5)},
+		{[]int{3, -9, 100}, Sigmoid(1.5)},
+	}
+	for _, c := range cases {
+		if got := loaded.Predict(c.features); math.Abs(got-c.want) > 1e-12 {
+			t.Errorf("Predict(%v) = %v, want %v", c.features, got, c.want)
+		}
+	}
+	if Sigmoid(0) != 0.5 || Sigmoid(1000) >= 1 || Sigmoid(-1000) <= 0 {
+		t.Errorf("Sigmoid out of range")
+	}
+}
+
+func TestModelScorerRank(t *testing.T) {
+	extractor, err := NewFeatureExtractor([]string{"package"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := &LinearModel{Weights: map[int]float64{
+		FeatureHash("package", "b"): 2,
+		FeatureHash("package", "c"): 1,
+	}}
+	cases := []struct {
+		name   string
+		model  *LinearModel
+		boost  func(record *Inventory) float64
+		ranked bool
+		want   []string
+	}{
+		{"no model", nil, nil, false, []string{"a", "b", "c"}},
+		{"model", model, nil, true, []string{"b", "c", "a"}},
+		{"boost only", nil, func(record *Inventory) float64 {
+			if record.PackageName == "c" {
+				return 10
+			}
+			return 1
+		}, true, []string{"c", "a", "b"}},
+		{"model and boost", model, func(record *Inventory) float64 {
+			if record.PackageName == "a" {
+				return 100
+			}
+			return 1
+		}, true, []string{"a", "b", "c"}},
+	}
+	for _, c := range cases {
+		scorer := NewModelScorer(NewConfigure(), extractor, testLogger)
+		if c.model != nil {
+			scorer.SetModel(c.model)
+		}
+		candidates := []*Inventory{{PackageName: "a"}, {PackageName: "b"}, {PackageName: "c"}}
+		ranked := scorer.Rank(&ParsedRequest{}, candidates, nil, c.boost)
+		if ranked != c.ranked || !equalStrings(inventoryPackages(candidates), c.want) {
+			t.Errorf("%v: ranked %v, order %v", c.name, ranked, inventoryPackages(candidates))
+		}
+	}
+}
+
+func TestModelScorerReload(t *testing.T) {
+	path := writeTempFile(t, "model.txt", "bias\t1\n")
+	configure := NewConfigure()
+	configure.ModelPath = path
+	scorer := NewModelScorer(configure, nil, testLogger)
+	if err := scorer.Reload(); err != nil || scorer.Model().Bias != 1 {
+		t.Fatalf("first Reload: %v", err)
+	}
+	first := scorer.Model()
+	if err := scorer.Reload(); err != nil || scorer.Model() != first {
+		t.Errorf("unchanged file reloaded: %v", err)
+	}
+	// 加载失败时保留旧模型
+	if err := ioutil.WriteFile(path, []byte("bias\tx\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if err := scorer.Reload(); err == nil || scorer.Model() != first {
+		t.Errorf("broken model replaced the old one: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("bias\t2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute))
+	if err := scorer.Reload(); err != nil || scorer.Model().Bias != 2 {
+		t.Errorf("changed model not reloaded: %v", err)
+	}
+}
+
+func inventoryPackages(records []*Inventory) []string {
+	packages := make([]string, len(records))
+	for i, record := range records {
+		packages[i] = record.PackageName
+	}
+	return packages
+}
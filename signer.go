@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 跟踪链接的签名密钥，Id随链接一起发出，用来在校验时找到对应的密钥
+type SigningKey struct {
+	Id     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// 签名覆盖param、final_url和过期时间，链接上附加exp、kid、sig三个参数。
+// win和loss通知的价格和原因是交易平台替换的宏，不在签名里，签名另外带上事件名
+type UrlSigner struct {
+	keys []*SigningKey
+	ttl  time.Duration
+}
+
+// 第一个密钥用于签名，其余的只用于校验，轮换时把新密钥放到最前面，
+// 等旧链接都过期之后再去掉旧密钥
+func NewUrlSigner(keys []*SigningKey, ttl int) (*UrlSigner, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	for _, key := range keys {
+		if key.Id == "" || key.Secret == "" {
+			return nil, errors.New("signing key needs both id and secret")
+		}
+	}
+	return &UrlSigner{keys: keys, ttl: time.Duration(ttl) * time.Second}, nil
+}
+
+// 展示和点击链接的scope为空，与原来的签名一致
+func signScope(event string) string {
+	if event == "win" || event == "loss" {
+		return event
+	}
+	return ""
+}
+
+func (s *UrlSigner) signature(key *SigningKey, scope string, values url.Values) string {
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	if scope != "" {
+		fmt.Fprintf(mac, "scope=%v\n", scope)
+	}
+	fmt.Fprintf(mac, "param=%v\nfinal_url=%v\nexp=%v\nkid=%v",
+		values.Get("param"), values.Get("final_url"), values.Get("exp"), key.Id)
+	// 截断到128位，链接短一些
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (s *UrlSigner) Sign(values url.Values, event string, now time.Time) {
+	key := s.keys[0]
+	values.Set("exp", strconv.FormatInt(now.Add(s.ttl).Unix(), 10))
+	values.Set("kid", key.Id)
+	values.Set("sig", s.signature(key, signScope(event), values))
+}
+
+func (s *UrlSigner) Verify(values url.Values, event string, now time.Time) error {
+	var key *SigningKey = nil
+	for _, value := range s.keys {
+		if value.Id == values.Get("kid") {
+			key = value
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("unknown key: %v", values.Get("kid"))
+	}
+	if !hmac.Equal([]byte(values.Get("sig")), []byte(s.signature(key, signScope(event), values))) {
+		return errors.New("bad signature")
+	}
+	exp, err := strconv.ParseInt(values.Get("exp"), 10, 64)
+	if err != nil {
+		return errors.New("bad expiry")
+	}
+	if now.Unix() > exp {
+		return errors.New("expired")
+	}
+	return nil
+}
+
+// 校验失败的事件不跳转、不记录，单独计数并写到rejected日志
+func (rl *RtbLite) VerifyTracker(rw http.ResponseWriter, req *http.Request, event string) bool {
+	if rl.signer == nil {
+		return true
+	}
+	if err := rl.signer.Verify(req.URL.Query(), event, time.Now()); err != nil {
+		rl.profiler.OnRejected()
+		rl.rejectLogger.Warning("rejected %v [err: %s][ip: %s][url: %s]",
+			event, err.Error(), req.RemoteAddr, req.URL.RequestURI())
+		rw.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
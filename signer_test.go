@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUrlSigner(t *testing.T) {
+	cases := []struct {
+		name   string
+		keys   []*SigningKey
+		signer bool
+		ok     bool
+	}{
+		{"disabled", nil, false, true},
+		{"keys", []*SigningKey{{Id: "a", Secret: "x"}, {Id: "b", Secret: "y"}}, true, true},
+		{"missing secret", []*SigningKey{{Id: "a"}}, false, false},
+		{"missing id", []*SigningKey{{Secret: "x"}}, false, false},
+	}
+	for _, c := range cases {
+		signer, err := NewUrlSigner(c.keys, 60)
+		if (err == nil) != c.ok || (signer != nil) != c.signer {
+			t.Errorf("%v: NewUrlSigner = %v, %v", c.name, signer, err)
+		}
+	}
+}
+
+func TestUrlSignerVerify(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	signer, _ := NewUrlSigner([]*SigningKey{{Id: "new", Secret: "x"}, {Id: "old", Secret: "y"}}, 60)
+	old, _ := NewUrlSigner([]*SigningKey{{Id: "old", Secret: "y"}}, 60)
+	retired, _ := NewUrlSigner([]*SigningKey{{Id: "gone", Secret: "z"}}, 60)
+	sign := func(s *UrlSigner, event string) url.Values {
+		values := url.Values{}
+		values.Set("param", "r-0")
+		values.Set("final_url", "http://example.com/?a=1")
+		s.Sign(values, event, now)
+		return values
+	}
+	cases := []struct {
+		name   string
+		values url.Values
+		event  string
+		modify func(values url.Values)
+		at     time.Time
+		ok     bool
+	}{
+		{"valid", sign(signer, "click"), "click", nil, now, true},
+		{"rotated key", sign(old, "click"), "click", nil, now, true},
+		{"retired key", sign(retired, "click"), "click", nil, now, false},
+		{"expired", sign(signer, "click"), "click", nil, now.Add(61 * time.Second), false},
+		{"param changed", sign(signer, "click"), "click", func(values url.Values) { values.Set("param", "r-1") }, now, false},
+		{"final_url changed", sign(signer, "click"), "click", func(values url.Values) { values.Set("final_url", "http://evil") }, now, false},
+		{"expiry extended", sign(signer, "click"), "click", func(values url.Values) { values.Set("exp", "9999999999") }, now, false},
+		// 展示和点击链接的签名相同，但不能拿来伪造成交通知
+		{"impression as click", sign(signer, "impression"), "click", nil, now, true},
+		{"impression as win", sign(signer, "impression"), "win", nil, now, false},
+		{"loss as win", sign(signer, "loss"), "win", nil, now, false},
+		{"win", sign(signer, "win"), "win", func(values url.Values) { values.Set("price", "1.5") }, now, true},
+		{"loss", sign(signer, "loss"), "loss", func(values url.Values) { values.Set("reason", "102") }, now, true},
+	}
+	for _, c := range cases {
+		if c.modify != nil {
+			c.modify(c.values)
+		}
+		if err := signer.Verify(c.values, c.event, c.at); (err == nil) != c.ok {
+			t.Errorf("%v: Verify err = %v", c.name, err)
+		}
+	}
+}
+
+func TestSignedNotices(t *testing.T) {
+	configure := NewConfigure()
+	configure.CallbackAddress = "rtb.example.com"
+	signer, _ := NewUrlSigner([]*SigningKey{{Id: "k", Secret: "x"}}, 60)
+	rl := &RtbLite{configure: configure, signer: signer}
+	parsed := &ParsedRequest{Id: "r"}
+	record := &Inventory{AdId: 1}
+	cases := []struct {
+		event  string
+		notice string
+		path   string
+	}{
+		{"win", rl.WinNotice(parsed, 2, record), "/win"},
+		{"loss", rl.LossNotice(parsed, 2, record), "/loss"},
+	}
+	for _, c := range cases {
+		// 宏保持原样，由交易平台替换
+		if !strings.Contains(c.notice, "price="+AuctionPriceMacro) {
+			t.Errorf("%v: notice %v", c.event, c.notice)
+		}
+		replaced := strings.NewReplacer(AuctionPriceMacro, "1.25", AuctionLossMacro, "102").Replace(c.notice)
+		u, err := url.Parse(replaced)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := u.Query()
+		if u.Path != c.path || values.Get("param") != "r-2" {
+			t.Errorf("%v: notice %v", c.event, c.notice)
+		}
+		if err := signer.Verify(values, c.event, time.Now()); err != nil {
+			t.Errorf("%v: Verify err = %v", c.event, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// 落盘的物料快照，数据库不可用时用来冷启动
+type InventorySnapshotFile struct {
+	SavedAt   time.Time    `json:"saved_at"`
+	Version   int64        `json:"version"`
+	Watermark string       `json:"watermark"`
+	Inventory []*Inventory `json:"inventory"`
+	Rank      []string     `json:"rank"`
+}
+
+// 先写临时文件再改名，避免留下写了一半的快照。
+// 排序表也一起落盘，只在启动时排序文件读不出来时使用，排序文件可用时以排序文件为准
+func (inv *InventoryCache) saveSnapshotFile(snapshot *InventorySnapshot) error {
+	if inv.configure.InventorySnapshotPath == "" {
+		return nil
+	}
+	records := make([]*Inventory, 0, len(snapshot.ById))
+	for _, record := range snapshot.ById {
+		records = append(records, record)
+	}
+	content, err := json.Marshal(&InventorySnapshotFile{
+		SavedAt:   snapshot.LoadTime,
+		Version:   snapshot.Version,
+		Watermark: inv.watermark,
+		Inventory: records,
+		Rank:      snapshot.RankTable.List(),
+	})
+	if err != nil {
+		return err
+	}
+	tmpFile := inv.configure.InventorySnapshotPath + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, inv.configure.InventorySnapshotPath)
+}
+
+func loadSnapshotFile(snapshotPath string) (*InventorySnapshotFile, error) {
+	content, err := ioutil.ReadFile(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	saved := &InventorySnapshotFile{}
+	if err := json.Unmarshal(content, saved); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// 排序文件缺失或损坏时，用快照中最近一次生效的排序表
+func loadSnapshotRankTable(configure *Configure) (*RankTable, error) {
+	if configure.InventorySnapshotPath == "" {
+		return nil, errors.New("inventory snapshot disabled")
+	}
+	saved, err := loadSnapshotFile(configure.InventorySnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(saved.Rank) == 0 {
+		return nil, errors.New("no rank table in inventory snapshot")
+	}
+	return NewRankTableFromList(configure.RankTablePath, saved.Rank), nil
+}
+
+// 全量加载之后总是落盘；增量更新频繁，距上次落盘不足InventorySnapshotInterval秒的先不写，
+// 下次刷新时再补上
+func (inv *InventoryCache) persist(force bool) {
+	snapshot := inv.Snapshot()
+	if snapshot.Version == inv.persistedVersion {
+		return
+	}
+	interval := time.Duration(inv.configure.InventorySnapshotInterval) * time.Second
+	if !force && time.Since(inv.persistedAt) < interval {
+		return
+	}
+	if err := inv.saveSnapshotFile(snapshot); err != nil {
+		inv.logger.Warning("fail to save inventory snapshot: %v", err.Error())
+		return
+	}
+	inv.persistedVersion = snapshot.Version
+	inv.persistedAt = time.Now()
+}
+
+// 从落盘快照恢复，恢复出的数据可能已经过期，下次刷新会强制全量重载
+func (inv *InventoryCache) LoadFromSnapshotFile() error {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	saved, err := loadSnapshotFile(inv.configure.InventorySnapshotPath)
+	if err != nil {
+		return err
+	}
+	saved.Inventory, _ = inv.prepare(saved.Inventory)
+	countryMap := make(map[string]*InventoryCollection)
+	idMap := make(map[int]*Inventory)
+	for _, record := range saved.Inventory {
+		if _, ok := countryMap[record.Country]; !ok {
+			countryMap[record.Country] = NewInventoryCollection(inv.rankTable, inv.estimator)
+		}
+		countryMap[record.Country].Append(record)
+		idMap[record.Id] = record
+	}
+	for _, queue := range countryMap {
+		queue.Build()
+	}
+	inv.version = saved.Version
+	inv.snapshot.Store(&InventorySnapshot{
+		Version:   saved.Version,
+		LoadTime:  saved.SavedAt,
+		ByCountry: countryMap,
+		ById:      idMap,
+		ByAdId:    indexByAdId(idMap),
+		RankTable: inv.rankTable,
+		WarmStart: true,
+	})
+	inv.watermark = saved.Watermark
+	inv.lastFullLoad = time.Time{}
+	inv.persistedVersion = saved.Version
+	inv.logger.Warning("warm started from %v, %v record(s), saved at %v",
+		inv.configure.InventorySnapshotPath, len(saved.Inventory), saved.SavedAt)
+	return nil
+}
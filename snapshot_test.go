@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func readSnapshotFile(t *testing.T, path string) *InventorySnapshotFile {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := &InventorySnapshotFile{}
+	if err := json.Unmarshal(content, saved); err != nil {
+		t.Fatal(err)
+	}
+	return saved
+}
+
+func TestSnapshotWarmStartKeepsRankFile(t *testing.T) {
+	records := []*Inventory{testRecord(1, "a", "US", "2017-01-01"), testRecord(2, "b", "US", "2017-01-02")}
+	cache, _ := newTestInventoryCache(t, records, []string{"a", "b"})
+	snapshotPath := writeTempFile(t, "inventory.snapshot", "")
+	cache.configure.InventorySnapshotPath = snapshotPath
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启时排序文件已经更新，数据源不可用
+	restarted, _ := newTestInventoryCache(t, nil, []string{"b", "a"})
+	restarted.configure.InventorySnapshotPath = snapshotPath
+	if err := restarted.LoadFromSnapshotFile(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := restarted.Snapshot()
+	if !snapshot.WarmStart || snapshot.Version != 1 || restarted.watermark != "2017-01-02" {
+		t.Errorf("snapshot = %+v, watermark = %v", snapshot, restarted.watermark)
+	}
+	us, _ := snapshot.Country("US")
+	if got := collectionPackages(us); !equalStrings(got, []string{"b", "a"}) {
+		t.Errorf("US = %v, want the fresh rank file order", got)
+	}
+	if snapshot.RankTable != restarted.GetRankTable() {
+		t.Errorf("rank table replaced by the snapshot")
+	}
+}
+
+func TestSnapshotPersistThrottled(t *testing.T) {
+	cases := []struct {
+		interval    int
+		wantVersion int64
+	}{
+		{3600, 1},
+		{0, 2},
+	}
+	for _, c := range cases {
+		cache, write := newTestInventoryCache(t, []*Inventory{testRecord(1, "a", "US", "1")}, nil)
+		snapshotPath := writeTempFile(t, "inventory.snapshot", "")
+		cache.configure.InventorySnapshotPath = snapshotPath
+		cache.configure.InventorySnapshotInterval = c.interval
+		if err := cache.Load(); err != nil {
+			t.Fatal(err)
+		}
+		write([]*Inventory{testRecord(1, "a", "US", "1"), testRecord(2, "b", "US", "2")})
+		if err := cache.LoadDelta(); err != nil {
+			t.Fatal(err)
+		}
+		if saved := readSnapshotFile(t, snapshotPath); saved.Version != c.wantVersion {
+			t.Errorf("interval %v: saved version = %v, want %v", c.interval, saved.Version, c.wantVersion)
+		}
+	}
+}
+
+func TestSnapshotRankTableFallback(t *testing.T) {
+	records := []*Inventory{testRecord(1, "a", "US", "1"), testRecord(2, "b", "US", "2")}
+	cache, _ := newTestInventoryCache(t, records, []string{"b", "a"})
+	snapshotPath := writeTempFile(t, "inventory.snapshot", "")
+	cache.configure.InventorySnapshotPath = snapshotPath
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if saved := readSnapshotFile(t, snapshotPath); !equalStrings(saved.Rank, []string{"b", "a"}) {
+		t.Errorf("saved rank = %v", saved.Rank)
+	}
+
+	cases := []struct {
+		name     string
+		rank     string
+		snapshot string
+		want     []string
+		ok       bool
+	}{
+		{"rank file", `["a", "b"]`, snapshotPath, []string{"a", "b"}, true},
+		{"broken rank file", `["a",`, snapshotPath, []string{"b", "a"}, true},
+		{"no snapshot", `["a",`, "", nil, false},
+	}
+	for _, c := range cases {
+		configure := *cache.configure
+		configure.RankTablePath = writeTempFile(t, "adrank.json", c.rank)
+		configure.InventorySnapshotPath = c.snapshot
+		restarted, err := NewInventoryCache(&configure, testLogger, nil)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got := restarted.GetRankTable().List(); !equalStrings(got, c.want) {
+			t.Errorf("%v: rank = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/op/go-logging"
+)
+
+// 物料数据源，InventoryCache只依赖这个接口
+type InventorySource interface {
+	// 读取全部在线物料
+	LoadOnline() ([]*Inventory, error)
+	// 用ad_id查询，包含已下线的物料
+	FetchOne(adId int, record *Inventory) error
+}
+
+func NewInventorySource(configure *Configure, logger *logging.Logger) (InventorySource, error) {
+	switch strings.ToLower(configure.InventorySource) {
+	case "", "mysql":
+		c := configure
+		dsn := fmt.Sprintf("%v:%v@tcp(%v)/%v",
+			c.MySqlUser, c.MySqlPassword, c.MySqlAddress, c.MySqlDatabase)
+		return NewSqlInventorySource("mysql", dsn, logger), nil
+	case "sqlite":
+		return NewSqlInventorySource("sqlite3", configure.InventoryFilePath, logger), nil
+	case "json":
+		return NewJsonInventorySource(configure.InventoryFilePath), nil
+	case "csv":
+		return NewCsvInventorySource(configure.InventoryFilePath), nil
+	}
+	return nil, fmt.Errorf("unknown inventory source: %v", configure.InventorySource)
+}
+
+// 支持按ts增量读取的数据源
+type IncrementalInventorySource interface {
+	InventorySource
+	// 读取ts不早于since的全部记录，包括已下线的
+	LoadChanged(since string) ([]*Inventory, error)
+}
+
+type RowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// mysql和sqlite共用一套表结构，只是驱动不同
+type SqlInventorySource struct {
+	driver          string
+	dsn             string
+	databaseHandler *sql.DB
+	selectColumns   string // 按表结构生成的查询前半部分，重连时重新探测
+
+	lock   sync.Mutex
+	logger *logging.Logger
+}
+
+func NewSqlInventorySource(driver string, dsn string, logger *logging.Logger) *SqlInventorySource {
+	return &SqlInventorySource{
+		driver: driver,
+		dsn:    dsn,
+		logger: logger,
+	}
+}
+
+const inventorySelectColumns = `
+		SELECT id, ad_id, package_name,
+		       icon_url, label, click_url,
+		       price, max_os, min_os,
+		       banner_url, country, ad_type,
+		       status, model_sign1, extensions,
+		       max_os_num, min_os_num, ts,
+		       %v
+		FROM inventory`
+
+// frequency_cap是后加的列，没有迁移的表按空串读，即不做物料级频控，迁移见README
+const (
+	frequencyCapColumn        = `COALESCE(frequency_cap, '')`
+	missingFrequencyCapColumn = `'' AS frequency_cap`
+)
+
+func (s *SqlInventorySource) scan(row RowScanner, record *Inventory) error {
+	return row.Scan(&record.Id, &record.AdId, &record.PackageName,
+		&record.IconUrl, &record.Label, &record.ClickUrl,
+		&record.Price, &record.MaxOs, &record.MinOs,
+		&record.BannerUrl, &record.Country, &record.AdType,
+		&record.Status, &record.ModelSign1, &record.Extension,
+		&record.MaxOsNum, &record.MinOsNum, &record.Ts,
+		&record.FrequencyCap)
+}
+
+func (s *SqlInventorySource) handler() (*sql.DB, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// 重连
+	if s.databaseHandler == nil {
+		if conn, err := sql.Open(s.driver, s.dsn); err != nil {
+			s.logger.Warning("fail to connect to %v: %v", s.driver, err.Error())
+			return nil, "", err
+		} else {
+			s.databaseHandler = conn
+			s.selectColumns = ""
+		}
+	}
+	if s.selectColumns == "" {
+		columns, err := s.probeColumns(s.databaseHandler)
+		if err != nil {
+			return nil, "", err
+		}
+		s.selectColumns = columns
+	}
+	return s.databaseHandler, s.selectColumns, nil
+}
+
+// 只有表本身可以查询而frequency_cap查询失败时才认为缺列，其他错误原样返回
+func (s *SqlInventorySource) probeColumns(db *sql.DB) (string, error) {
+	rows, err := db.Query(`SELECT frequency_cap FROM inventory LIMIT 0`)
+	if err == nil {
+		rows.Close()
+		return fmt.Sprintf(inventorySelectColumns, frequencyCapColumn), nil
+	}
+	rows, tableErr := db.Query(`SELECT id FROM inventory LIMIT 0`)
+	if tableErr != nil {
+		s.logger.Warning("fail to execute sql: %v", tableErr.Error())
+		return "", tableErr
+	}
+	rows.Close()
+	s.logger.Warning("inventory has no frequency_cap column, creative caps disabled: %v", err.Error())
+	return fmt.Sprintf(inventorySelectColumns, missingFrequencyCapColumn), nil
+}
+
+// 释放掉下次重连
+func (s *SqlInventorySource) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.databaseHandler != nil {
+		s.databaseHandler.Close()
+		s.databaseHandler = nil
+	}
+}
+
+func (s *SqlInventorySource) FetchOne(adId int, record *Inventory) error {
+	db, columns, err := s.handler()
+	if err != nil {
+		return err
+	}
+	row := db.QueryRow(columns+`
+		WHERE ad_id=?
+		LIMIT 1
+	`, adId)
+	return s.scan(row, record)
+}
+
+func (s *SqlInventorySource) LoadOnline() ([]*Inventory, error) {
+	return s.query(`
+		WHERE status='online'
+	`)
+}
+
+func (s *SqlInventorySource) LoadChanged(since string) ([]*Inventory, error) {
+	return s.query(`
+		WHERE ts>=?
+	`, since)
+}
+
+// where为查询的后半部分
+func (s *SqlInventorySource) query(where string, args ...interface{}) ([]*Inventory, error) {
+	db, columns, err := s.handler()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(columns+where, args...)
+	if err != nil {
+		s.logger.Warning("fail to execute sql: %v", err.Error())
+		s.reset()
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]*Inventory, 0)
+	errorCount := 0
+	for rows.Next() {
+		record := &Inventory{}
+		if err := s.scan(rows, record); err != nil {
+			if errorCount < 10 {
+				s.logger.Warning(err.Error())
+			} else if errorCount == 10 {
+				s.logger.Warning("to many errors, ignored")
+			}
+			errorCount += 1
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// 文件数据源每次都整体读入，适合开发环境和小规模部署
+type fileInventorySource struct {
+	load func() ([]*Inventory, error)
+}
+
+func (s *fileInventorySource) LoadOnline() ([]*Inventory, error) {
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	online := make([]*Inventory, 0, len(records))
+	for _, record := range records {
+		if record.Status == "online" {
+			online = append(online, record)
+		}
+	}
+	return online, nil
+}
+
+func (s *fileInventorySource) LoadChanged(since string) ([]*Inventory, error) {
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	changed := make([]*Inventory, 0)
+	for _, record := range records {
+		if record.Ts >= since {
+			changed = append(changed, record)
+		}
+	}
+	return changed, nil
+}
+
+func (s *fileInventorySource) FetchOne(adId int, record *Inventory) error {
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	for _, value := range records {
+		if value.AdId == adId {
+			*record = *value
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// 文件内容为Inventory数组，字段名同json tag
+func NewJsonInventorySource(file string) InventorySource {
+	return &fileInventorySource{
+		load: func() ([]*Inventory, error) {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			records := make([]*Inventory, 0)
+			if err := json.Unmarshal(content, &records); err != nil {
+				return nil, err
+			}
+			return records, nil
+		},
+	}
+}
+
+// 第一行为表头，列名同inventory表
+func NewCsvInventorySource(file string) InventorySource {
+	return &fileInventorySource{
+		load: func() ([]*Inventory, error) {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			reader := csv.NewReader(f)
+			header, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			records := make([]*Inventory, 0)
+			for line := 2; ; line++ {
+				fields, err := reader.Read()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, err
+				}
+				record := &Inventory{}
+				for index, column := range header {
+					if index >= len(fields) {
+						break
+					}
+					if err := setInventoryColumn(record, column, fields[index]); err != nil {
+						return nil, fmt.Errorf("%v line %v: %v", file, line, err.Error())
+					}
+				}
+				records = append(records, record)
+			}
+			return records, nil
+		},
+	}
+}
+
+func setInventoryColumn(record *Inventory, column string, value string) error {
+	atoi := func(target *int) error {
+		if value == "" {
+			*target = 0
+			return nil
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("column %v: %v", column, err.Error())
+		}
+		*target = v
+		return nil
+	}
+	switch strings.TrimSpace(column) {
+	case "id":
+		return atoi(&record.Id)
+	case "ad_id":
+		return atoi(&record.AdId)
+	case "package_name":
+		record.PackageName = value
+	case "icon_url":
+		record.IconUrl = value
+	case "label":
+		record.Label = value
+	case "click_url":
+		record.ClickUrl = value
+	case "price":
+		record.Price = value
+	case "max_os":
+		record.MaxOs = value
+	case "min_os":
+		record.MinOs = value
+	case "banner_url":
+		record.BannerUrl = value
+	case "country":
+		record.Country = value
+	case "ad_type":
+		record.AdType = value
+	case "status":
+		record.Status = value
+	case "model_sign1":
+		return atoi(&record.ModelSign1)
+	case "extensions", "extension":
+		record.Extension = value
+	case "max_os_num":
+		return atoi(&record.MaxOsNum)
+	case "min_os_num":
+		return atoi(&record.MinOsNum)
+	case "ts":
+		record.Ts = value
+	case "frequency_cap":
+		record.FrequencyCap = value
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+var testLogger = logging.MustGetLogger("rtblite")
+
+func writeTempFile(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "rtblite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var sourceFixture = []*Inventory{
+	{Id: 1, AdId: 101, PackageName: "a", Price: "1.5", Country: "US", Status: "online", Ts: "2017-01-01 00:00:00"},
+	{Id: 2, AdId: 102, PackageName: "b", Price: "2", Country: "US", Status: "offline", Ts: "2017-01-02 00:00:00"},
+	{Id: 3, AdId: 103, PackageName: "c", Price: "0.5", Country: "BR", Status: "online", Ts: "2017-01-03 00:00:00"},
+}
+
+const sourceFixtureCsv = `id,ad_id,package_name,price,country,status,ts
+1,101,a,1.5,US,online,2017-01-01 00:00:00
+2,102,b,2,US,offline,2017-01-02 00:00:00
+3,103,c,0.5,BR,online,2017-01-03 00:00:00
+`
+
+func fileSources(t *testing.T) map[string]InventorySource {
+	content, err := json.Marshal(sourceFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]InventorySource{
+		"json": NewJsonInventorySource(writeTempFile(t, "inventory.json", string(content))),
+		"csv":  NewCsvInventorySource(writeTempFile(t, "inventory.csv", sourceFixtureCsv)),
+	}
+}
+
+func adIds(records []*Inventory) []int {
+	ids := make([]int, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record.AdId)
+	}
+	return ids
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFileInventorySource(t *testing.T) {
+	for name, source := range fileSources(t) {
+		online, err := source.LoadOnline()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got := adIds(online); !equalInts(got, []int{101, 103}) {
+			t.Errorf("%v: LoadOnline = %v", name, got)
+		}
+
+		incremental, ok := source.(IncrementalInventorySource)
+		if !ok {
+			t.Fatalf("%v: not incremental", name)
+		}
+		cases := []struct {
+			since string
+			want  []int
+		}{
+			{"", []int{101, 102, 103}},
+			{"2017-01-02 00:00:00", []int{102, 103}},
+			{"2017-01-04 00:00:00", []int{}},
+		}
+		for _, c := range cases {
+			changed, err := incremental.LoadChanged(c.since)
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			if got := adIds(changed); !equalInts(got, c.want) {
+				t.Errorf("%v: LoadChanged(%q) = %v, want %v", name, c.since, got, c.want)
+			}
+		}
+
+		record := &Inventory{}
+		if err := source.FetchOne(102, record); err != nil || record.PackageName != "b" || record.Status != "offline" {
+			t.Errorf("%v: FetchOne(102) = %+v, %v", name, record, err)
+		}
+		if err := source.FetchOne(999, record); err != sql.ErrNoRows {
+			t.Errorf("%v: FetchOne(999) err = %v, want sql.ErrNoRows", name, err)
+		}
+	}
+}
+
+func TestCsvInventorySourceErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+	}{
+		{"bad int", "id,ad_id\n1,x\n"},
+		{"empty", ""},
+	}
+	for _, c := range cases {
+		source := NewCsvInventorySource(writeTempFile(t, "inventory.csv", c.content))
+		if _, err := source.LoadOnline(); err == nil {
+			t.Errorf("%v: expected error", c.name)
+		}
+	}
+	// 缺列和空值按零值处理
+	source := NewCsvInventorySource(writeTempFile(t, "inventory.csv", "ad_id,model_sign1,status\n7,,online\n"))
+	records, err := source.LoadOnline()
+	if err != nil || len(records) != 1 || records[0].AdId != 7 || records[0].ModelSign1 != 0 {
+		t.Errorf("LoadOnline = %v, %v", records, err)
+	}
+}
+
+func TestNewInventorySource(t *testing.T) {
+	cases := []struct {
+		kind string
+		ok   bool
+	}{
+		{"", true},
+		{"MySQL", true},
+		{"sqlite", true},
+		{"json", true},
+		{"csv", true},
+		{"xml", false},
+	}
+	for _, c := range cases {
+		configure := NewConfigure()
+		configure.InventorySource = c.kind
+		source, err := NewInventorySource(configure, testLogger)
+		if (err == nil) != c.ok || (source != nil) != c.ok {
+			t.Errorf("NewInventorySource(%q) = %v, %v", c.kind, source, err)
+		}
+	}
+}
+
+func sqliteAvailable() bool {
+	for _, driver := range sql.Drivers() {
+		if driver == "sqlite3" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSqliteInventorySource(t *testing.T) {
+	if !sqliteAvailable() {
+		t.Skip("sqlite3 driver not registered")
+	}
+	columns := `id INTEGER PRIMARY KEY, ad_id INTEGER, package_name TEXT,
+		icon_url TEXT, label TEXT, click_url TEXT,
+		price TEXT, max_os TEXT, min_os TEXT,
+		banner_url TEXT, country TEXT, ad_type TEXT,
+		status TEXT, model_sign1 INTEGER, extensions TEXT,
+		max_os_num INTEGER, min_os_num INTEGER, ts TEXT`
+	values := []string{
+		`1, 101, 'a', '', '', '', '1.5', '', '', '', 'US', '', 'online', 0, '', 0, 0, '2017-01-01'`,
+		`2, 102, 'b', '', '', '', '2', '', '', '', 'US', '', 'offline', 0, '', 0, 0, '2017-01-02'`,
+	}
+	cases := []struct {
+		name         string
+		schema       string
+		capValues    []string
+		frequencyCap string
+	}{
+		{"with frequency_cap", columns + ", frequency_cap TEXT", []string{", NULL", ", 'day:1'"}, "day:1"},
+		// 没有迁移的老表仍然可以加载，只是没有物料级频控
+		{"without frequency_cap", columns, []string{"", ""}, ""},
+	}
+	for _, c := range cases {
+		path := writeTempFile(t, "inventory.db", "")
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statements := []string{"CREATE TABLE inventory (" + c.schema + ")"}
+		for i, value := range values {
+			statements = append(statements, "INSERT INTO inventory VALUES ("+value+c.capValues[i]+")")
+		}
+		for _, statement := range statements {
+			if _, err := db.Exec(statement); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		source := NewSqlInventorySource("sqlite3", path, testLogger)
+		online, err := source.LoadOnline()
+		if err != nil || !equalInts(adIds(online), []int{101}) {
+			t.Errorf("%v: LoadOnline = %v, %v", c.name, adIds(online), err)
+		}
+		changed, err := source.LoadChanged("2017-01-02")
+		if err != nil || !equalInts(adIds(changed), []int{102}) {
+			t.Errorf("%v: LoadChanged = %v, %v", c.name, adIds(changed), err)
+		}
+		record := &Inventory{}
+		if err := source.FetchOne(102, record); err != nil || record.FrequencyCap != c.frequencyCap {
+			t.Errorf("%v: FetchOne = %+v, %v", c.name, record, err)
+		}
+		if err := source.FetchOne(999, record); err != sql.ErrNoRows {
+			t.Errorf("%v: FetchOne(999) err = %v", c.name, err)
+		}
+	}
+
+	// 表不存在时报错，不当作缺列
+	source := NewSqlInventorySource("sqlite3", writeTempFile(t, "empty.db", ""), testLogger)
+	if _, err := source.LoadOnline(); err == nil {
+		t.Errorf("LoadOnline without table succeeded")
+	}
+}
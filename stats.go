@@ -0,0 +1,261 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// 汇总所有广告位时placement取这个值
+const AllPlacements = "*"
+
+type RateCounts struct {
+	Impressions int64 `json:"impressions"`
+	Clicks      int64 `json:"clicks"`
+	Conversions int64 `json:"conversions"`
+}
+
+func (c *RateCounts) Add(other *RateCounts) {
+	c.Impressions += other.Impressions
+	c.Clicks += other.Clicks
+	c.Conversions += other.Conversions
+}
+
+func RateKey(packageName string, country string, placementId string) string {
+	return packageName + "|" + country + "|" + placementId
+}
+
+// 统计的存储，由RedisWrapper实现
+type rateStore interface {
+	WriteRates(deltas map[string]*RateCounts, now time.Time, windowDays int) error
+	ReadRates(keys []string, now time.Time, windowDays int) (map[string]*RateCounts, error)
+}
+
+// 按(包名, 国家, 广告位)统计的展示、点击、转化。
+// 进程内先累加增量，定期写入redis按天分桶的计数，再把窗口内的合计读回来，
+// 多台机器共享同一份统计
+type RateStats struct {
+	configure *Configure
+	store     rateStore
+	logger    *logging.Logger
+
+	lock   sync.Mutex
+	deltas map[string]*RateCounts
+	// 已经写入但还没有读回的增量，读回之后包含在totals里
+	written map[string]*RateCounts
+	totals  map[string]*RateCounts
+	// 除了本进程统计过的，每次同步还要读的key，见SetKeySource
+	keySource func() []string
+}
+
+func NewRateStats(configure *Configure, redisWrapper *RedisWrapper, logger *logging.Logger) *RateStats {
+	return newRateStats(configure, redisWrapper, logger)
+}
+
+func newRateStats(configure *Configure, store rateStore, logger *logging.Logger) *RateStats {
+	return &RateStats{
+		configure: configure,
+		store:     store,
+		logger:    logger,
+		deltas:    make(map[string]*RateCounts),
+		written:   make(map[string]*RateCounts),
+		totals:    make(map[string]*RateCounts),
+	}
+}
+
+// 新进程或本进程没有投放过的物料也要读到其他机器写入的统计，
+// 一般传InventoryCache.RateKeys，按当前在线物料的包名和国家读所有广告位的汇总
+func (rs *RateStats) SetKeySource(keySource func() []string) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.keySource = keySource
+}
+
+func mergeRateCounts(target map[string]*RateCounts, source map[string]*RateCounts) {
+	for key, counts := range source {
+		if _, ok := target[key]; !ok {
+			target[key] = &RateCounts{}
+		}
+		target[key].Add(counts)
+	}
+}
+
+func (rs *RateStats) incr(req *ParsedRequest, record *Inventory, counts RateCounts) {
+	country := record.Country
+	if req.IpLib != nil && req.IpLib.CountryCode != "" {
+		country = req.IpLib.CountryCode
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for _, key := range []string{
+		RateKey(record.PackageName, country, req.PlacementId),
+		RateKey(record.PackageName, country, AllPlacements),
+	} {
+		if _, ok := rs.deltas[key]; !ok {
+			rs.deltas[key] = &RateCounts{}
+		}
+		rs.deltas[key].Add(&counts)
+	}
+}
+
+func (rs *RateStats) OnImpression(req *ParsedRequest, record *Inventory) {
+	rs.incr(req, record, RateCounts{Impressions: 1})
+}
+
+func (rs *RateStats) OnClick(req *ParsedRequest, record *Inventory) {
+	rs.incr(req, record, RateCounts{Clicks: 1})
+}
+
+func (rs *RateStats) OnConversion(req *ParsedRequest, record *Inventory) {
+	rs.incr(req, record, RateCounts{Conversions: 1})
+}
+
+// 窗口内合计加上尚未同步的增量
+func (rs *RateStats) Counts(key string) RateCounts {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	counts := RateCounts{}
+	for _, source := range []map[string]*RateCounts{rs.totals, rs.written, rs.deltas} {
+		if value, ok := source[key]; ok {
+			counts.Add(value)
+		}
+	}
+	return counts
+}
+
+// 贝叶斯平滑，先验均值为DefaultCtr/DefaultCvr，强度为RatePriorWeight
+func (rs *RateStats) Smooth(counts RateCounts) (ctr float64, cvr float64) {
+	weight := rs.configure.RatePriorWeight
+	ctr = (float64(counts.Clicks) + rs.configure.DefaultCtr*weight) / (float64(counts.Impressions) + weight)
+	cvr = (float64(counts.Conversions) + rs.configure.DefaultCvr*weight) / (float64(counts.Clicks) + weight)
+	return
+}
+
+func (rs *RateStats) Rates(packageName string, country string, placementId string) (float64, float64) {
+	return rs.Smooth(rs.Counts(RateKey(packageName, country, placementId)))
+}
+
+// 排序发生在加载时，拿不到广告位，用所有广告位的汇总
+func (rs *RateStats) Estimate(record *Inventory) (float64, float64) {
+	return rs.Rates(record.PackageName, record.Country, AllPlacements)
+}
+
+// 写和读分开：只有写失败时增量放回去重试，写成功后读失败不能再写一次
+func (rs *RateStats) Sync() error {
+	now := time.Now()
+	rs.lock.Lock()
+	deltas := rs.deltas
+	rs.deltas = make(map[string]*RateCounts)
+	rs.lock.Unlock()
+
+	if err := rs.store.WriteRates(deltas, now, rs.configure.RateWindowDays); err != nil {
+		// 增量放回去，下次再写
+		rs.lock.Lock()
+		mergeRateCounts(rs.deltas, deltas)
+		rs.lock.Unlock()
+		return err
+	}
+
+	rs.lock.Lock()
+	mergeRateCounts(rs.written, deltas)
+	written := rs.written
+	rs.written = make(map[string]*RateCounts)
+	seen := make(map[string]bool, len(rs.totals)+len(written))
+	for key := range rs.totals {
+		seen[key] = true
+	}
+	for key := range written {
+		seen[key] = true
+	}
+	keySource := rs.keySource
+	rs.lock.Unlock()
+	if keySource != nil {
+		for _, key := range keySource() {
+			seen[key] = true
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+
+	totals, err := rs.store.ReadRates(keys, now, rs.configure.RateWindowDays)
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if err != nil {
+		// 旧的合计加上已写入的增量先顶着，下次读回来再替换
+		mergeRateCounts(rs.written, written)
+		return err
+	}
+	rs.totals = totals
+	return nil
+}
+
+// onSync在每次同步成功后调用，ecpm排序时用来按新的统计重新排序
+func (rs *RateStats) SyncLoop(onSync func()) {
+	interval := time.Duration(rs.configure.RateSyncInterval) * time.Second
+	timer := time.NewTimer(interval)
+	for range timer.C {
+		if err := rs.Sync(); err != nil {
+			rs.logger.Warning("fail to sync rate stats: %v", err.Error())
+		} else if onSync != nil {
+			onSync()
+		}
+		timer.Reset(interval)
+	}
+}
+
+type RateEntry struct {
+	Package   string `json:"package"`
+	Country   string `json:"country"`
+	Placement string `json:"placement"`
+	RateCounts
+	Ctr float64 `json:"ctr"`
+	Cvr float64 `json:"cvr"`
+}
+
+// 按条件筛选的统计，条件为空表示不限
+func (rs *RateStats) Entries(packageName string, country string, placementId string) []*RateEntry {
+	rs.lock.Lock()
+	keys := make(map[string]bool)
+	for key := range rs.totals {
+		keys[key] = true
+	}
+	for key := range rs.written {
+		keys[key] = true
+	}
+	for key := range rs.deltas {
+		keys[key] = true
+	}
+	rs.lock.Unlock()
+
+	entries := make([]*RateEntry, 0)
+	for key := range keys {
+		fields := strings.SplitN(key, "|", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if (packageName != "" && fields[0] != packageName) ||
+			(country != "" && fields[1] != country) ||
+			(placementId != "" && fields[2] != placementId) {
+			continue
+		}
+		counts := rs.Counts(key)
+		ctr, cvr := rs.Smooth(counts)
+		entries = append(entries, &RateEntry{
+			Package:    fields[0],
+			Country:    fields[1],
+			Placement:  fields[2],
+			RateCounts: counts,
+			Ctr:        ctr,
+			Cvr:        cvr,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Impressions > entries[j].Impressions
+	})
+	return entries
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// 内存中的rateStore，可以指定下一次读写失败
+type fakeRateStore struct {
+	stored    map[string]*RateCounts
+	writes    int
+	failWrite bool
+	failRead  bool
+}
+
+func newFakeRateStore() *fakeRateStore {
+	return &fakeRateStore{stored: make(map[string]*RateCounts)}
+}
+
+func (s *fakeRateStore) WriteRates(deltas map[string]*RateCounts, now time.Time, windowDays int) error {
+	if s.failWrite {
+		s.failWrite = false
+		return errors.New("write failed")
+	}
+	s.writes += 1
+	mergeRateCounts(s.stored, deltas)
+	return nil
+}
+
+func (s *fakeRateStore) ReadRates(keys []string, now time.Time, windowDays int) (map[string]*RateCounts, error) {
+	if s.failRead {
+		s.failRead = false
+		return nil, errors.New("read failed")
+	}
+	totals := make(map[string]*RateCounts)
+	for _, key := range keys {
+		if counts, ok := s.stored[key]; ok {
+			copied := *counts
+			totals[key] = &copied
+		}
+	}
+	return totals, nil
+}
+
+func TestRateStatsSync(t *testing.T) {
+	cases := []struct {
+		name      string
+		failWrite bool
+		failRead  bool
+	}{
+		{"ok", false, false},
+		{"write fails", true, false},
+		{"read fails after write", false, true},
+	}
+	record := &Inventory{PackageName: "a", Country: "US"}
+	request := &ParsedRequest{PlacementId: "p1", IpLib: &IpLib{CountryCode: "BR"}}
+	key := RateKey("a", "BR", "p1")
+	for _, c := range cases {
+		store := newFakeRateStore()
+		stats := newRateStats(NewConfigure(), store, testLogger)
+		stats.OnImpression(request, record)
+		stats.OnImpression(request, record)
+		stats.OnClick(request, record)
+
+		store.failWrite, store.failRead = c.failWrite, c.failRead
+		err := stats.Sync()
+		if (err != nil) != (c.failWrite || c.failRead) {
+			t.Errorf("%v: first Sync err = %v", c.name, err)
+		}
+		// 失败之后本地看到的计数不变
+		if counts := stats.Counts(key); counts.Impressions != 2 || counts.Clicks != 1 {
+			t.Errorf("%v: Counts after first sync = %+v", c.name, counts)
+		}
+		if err := stats.Sync(); err != nil {
+			t.Fatalf("%v: second Sync err = %v", c.name, err)
+		}
+		// 每个增量只写一次
+		if stored := store.stored[key]; stored == nil || stored.Impressions != 2 || stored.Clicks != 1 {
+			t.Errorf("%v: stored = %+v", c.name, stored)
+		}
+		if counts := stats.Counts(key); counts.Impressions != 2 || counts.Clicks != 1 {
+			t.Errorf("%v: Counts = %+v", c.name, counts)
+		}
+		if all := stats.Counts(RateKey("a", "BR", AllPlacements)); all.Impressions != 2 {
+			t.Errorf("%v: all placements = %+v", c.name, all)
+		}
+	}
+}
+
+func TestRateStatsSmooth(t *testing.T) {
+	configure := NewConfigure()
+	configure.DefaultCtr, configure.DefaultCvr, configure.RatePriorWeight = 0.01, 0.1, 100
+	stats := newRateStats(configure, newFakeRateStore(), testLogger)
+	cases := []struct {
+		counts   RateCounts
+		ctr, cvr float64
+	}{
+		{RateCounts{}, 0.01, 0.1},
+		{RateCounts{Impressions: 100, Clicks: 3}, 4.0 / 200, 10.0 / 103},
+		{RateCounts{Impressions: 1000000, Clicks: 50000, Conversions: 500}, 50001.0 / 1000100, 510.0 / 50100},
+	}
+	for _, c := range cases {
+		ctr, cvr := stats.Smooth(c.counts)
+		if math.Abs(ctr-c.ctr) > 1e-12 || math.Abs(cvr-c.cvr) > 1e-12 {
+			t.Errorf("Smooth(%+v) = %v, %v, want %v, %v", c.counts, ctr, cvr, c.ctr, c.cvr)
+		}
+	}
+}
+
+func TestInventoryResortOnRateSync(t *testing.T) {
+	a := testRecord(1, "a", "US", "1")
+	b := testRecord(2, "b", "US", "1")
+	cache, _ := newTestInventoryCache(t, []*Inventory{a, b}, nil)
+	store := newFakeRateStore()
+	stats := newRateStats(cache.configure, store, testLogger)
+	cache.estimator = stats
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		stats.OnImpression(&ParsedRequest{IpLib: &IpLib{CountryCode: "US"}}, b)
+		if i < 100 {
+			stats.OnClick(&ParsedRequest{IpLib: &IpLib{CountryCode: "US"}}, b)
+		}
+	}
+	if err := stats.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	before := cache.Snapshot()
+	cache.Resort()
+	after := cache.Snapshot()
+	us, _ := after.Country("US")
+	if after.Version != before.Version+1 || !equalStrings(collectionPackages(us), []string{"b", "a"}) {
+		t.Errorf("version %v, US = %v", after.Version, collectionPackages(us))
+	}
+	if len(after.ByAdId) != 2 {
+		t.Errorf("ByAdId = %v", after.ByAdId)
+	}
+}
+
+func TestRateStatsReadsOtherInstances(t *testing.T) {
+	a := testRecord(1, "a", "US", "1")
+	b := testRecord(2, "b", "US", "1")
+	cache, _ := newTestInventoryCache(t, []*Inventory{a, b}, nil)
+	if err := cache.Load(); err != nil {
+		t.Fatal(err)
+	}
+	store := newFakeRateStore()
+	other := newRateStats(NewConfigure(), store, testLogger)
+	for i := 0; i < 10; i++ {
+		other.OnImpression(&ParsedRequest{PlacementId: "p1", IpLib: &IpLib{CountryCode: "US"}}, b)
+	}
+	if err := other.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		keySource   func() []string
+		impressions int64
+	}{
+		{"no key source", nil, 0},
+		{"inventory keys", cache.RateKeys, 10},
+	}
+	for _, c := range cases {
+		// 新进程没有投放过b，也要读到其他机器的统计
+		stats := newRateStats(NewConfigure(), store, testLogger)
+		stats.SetKeySource(c.keySource)
+		if err := stats.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if counts := stats.Counts(RateKey("b", "US", AllPlacements)); counts.Impressions != c.impressions {
+			t.Errorf("%v: counts = %+v", c.name, counts)
+		}
+	}
+	if keys := cache.RateKeys(); len(keys) != 2 {
+		t.Errorf("RateKeys = %v", keys)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+)
+
+// 物料定向规则，每一项为空表示不限
+type TargetingRule struct {
+	Carriers      []string `json:"carriers"`      // mcc+mnc，如72402
+	Languages     []string `json:"languages"`     // 如pt匹配pt_BR，pt_BR只匹配pt_BR
+	Networks      []int    `json:"networks"`      // connection_type
+	Regions       []string `json:"regions"`       // 国家|省，如BR|27
+	Cities        []string `json:"cities"`        // 国家|省|市
+	HostPackages  []string `json:"host_packages"` // hp
+	MinAppVersion string   `json:"min_app_version"`
+	MaxAppVersion string   `json:"max_app_version"`
+
+	carriers         map[string]bool
+	networks         map[int]bool
+	regions          map[int]bool
+	cities           map[int]bool
+	hostPackages     map[string]bool
+	minAppVersionNum int
+	maxAppVersionNum int
+}
+
+// 加载时调用一次，把列表转成查找表
+func (t *TargetingRule) prepare() {
+	toSet := func(values []string) map[string]bool {
+		if len(values) == 0 {
+			return nil
+		}
+		set := make(map[string]bool)
+		for _, value := range values {
+			set[strings.TrimSpace(value)] = true
+		}
+		return set
+	}
+	toHashSet := func(values []string) map[int]bool {
+		if len(values) == 0 {
+			return nil
+		}
+		set := make(map[int]bool)
+		for _, value := range values {
+			set[HiveHash(strings.TrimSpace(value))] = true
+		}
+		return set
+	}
+	t.carriers = toSet(t.Carriers)
+	t.hostPackages = toSet(t.HostPackages)
+	t.regions = toHashSet(t.Regions)
+	t.cities = toHashSet(t.Cities)
+	if len(t.Networks) > 0 {
+		t.networks = make(map[int]bool)
+		for _, network := range t.Networks {
+			t.networks[network] = true
+		}
+	}
+	if t.MinAppVersion != "" {
+		t.minAppVersionNum = VersionToInt(t.MinAppVersion)
+	}
+	if t.MaxAppVersion != "" {
+		t.maxAppVersionNum = VersionToInt(t.MaxAppVersion)
+	}
+}
+
+func (t *TargetingRule) Match(req *ParsedRequest) bool {
+	if t == nil {
+		return true
+	}
+	if t.carriers != nil {
+		matched := false
+		for _, carrier := range strings.Split(req.M, ",") {
+			if t.carriers[strings.TrimSpace(carrier)] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(t.Languages) > 0 && !matchLanguage(t.Languages, req.L) {
+		return false
+	}
+	if t.networks != nil && !t.networks[req.Network] {
+		return false
+	}
+	if t.regions != nil && (req.IpLib == nil || !t.regions[req.IpLib.IpHashLevel2]) {
+		return false
+	}
+	if t.cities != nil && (req.IpLib == nil || !t.cities[req.IpLib.IpHashLevel3]) {
+		return false
+	}
+	if t.hostPackages != nil && !t.hostPackages[req.Hp] {
+		return false
+	}
+	if t.minAppVersionNum > 0 || t.maxAppVersionNum > 0 {
+		if req.ClientVersion == "" {
+			return false
+		}
+		appVersion := VersionToInt(req.ClientVersion)
+		if t.minAppVersionNum > 0 && appVersion < t.minAppVersionNum {
+			return false
+		}
+		if t.maxAppVersionNum > 0 && appVersion > t.maxAppVersionNum {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeLanguage(language string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(language), "-", "_", -1))
+}
+
+func matchLanguage(languages []string, language string) bool {
+	language = normalizeLanguage(language)
+	for _, value := range languages {
+		value = normalizeLanguage(value)
+		if value == language || strings.HasPrefix(language, value+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// 系统版本和定向规则都满足才可以投放
+func (record *Inventory) Eligible(req *ParsedRequest) bool {
+	if req.OsVersionNum < record.MinOsNum || req.OsVersionNum > record.MaxOsNum {
+		return false
+	}
+	return record.Targeting.Match(req)
+}
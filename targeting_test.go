@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func preparedRule(rule *TargetingRule) *TargetingRule {
+	rule.prepare()
+	return rule
+}
+
+func TestTargetingRuleMatch(t *testing.T) {
+	ipLib := &IpLib{IpHashLevel2: HiveHash("BR|27"), IpHashLevel3: HiveHash("BR|27|1")}
+	request := &ParsedRequest{M: "72402, 72403", L: "pt_BR", Network: 2, IpLib: ipLib, Hp: "com.host", ClientVersion: "1.5.0"}
+	cases := []struct {
+		name    string
+		rule    *TargetingRule
+		request *ParsedRequest
+		want    bool
+	}{
+		{"nil rule", nil, request, true},
+		{"empty rule", &TargetingRule{}, request, true},
+		{"carrier in list", &TargetingRule{Carriers: []string{"72403"}}, request, true},
+		{"carrier not in list", &TargetingRule{Carriers: []string{"72411"}}, request, false},
+		{"language prefix", &TargetingRule{Languages: []string{"pt"}}, request, true},
+		{"language exact", &TargetingRule{Languages: []string{"pt-br"}}, request, true},
+		{"language other", &TargetingRule{Languages: []string{"en"}}, request, false},
+		{"language longer than request", &TargetingRule{Languages: []string{"pt_BR"}}, &ParsedRequest{L: "pt"}, false},
+		{"network", &TargetingRule{Networks: []int{1, 2}}, request, true},
+		{"network mismatch", &TargetingRule{Networks: []int{1}}, request, false},
+		{"region", &TargetingRule{Regions: []string{" BR|27 "}}, request, true},
+		{"region mismatch", &TargetingRule{Regions: []string{"BR|26"}}, request, false},
+		{"region without ip lib", &TargetingRule{Regions: []string{"BR|27"}}, &ParsedRequest{}, false},
+		{"city", &TargetingRule{Cities: []string{"BR|27|1"}}, request, true},
+		{"host package", &TargetingRule{HostPackages: []string{"com.other"}}, request, false},
+		{"app version in range", &TargetingRule{MinAppVersion: "1.0", MaxAppVersion: "2.0"}, request, true},
+		{"app version too low", &TargetingRule{MinAppVersion: "1.6"}, request, false},
+		{"app version too high", &TargetingRule{MaxAppVersion: "1.4.9"}, request, false},
+		{"app version missing", &TargetingRule{MinAppVersion: "1.0"}, &ParsedRequest{}, false},
+	}
+	for _, c := range cases {
+		rule := c.rule
+		if rule != nil {
+			rule = preparedRule(rule)
+		}
+		if got := rule.Match(c.request); got != c.want {
+			t.Errorf("%v: Match = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestInventoryEligible(t *testing.T) {
+	record := &Inventory{MinOsNum: 40000, MaxOsNum: 60000, Targeting: preparedRule(&TargetingRule{Networks: []int{2}})}
+	cases := []struct {
+		osVersionNum int
+		network      int
+		want         bool
+	}{
+		{40000, 2, true},
+		{60000, 2, true},
+		{39999, 2, false},
+		{60001, 2, false},
+		{50000, 1, false},
+	}
+	for _, c := range cases {
+		request := &ParsedRequest{OsVersionNum: c.osVersionNum, Network: c.network}
+		if got := record.Eligible(request); got != c.want {
+			t.Errorf("Eligible(%v, %v) = %v, want %v", c.osVersionNum, c.network, got, c.want)
+		}
+	}
+}
+
+func TestInventoryPrepare(t *testing.T) {
+	cases := []struct {
+		name          string
+		extension     string
+		price         string
+		ok            bool
+		wantTargeting bool
+	}{
+		{"empty", "", "1000000", true, false},
+		{"targeting", `{"targeting": {"networks": [1]}}`, "1000000", true, true},
+		{"not json", "free text", "1000000", true, false},
+		{"wrong type", `{"targeting": 1}`, "1000000", true, false},
+		{"bad price", "", "abc", false, false},
+		{"bad bid type", `{"bid_type": "cpx"}`, "1000000", false, false},
+		{"no exchange rate", `{"currency": "JPY"}`, "1000000", false, false},
+	}
+	for _, c := range cases {
+		record := &Inventory{Id: 1, Extension: c.extension, Price: c.price}
+		err := record.Prepare(nil, testLogger)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: Prepare err = %v", c.name, err)
+			continue
+		}
+		if c.ok && (record.Targeting != nil) != c.wantTargeting {
+			t.Errorf("%v: Targeting = %+v", c.name, record.Targeting)
+		}
+	}
+}
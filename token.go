@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 加密token的前缀，base64url里没有"."，和旧的"request_id-index"格式不会混淆
+const trackingTokenPrefix = "t."
+
+// 事件回调需要的请求信息，json字段尽量短。
+// 除了归因用到的字段，还带上特征抽取、kafka和model.save用到的请求字段，
+// 在线训练和离线导出得到的特征与redis关联时一致
+type TrackingToken struct {
+	RequestId   string  `json:"r"`
+	Index       int     `json:"i"`
+	AdId        int     `json:"a"`
+	PlacementId string  `json:"p,omitempty"`
+	Country     string  `json:"c,omitempty"`
+	Cid         string  `json:"u,omitempty"`
+	Adgroup     string  `json:"g,omitempty"`
+	Propensity  float64 `json:"w,omitempty"`
+	IssuedAt    int64   `json:"t"`
+
+	IpHashLevel2  int    `json:"i2,omitempty"`
+	IpHashLevel3  int    `json:"i3,omitempty"`
+	OsVersion     string `json:"o,omitempty"`
+	ClientVersion string `json:"v,omitempty"`
+	Network       int    `json:"n,omitempty"`
+	Carrier       string `json:"m,omitempty"`
+	Language      string `json:"l,omitempty"`
+	Hp            string `json:"h,omitempty"`
+	Cc            string `json:"cc,omitempty"` // 客户端传的cc参数，和按ip查到的Country不是一回事
+	Experiments   string `json:"e,omitempty"`
+	UserPackage   string `json:"up,omitempty"`
+	UserCategory  string `json:"uc,omitempty"`
+
+	// 旧格式只有RequestId和Index，需要到redis关联
+	stateless bool
+}
+
+func NewTrackingToken(parsed *ParsedRequest, index int, record *Inventory) *TrackingToken {
+	token := &TrackingToken{
+		RequestId:   parsed.Id,
+		Index:       index,
+		AdId:        record.AdId,
+		PlacementId: parsed.PlacementId,
+		Cid:         parsed.Cid,
+		Adgroup:     parsed.Adgroup,
+		Propensity:  record.Propensity,
+		IssuedAt:    time.Now().Unix(),
+
+		OsVersion:     parsed.OsVersion,
+		ClientVersion: parsed.ClientVersion,
+		Network:       parsed.Network,
+		Carrier:       parsed.M,
+		Language:      parsed.L,
+		Hp:            parsed.Hp,
+		Cc:            parsed.Cc,
+		Experiments:   parsed.Experiments,
+	}
+	if parsed.IpLib != nil {
+		token.Country = parsed.IpLib.CountryCode
+		token.IpHashLevel2 = parsed.IpLib.IpHashLevel2
+		token.IpHashLevel3 = parsed.IpLib.IpHashLevel3
+	}
+	if parsed.Profile != nil {
+		token.UserPackage = parsed.Profile.PackageState(record.PackageName)
+		token.UserCategory = parsed.Profile.CategoryState(record.Category)
+	}
+	return token
+}
+
+// 还原出事件处理用到的那部分请求，Creatives只填到Index为止。
+// ip、limit和候选包名等不参与特征的字段不带，model.save中为空
+func (token *TrackingToken) Request() *ParsedRequest {
+	creatives := make([]*InventoryForRedis, token.Index+1)
+	for index := range creatives {
+		creatives[index] = &InventoryForRedis{Position: index}
+	}
+	creatives[token.Index].AdId = token.AdId
+	creatives[token.Index].Propensity = token.Propensity
+	creatives[token.Index].UserPackage = token.UserPackage
+	creatives[token.Index].UserCategory = token.UserCategory
+	return &ParsedRequest{
+		Id:            token.RequestId,
+		PlacementId:   token.PlacementId,
+		Cc:            token.Cc,
+		Cid:           token.Cid,
+		Adgroup:       token.Adgroup,
+		OsVersion:     token.OsVersion,
+		OsVersionNum:  VersionToInt(token.OsVersion),
+		ClientVersion: token.ClientVersion,
+		Network:       token.Network,
+		M:             token.Carrier,
+		L:             token.Language,
+		Hp:            token.Hp,
+		Experiments:   token.Experiments,
+		IpLib: &IpLib{
+			CountryCode:  token.Country,
+			IpHashLevel2: token.IpHashLevel2,
+			IpHashLevel3: token.IpHashLevel3,
+		},
+		Creatives: creatives,
+	}
+}
+
+type TrackingTokenCodec struct {
+	aead cipher.AEAD
+}
+
+// key为16、24或32字节的hex编码，对应AES-128/192/256
+func NewTrackingTokenCodec(key string) (*TrackingTokenCodec, error) {
+	secret, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracking token key: %v", err.Error())
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TrackingTokenCodec{aead: aead}, nil
+}
+
+// nonce放在密文前面一起编码
+func (codec *TrackingTokenCodec) Encode(token *TrackingToken) (string, error) {
+	plain, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, codec.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := codec.aead.Seal(nonce, nonce, plain, nil)
+	return trackingTokenPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (codec *TrackingTokenCodec) Decode(param string) (*TrackingToken, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(param, trackingTokenPrefix))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := codec.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("tracking token too short")
+	}
+	plain, err := codec.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+	token := &TrackingToken{}
+	if err := json.Unmarshal(plain, token); err != nil {
+		return nil, err
+	}
+	if token.Index < 0 {
+		return nil, errors.New("invalid creative index in tracking token")
+	}
+	token.stateless = true
+	return token, nil
+}
+
+// 开启token时跟踪链接带加密token，否则沿用"request_id-index"
+func (rl *RtbLite) TrackingParam(parsed *ParsedRequest, index int, record *Inventory) string {
+	if rl.tokens != nil {
+		if param, err := rl.tokens.Encode(NewTrackingToken(parsed, index, record)); err == nil {
+			return param
+		} else {
+			rl.logger.Warning("fail to encode tracking token: %v", err.Error())
+		}
+	}
+	return fmt.Sprintf("%v-%v", parsed.Id, index)
+}
+
+// 两种格式都接受，切换期间已经发出去的链接仍然有效
+func (rl *RtbLite) DecodeParam(param string) (*TrackingToken, error) {
+	if strings.HasPrefix(param, trackingTokenPrefix) {
+		if rl.tokens == nil {
+			return nil, errors.New("tracking token disabled")
+		}
+		return rl.tokens.Decode(param)
+	}
+	id, index, err := SplitId(param)
+	if err != nil {
+		return nil, err
+	}
+	return &TrackingToken{RequestId: id, Index: index}, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testTokenKey = "000102030405060708090a0b0c0d0e0f"
+
+func TestNewTrackingTokenCodec(t *testing.T) {
+	cases := []struct {
+		key string
+		ok  bool
+	}{
+		{testTokenKey, true},
+		{testTokenKey + "0001020304050607", true},
+		{testTokenKey + testTokenKey, true},
+		{"0001", false},
+		{"not hex", false},
+	}
+	for _, c := range cases {
+		if _, err := NewTrackingTokenCodec(c.key); (err == nil) != c.ok {
+			t.Errorf("NewTrackingTokenCodec(%q) err = %v", c.key, err)
+		}
+	}
+}
+
+func TestTrackingTokenRoundTrip(t *testing.T) {
+	codec, err := NewTrackingTokenCodec(testTokenKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewTrackingTokenCodec(strings.Repeat("ff", 16))
+	token := &TrackingToken{RequestId: "r", Index: 2, AdId: 7, PlacementId: "p", Country: "BR", Propensity: 0.25, Carrier: "72402"}
+	param, err := codec.Encode(token)
+	if err != nil || !strings.HasPrefix(param, trackingTokenPrefix) {
+		t.Fatalf("Encode = %v, %v", param, err)
+	}
+	decoded, err := codec.Decode(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.stateless || decoded.RequestId != "r" || decoded.Index != 2 || decoded.AdId != 7 ||
+		decoded.Propensity != 0.25 || decoded.Carrier != "72402" {
+		t.Errorf("decoded = %+v", decoded)
+	}
+
+	tampered := []byte(param)
+	tampered[len(tampered)-3] ^= 1
+	negative, _ := codec.Encode(&TrackingToken{RequestId: "r", Index: -1})
+	cases := []struct {
+		name  string
+		codec *TrackingTokenCodec
+		param string
+	}{
+		{"tampered", codec, string(tampered)},
+		{"other key", other, param},
+		{"short", codec, trackingTokenPrefix + "AAAA"},
+		{"not base64", codec, trackingTokenPrefix + "!!"},
+		{"negative index", codec, negative},
+	}
+	for _, c := range cases {
+		if _, err := c.codec.Decode(c.param); err == nil {
+			t.Errorf("%v: decoded", c.name)
+		}
+	}
+}
+
+func TestDecodeParam(t *testing.T) {
+	codec, _ := NewTrackingTokenCodec(testTokenKey)
+	param, _ := codec.Encode(&TrackingToken{RequestId: "r", Index: 1})
+	cases := []struct {
+		name      string
+		tokens    *TrackingTokenCodec
+		param     string
+		requestId string
+		index     int
+		stateless bool
+		ok        bool
+	}{
+		{"legacy", nil, "abc-3", "abc", 3, false, true},
+		{"legacy with tokens", codec, "abc-3", "abc", 3, false, true},
+		{"token", codec, param, "r", 1, true, true},
+		{"token disabled", nil, param, "", 0, false, false},
+		{"malformed", nil, "abc", "", 0, false, false},
+	}
+	for _, c := range cases {
+		rl := &RtbLite{tokens: c.tokens}
+		token, err := rl.DecodeParam(c.param)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+			continue
+		}
+		if c.ok && (token.RequestId != c.requestId || token.Index != c.index || token.stateless != c.stateless) {
+			t.Errorf("%v: token = %+v", c.name, token)
+		}
+	}
+}
+
+// 用token还原的请求训练时，特征和选择时一致
+func TestTrackingTokenFeatures(t *testing.T) {
+	names := append(append(append([]string{}, requestFeatureNames...), creativeFeatureNames...), userFeatureNames...)
+	extractor, err := NewFeatureExtractor(names, DefaultFeatureCrosses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := &ParsedRequest{
+		Id: "r", PlacementId: "p1", OsVersion: "4.4", ClientVersion: "134", Network: 9, M: "72402,72403",
+		L: "pt_BR", Hp: "com.host", Experiments: "strategy:random", Cid: "u", Cc: "us",
+		IpLib:   &IpLib{CountryCode: "BR", IpHashLevel2: 3, IpHashLevel3: 4},
+		Profile: NewUserProfileFromStates("b", "seen", "game", "engaged"),
+	}
+	records := []*Inventory{{AdId: 1, PackageName: "a"}, {AdId: 2, PackageName: "b", Category: "game", ModelSign1: 7, AdType: "big"}}
+	online := extractor.Extract(parsed, records[1])
+
+	codec, _ := NewTrackingTokenCodec(testTokenKey)
+	param, err := codec.Encode(NewTrackingToken(parsed, 1, records[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := codec.Decode(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := token.Request()
+	// cc是客户端参数，和ip查到的国家分开保存，与redis关联时model.save中的值一致
+	if len(req.Creatives) != 2 || req.Creatives[1].AdId != 2 || req.Experiments != parsed.Experiments || req.Cid != "u" ||
+		req.Cc != "us" || req.IpLib.CountryCode != "BR" {
+		t.Errorf("request = %+v", req)
+	}
+	featureRequest := *req
+	featureRequest.Profile = req.ProfileAt(1, records[1])
+	if joined := extractor.Extract(&featureRequest, records[1]); !equalInts(joined, online) {
+		t.Errorf("features from token %v, online %v", joined, online)
+	}
+}
@@ -37,11 +37,7 @@ func VersionToInt(versionString string) int {
 
 func GetParam(index int, req *ParsedRequest, record *Inventory) string {
 	param := ""
-	price, err := strconv.ParseFloat(record.Price, 64)
-	if err != nil {
-		price = 0
-	}
-	price /= 1e6
+	price := float64(record.Bid.Micros) / 1e6
 
 	if strings.ToLower(record.AdType) == "bigtree6" {
 		param = fmt.Sprintf("5_2_%v_%v_%v_%v_%v_%v_%v_%v-%v",
@@ -99,6 +95,9 @@ func NanIfEmpty(value string) string {
 
 func SplitId(param string) (string, int, error) {
 	splited := strings.Split(param, "-")
+	if len(splited) < 2 {
+		return "", 0, fmt.Errorf("invalid param: %v", param)
+	}
 	id, index := splited[0], splited[1]
 	creativeIndex, err := strconv.Atoi(index)
 	return id, creativeIndex, err
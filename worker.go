@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// 溢出策略
+const (
+	OverflowDrop  = "drop"
+	OverflowBlock = "block"
+	OverflowSpill = "spill"
+)
+
+// 响应之后的异步任务，能序列化，溢出时可以落盘之后再重放
+type AsyncTask struct {
+	Event   string         `json:"event"`
+	Param   string         `json:"param,omitempty"`
+	Price   float64        `json:"price,omitempty"`
+	Reason  string         `json:"reason,omitempty"`
+	Request *ParsedRequest `json:"request,omitempty"`
+	Time    time.Time      `json:"time"`
+}
+
+// 单个事件类型的配置，没有配置的项使用AsyncWorkers、AsyncQueueSize、AsyncOverflow。
+// 数值用指针区分没有配置和配置成0，queue_size为0表示不排队
+type WorkerPoolConfig struct {
+	Workers   *int   `json:"workers"`
+	QueueSize *int   `json:"queue_size"`
+	Overflow  string `json:"overflow"`
+}
+
+// 没有在AsyncPools中配置溢出策略时，按事件使用的默认值。
+// 请求丢了之后它的事件都关联不上，所以请求默认落盘而不是丢弃
+var defaultPoolOverflow = map[string]string{
+	"request": OverflowSpill,
+}
+
+// 落盘任务的最大长度，超过的不落盘，重放时遇到也跳过
+const maxSpillLine = 16 * 1024 * 1024
+
+var errSpillLineTooLong = errors.New("spilled task too long")
+
+// 重放时每处理这么多任务记一次进度，重放中途退出时最多重复处理这么多
+const replayCheckpoint = 100
+
+type WorkerPool struct {
+	event    string
+	workers  int
+	overflow string
+	queue    chan *AsyncTask
+	handle   func(task *AsyncTask)
+
+	spillFile string
+	spillLock sync.Mutex
+
+	dropped  int64
+	spilled  int64
+	blocked  int64
+	replayed int64
+	panics   int64
+
+	logger *logging.Logger
+}
+
+type WorkerPoolStatus struct {
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Workers  int    `json:"workers"`
+	Overflow string `json:"overflow"`
+	Dropped  int64  `json:"dropped"`
+	Spilled  int64  `json:"spilled"`
+	Blocked  int64  `json:"blocked"`
+	Replayed int64  `json:"replayed"`
+	Panics   int64  `json:"panics"`
+}
+
+func checkOverflow(overflow string) error {
+	switch overflow {
+	case OverflowDrop, OverflowBlock, OverflowSpill:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy: %v", overflow)
+}
+
+func NewWorkerPool(event string, workers int, queueSize int, overflow string, spillDir string, handle func(task *AsyncTask), logger *logging.Logger) (*WorkerPool, error) {
+	if err := checkOverflow(overflow); err != nil {
+		return nil, err
+	}
+	if workers <= 0 || queueSize < 0 {
+		return nil, fmt.Errorf("invalid worker pool config for %v", event)
+	}
+	return &WorkerPool{
+		event:     event,
+		workers:   workers,
+		overflow:  overflow,
+		queue:     make(chan *AsyncTask, queueSize),
+		handle:    handle,
+		spillFile: path.Join(spillDir, event+".spill"),
+		logger:    logger,
+	}, nil
+}
+
+func (p *WorkerPool) Submit(task *AsyncTask) {
+	select {
+	case p.queue <- task:
+		return
+	default:
+	}
+	switch p.overflow {
+	case OverflowBlock:
+		atomic.AddInt64(&p.blocked, 1)
+		p.queue <- task
+	case OverflowSpill:
+		if err := p.spill(task); err != nil {
+			atomic.AddInt64(&p.dropped, 1)
+			p.logger.Warning("fail to spill %v task, dropped: %v", p.event, err.Error())
+			return
+		}
+		atomic.AddInt64(&p.spilled, 1)
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+	}
+}
+
+func (p *WorkerPool) spill(task *AsyncTask) error {
+	line, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	if len(line) > maxSpillLine {
+		return errSpillLineTooLong
+	}
+	p.spillLock.Lock()
+	defer p.spillLock.Unlock()
+	f, err := os.OpenFile(p.spillFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 队列降到一半以下时把落盘的任务读回来，读回时队列满了就等。
+// 读到的位置每replayCheckpoint个任务写到.offset文件，重放中途退出后从记下的位置继续
+func (p *WorkerPool) replay() {
+	if len(p.queue) > cap(p.queue)/2 {
+		return
+	}
+	replaying := p.spillFile + ".replaying"
+	offsetFile := replaying + ".offset"
+	p.spillLock.Lock()
+	// 上次没有重放完的优先
+	if _, err := os.Stat(replaying); os.IsNotExist(err) {
+		if err := os.Rename(p.spillFile, replaying); err != nil {
+			p.spillLock.Unlock()
+			if !os.IsNotExist(err) {
+				p.logger.Warning("fail to rotate spill file: %v", err.Error())
+			}
+			return
+		}
+		os.Remove(offsetFile)
+	}
+	p.spillLock.Unlock()
+	f, err := os.Open(replaying)
+	if err != nil {
+		p.logger.Warning("fail to open spill file: %v", err.Error())
+		return
+	}
+	defer f.Close()
+	offset := readReplayOffset(offsetFile)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		p.logger.Warning("fail to seek spill file: %v", err.Error())
+		return
+	}
+	reader := bufio.NewReaderSize(f, 64*1024)
+	count := 0
+	for {
+		line, n, err := readSpillLine(reader, maxSpillLine)
+		offset += n
+		if err == errSpillLineTooLong {
+			// 跳过这一行继续，不能让后面的任务一直卡在这里
+			p.logger.Warning("oversized spilled %v task skipped, %v bytes", p.event, n)
+		} else if len(line) > 0 {
+			task := &AsyncTask{}
+			if jsonErr := json.Unmarshal(line, task); jsonErr != nil {
+				p.logger.Warning("invalid spilled %v task: %v", p.event, jsonErr.Error())
+			} else {
+				p.queue <- task
+				atomic.AddInt64(&p.replayed, 1)
+				if count += 1; count%replayCheckpoint == 0 {
+					if err := writeReplayOffset(offsetFile, offset); err != nil {
+						p.logger.Warning("fail to save replay offset: %v", err.Error())
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != errSpillLineTooLong {
+			p.logger.Warning("fail to read spill file: %v", err.Error())
+			writeReplayOffset(offsetFile, offset)
+			return
+		}
+	}
+	// 先删进度，中途退出最多重放整个文件，不会用旧的进度跳过新文件的内容
+	os.Remove(offsetFile)
+	os.Remove(replaying)
+}
+
+// 读一行，不含换行符，n为读过的字节数。超过maxLine的行读完丢弃，返回errSpillLineTooLong
+func readSpillLine(reader *bufio.Reader, maxLine int) (line []byte, n int64, err error) {
+	tooLong := false
+	for {
+		chunk, readErr := reader.ReadSlice('\n')
+		n += int64(len(chunk))
+		if !tooLong {
+			if len(line)+len(chunk) > maxLine+1 {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if readErr == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong && (readErr == nil || readErr == io.EOF) {
+			return nil, n, errSpillLineTooLong
+		}
+		return bytes.TrimRight(line, "\n"), n, readErr
+	}
+}
+
+func readReplayOffset(offsetFile string) int64 {
+	content, err := ioutil.ReadFile(offsetFile)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+func writeReplayOffset(offsetFile string, offset int64) error {
+	tmpFile := offsetFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, offsetFile)
+}
+
+// 单个任务panic只记日志，不影响worker继续处理
+func (p *WorkerPool) process(task *AsyncTask) {
+	defer func() {
+		if err := recover(); err != nil {
+			atomic.AddInt64(&p.panics, 1)
+			p.logger.Error("%v task panic: %v\n%s", p.event, err, debug.Stack())
+		}
+	}()
+	p.handle(task)
+}
+
+func (p *WorkerPool) Run(replayInterval time.Duration) {
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for task := range p.queue {
+				p.process(task)
+			}
+		}()
+	}
+	if p.overflow == OverflowSpill {
+		go func() {
+			for {
+				p.replay()
+				time.Sleep(replayInterval)
+			}
+		}()
+	}
+}
+
+func (p *WorkerPool) Status() *WorkerPoolStatus {
+	return &WorkerPoolStatus{
+		Depth:    len(p.queue),
+		Capacity: cap(p.queue),
+		Workers:  p.workers,
+		Overflow: p.overflow,
+		Dropped:  atomic.LoadInt64(&p.dropped),
+		Spilled:  atomic.LoadInt64(&p.spilled),
+		Blocked:  atomic.LoadInt64(&p.blocked),
+		Replayed: atomic.LoadInt64(&p.replayed),
+		Panics:   atomic.LoadInt64(&p.panics),
+	}
+}
+
+// 每种事件一个池子，互不影响
+type WorkerPools struct {
+	pools     map[string]*WorkerPool
+	configure *Configure
+	logger    *logging.Logger
+}
+
+func NewWorkerPools(configure *Configure, handlers map[string]func(task *AsyncTask), logger *logging.Logger) (*WorkerPools, error) {
+	pools := make(map[string]*WorkerPool, len(handlers))
+	for event, handle := range handlers {
+		workers, queueSize, overflow := configure.AsyncWorkers, configure.AsyncQueueSize, configure.AsyncOverflow
+		if value, ok := defaultPoolOverflow[event]; ok {
+			overflow = value
+		}
+		if override, ok := configure.AsyncPools[event]; ok && override != nil {
+			if override.Workers != nil {
+				workers = *override.Workers
+			}
+			if override.QueueSize != nil {
+				queueSize = *override.QueueSize
+			}
+			if override.Overflow != "" {
+				overflow = override.Overflow
+			}
+		}
+		if overflow == OverflowSpill {
+			if err := os.MkdirAll(configure.AsyncSpillDir, 0755); err != nil {
+				return nil, err
+			}
+		}
+		pool, err := NewWorkerPool(event, workers, queueSize, overflow, configure.AsyncSpillDir, handle, logger)
+		if err != nil {
+			return nil, err
+		}
+		pools[event] = pool
+	}
+	return &WorkerPools{pools: pools, configure: configure, logger: logger}, nil
+}
+
+func (wp *WorkerPools) Submit(task *AsyncTask) {
+	pool, ok := wp.pools[task.Event]
+	if !ok {
+		wp.logger.Error("no worker pool for event %v", task.Event)
+		return
+	}
+	pool.Submit(task)
+}
+
+// 不按溢出策略处理，队列满时等待，用于重启后恢复的任务，不能因为队列满就丢掉
+func (wp *WorkerPools) SubmitWait(task *AsyncTask) {
+	pool, ok := wp.pools[task.Event]
+	if !ok {
+		wp.logger.Error("no worker pool for event %v", task.Event)
+		return
+	}
+	pool.queue <- task
+}
+
+func (wp *WorkerPools) Run() {
+	interval := time.Duration(wp.configure.AsyncSpillReplayInterval) * time.Second
+	for _, pool := range wp.pools {
+		pool.Run(interval)
+	}
+}
+
+func (wp *WorkerPools) Status() map[string]*WorkerPoolStatus {
+	status := make(map[string]*WorkerPoolStatus, len(wp.pools))
+	for event, pool := range wp.pools {
+		status[event] = pool.Status()
+	}
+	return status
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestWorkerPool(t *testing.T, queueSize int, overflow string, handle func(task *AsyncTask)) *WorkerPool {
+	spillDir := filepath.Dir(writeTempFile(t, "placeholder", ""))
+	pool, err := NewWorkerPool("click", 1, queueSize, overflow, spillDir, handle, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func spilledTasks(t *testing.T, count int, from int) string {
+	lines := make([]string, 0, count)
+	for i := from; i < from+count; i++ {
+		line, err := json.Marshal(&AsyncTask{Event: "click", Param: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func queuedParams(pool *WorkerPool) []string {
+	params := make([]string, 0)
+	for len(pool.queue) > 0 {
+		params = append(params, (<-pool.queue).Param)
+	}
+	return params
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	cases := []struct {
+		overflow string
+		dropped  int64
+		spilled  int64
+		blocked  int64
+	}{
+		{OverflowDrop, 1, 0, 0},
+		{OverflowSpill, 0, 1, 0},
+		{OverflowBlock, 0, 0, 1},
+	}
+	for _, c := range cases {
+		pool := newTestWorkerPool(t, 1, c.overflow, nil)
+		pool.Submit(&AsyncTask{Event: "click", Param: "0"})
+		submitted := make(chan bool)
+		go func() {
+			pool.Submit(&AsyncTask{Event: "click", Param: "1"})
+			submitted <- true
+		}()
+		if c.overflow == OverflowBlock {
+			// 队列腾出位置之前一直等着
+			select {
+			case <-submitted:
+				t.Fatalf("%v: submit did not block", c.overflow)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if task := <-pool.queue; task.Param != "0" {
+				t.Errorf("%v: first task %v", c.overflow, task.Param)
+			}
+		}
+		<-submitted
+		status := pool.Status()
+		if status.Dropped != c.dropped || status.Spilled != c.spilled || status.Blocked != c.blocked || status.Depth != 1 {
+			t.Errorf("%v: status = %+v", c.overflow, status)
+		}
+		if c.overflow == OverflowSpill {
+			content, err := ioutil.ReadFile(pool.spillFile)
+			if err != nil || strings.Count(string(content), "\n") != 1 {
+				t.Errorf("%v: spill file = %q, %v", c.overflow, content, err)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolReplay(t *testing.T) {
+	cases := []struct {
+		name      string
+		replaying string
+		offset    string
+		spill     string
+		want      []string
+	}{
+		{"spill file", "", "", spilledTasks(t, 3, 0), []string{"0", "1", "2"}},
+		// 上次重放到一半退出，从记下的位置继续
+		{"resume", spilledTasks(t, 5, 0), fmt.Sprint(len(spilledTasks(t, 2, 0))), spilledTasks(t, 1, 5), []string{"2", "3", "4"}},
+		{"invalid offset", spilledTasks(t, 2, 0), "x", "", []string{"0", "1"}},
+		// 新文件不用旧的进度
+		{"stale offset", "", "10", spilledTasks(t, 2, 0), []string{"0", "1"}},
+		// 超长的行跳过，后面的照常重放
+		{"oversized line", "", "", spilledTasks(t, 1, 0) + strings.Repeat("x", maxSpillLine+1) + "\n" + spilledTasks(t, 1, 1),
+			[]string{"0", "1"}},
+		{"oversized last line", "", "", spilledTasks(t, 1, 0) + strings.Repeat("x", maxSpillLine+1), []string{"0"}},
+		{"no trailing newline", "", "", strings.TrimSuffix(spilledTasks(t, 2, 0), "\n"), []string{"0", "1"}},
+	}
+	for _, c := range cases {
+		pool := newTestWorkerPool(t, 10, OverflowSpill, nil)
+		replaying := pool.spillFile + ".replaying"
+		files := map[string]string{pool.spillFile: c.spill, replaying: c.replaying, replaying + ".offset": c.offset}
+		for name, content := range files {
+			if content != "" {
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		pool.replay()
+		if got := queuedParams(pool); !equalStrings(got, c.want) {
+			t.Errorf("%v: replayed %v, want %v", c.name, got, c.want)
+		}
+		for _, name := range []string{replaying, replaying + ".offset"} {
+			if _, err := ioutil.ReadFile(name); err == nil {
+				t.Errorf("%v: %v left", c.name, filepath.Base(name))
+			}
+		}
+	}
+}
+
+func TestWorkerPoolReplayCheckpoint(t *testing.T) {
+	pool := newTestWorkerPool(t, replayCheckpoint*2, OverflowSpill, nil)
+	replaying := pool.spillFile + ".replaying"
+	content := spilledTasks(t, replayCheckpoint+1, 0)
+	if err := ioutil.WriteFile(pool.spillFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 重放中途卡住时，已经记下的进度之后的任务才会再次重放
+	blocked := newTestWorkerPool(t, replayCheckpoint, OverflowSpill, nil)
+	blocked.spillFile = pool.spillFile
+	done := make(chan bool)
+	go func() {
+		blocked.replay()
+		done <- true
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for readReplayOffset(replaying+".offset") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if offset := readReplayOffset(replaying + ".offset"); offset != int64(len(spilledTasks(t, replayCheckpoint, 0))) {
+		t.Fatalf("offset = %v", offset)
+	}
+	pool.replay()
+	if got := queuedParams(pool); !equalStrings(got, []string{fmt.Sprint(replayCheckpoint)}) {
+		t.Errorf("replayed %v after restart", got)
+	}
+	queuedParams(blocked)
+	<-done
+}
+
+func TestWorkerPoolRecover(t *testing.T) {
+	handled := make(chan string, 2)
+	pool := newTestWorkerPool(t, 10, OverflowDrop, func(task *AsyncTask) {
+		if task.Param == "panic" {
+			panic("bad task")
+		}
+		handled <- task.Param
+	})
+	pool.Run(time.Second)
+	pool.Submit(&AsyncTask{Event: "click", Param: "panic"})
+	pool.Submit(&AsyncTask{Event: "click", Param: "ok"})
+	select {
+	case param := <-handled:
+		if param != "ok" {
+			t.Errorf("handled %v", param)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker stopped after panic")
+	}
+	if status := pool.Status(); status.Panics != 1 {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestNewWorkerPools(t *testing.T) {
+	cases := []struct {
+		name     string
+		pools    string
+		event    string
+		workers  int
+		capacity int
+		overflow string
+		ok       bool
+	}{
+		{"defaults", ``, "click", 8, 10000, OverflowDrop, true},
+		{"request spills by default", ``, "request", 8, 10000, OverflowSpill, true},
+		{"request overridden", `{"request": {"overflow": "block"}}`, "request", 8, 10000, OverflowBlock, true},
+		{"zero queue size", `{"click": {"queue_size": 0}}`, "click", 8, 0, OverflowDrop, true},
+		{"workers", `{"click": {"workers": 2, "overflow": "spill"}}`, "click", 2, 10000, OverflowSpill, true},
+		{"zero workers", `{"click": {"workers": 0}}`, "click", 0, 0, "", false},
+		{"unknown overflow", `{"click": {"overflow": "retry"}}`, "click", 0, 0, "", false},
+	}
+	handlers := map[string]func(task *AsyncTask){"request": nil, "click": nil}
+	for _, c := range cases {
+		configure := NewConfigure()
+		configure.AsyncSpillDir = filepath.Dir(writeTempFile(t, "placeholder", ""))
+		if c.pools != "" {
+			if err := json.Unmarshal([]byte(c.pools), &configure.AsyncPools); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pools, err := NewWorkerPools(configure, handlers, testLogger)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: err = %v", c.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		status := pools.Status()[c.event]
+		if status.Workers != c.workers || status.Capacity != c.capacity || status.Overflow != c.overflow {
+			t.Errorf("%v: status = %+v", c.name, status)
+		}
+	}
+}
+
+// 恢复的任务不按溢出策略丢弃，队列满时等待
+func TestWorkerPoolsSubmitWait(t *testing.T) {
+	configure := NewConfigure()
+	configure.AsyncSpillDir = filepath.Dir(writeTempFile(t, "placeholder", ""))
+	queueSize := 1
+	configure.AsyncPools = map[string]*WorkerPoolConfig{"click": {QueueSize: &queueSize}}
+	pools, err := NewWorkerPools(configure, map[string]func(task *AsyncTask){"click": nil}, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := pools.pools["click"]
+	pools.SubmitWait(&AsyncTask{Event: "click", Param: "0"})
+	submitted := make(chan bool)
+	go func() {
+		pools.SubmitWait(&AsyncTask{Event: "click", Param: "1"})
+		submitted <- true
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("SubmitWait did not wait for a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-pool.queue
+	<-submitted
+	if got := queuedParams(pool); !equalStrings(got, []string{"1"}) || pool.Status().Dropped != 0 {
+		t.Errorf("queued %v, status %+v", got, pool.Status())
+	}
+}